@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containers/storage"
+
+	"parallax/common"
+)
+
+// RunChecksum re-verifies the recorded checksums of one image or of every squash file in the store
+func RunChecksum(cfg common.Config) error {
+	log = log.WithField("sub", "checksum")
+	log.Infof("Starting checksum verification in %s", cfg.RoStoragePath)
+
+	var squashFiles []string
+	if cfg.Image != "" {
+		squashPath, err := imageSquashPath(cfg)
+		if err != nil {
+			return err
+		}
+		squashFiles = []string{squashPath}
+	} else {
+		matches, err := filepath.Glob(filepath.Join(cfg.RoStoragePath, "squash", "*.squash"))
+		if err != nil {
+			return err
+		}
+		sort.Strings(matches)
+		squashFiles = matches
+	}
+
+	failed, missing := 0, 0
+	for _, squashPath := range squashFiles {
+		err := common.VerifyChecksum(squashPath)
+		switch {
+		case err == nil:
+			log.Infof("OK %s", squashPath)
+		case errors.Is(err, common.ErrNoChecksum):
+			log.Warnf("MISSING checksum for %s", squashPath)
+			missing++
+		default:
+			log.Errorf("FAILED %v", err)
+			failed++
+		}
+	}
+
+	log.Infof("Checked %d squash files: %d failed, %d without checksum", len(squashFiles), failed, missing)
+	if failed > 0 {
+		return fmt.Errorf("%d squash files do not match their checksum", failed)
+	}
+	return nil
+}
+
+// imageSquashPath locates the squash side-car of cfg.Image, reading the
+// read-only store without opening or mirroring it
+func imageSquashPath(cfg common.Config) (string, error) {
+	img, err := common.FindStoreImage(cfg.RoStoragePath, cfg.Image)
+	if err != nil {
+		return "", fmt.Errorf("locate image %s: %w", cfg.Image, err)
+	}
+	ro, err := roImage(storage.Image{ID: img.ID, TopLayer: img.TopLayer}, cfg)
+	if err != nil {
+		return "", fmt.Errorf("read overlay link: %w", err)
+	}
+	return squashPathOf(cfg, strings.TrimSpace(ro.Link)), nil
+}
@@ -0,0 +1,19 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"parallax/common"
+)
+
+// RunConfigShow prints the effective value of every option and where it was set
+func RunConfigShow(settings []common.Setting) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "OPTION\tVALUE\tSOURCE")
+	for _, s := range settings {
+		fmt.Fprintf(w, "%s\t%q\t%s\n", s.Name, s.Value, s.Source)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,417 @@
+package cmd
+
+import (
+	"bufio"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/containers/storage/pkg/unshare"
+	"golang.org/x/sys/unix"
+
+	"parallax/common"
+	"parallax/mountprogram"
+)
+
+// Outcomes of a doctor check
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "FAIL"
+	checkSkip = "skip"
+)
+
+// checkResult is the outcome of one doctor check, with a hint on how to fix failures
+type checkResult struct {
+	status string
+	detail string
+	hint   string
+}
+
+// doctorChecks run in order, each looks at one thing parallax needs
+var doctorChecks = []struct {
+	name  string
+	check func(common.Config) checkResult
+}{
+	{"dynamic linking", checkDynamicBinary},
+	{"user namespace", checkSubIDs},
+	{"rsync", checkRsync},
+	{"fusermount3", checkFusermount},
+	{"fuse tools", checkFuseTools},
+	{"mount program", checkMountProgram},
+	{"temp directory", checkTempDir},
+	{"podman store", checkPodmanStore},
+	{"read-only store", checkRoStore},
+	{"read-only store access", checkRoStoreAccess},
+	{"mksquashfs", checkMksquashfsBinary},
+	{"mksquashfs options", checkMksquashfsOptions},
+}
+
+// RunDoctor checks the environment parallax runs in and reports what needs fixing
+func RunDoctor(cfg common.Config) error {
+	log = log.WithField("sub", "doctor")
+
+	failed := 0
+	for _, c := range doctorChecks {
+		r := c.check(cfg)
+		fmt.Printf("[%-4s] %s: %s\n", r.status, c.name, r.detail)
+		if r.hint != "" && r.status != checkOK {
+			fmt.Printf("       hint: %s\n", r.hint)
+		}
+		if r.status == checkFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(doctorChecks))
+	}
+	return nil
+}
+
+func checkMksquashfsBinary(cfg common.Config) checkResult {
+	caps, err := common.ProbeMksquashfs(cfg.MksquashfsPath)
+	if err != nil {
+		if cfg.SquashBuilder == common.SquashBuilderBuiltin {
+			return checkResult{status: checkSkip, detail: "not needed by the builtin builder"}
+		}
+		return checkResult{status: checkFail, detail: err.Error(),
+			hint: "install squashfs-tools, point --mksquashfsPath at mksquashfs, or use --squash-builder builtin"}
+	}
+	return checkResult{status: checkOK, detail: fmt.Sprintf("%s version %s, compressors: %s",
+		caps.Path, caps.Version, strings.Join(caps.Compressors, " "))}
+}
+
+func checkMksquashfsOptions(cfg common.Config) checkResult {
+	flags := strings.Join(squashFlags(cfg), " ")
+	if cfg.SquashBuilder == common.SquashBuilderBuiltin {
+		// the command line already rejected what the builtin builder cannot do
+		return checkResult{status: checkOK, detail: flags + " (builtin builder)"}
+	}
+	if _, err := checkMksquashfs(cfg); err != nil {
+		return checkResult{status: checkFail, detail: err.Error(),
+			hint: "change --mksquashfs-opts, or the mksquashfs-opts of the config file or store, to what this mksquashfs supports"}
+	}
+	return checkResult{status: checkOK, detail: flags}
+}
+
+// checkDynamicBinary looks for the ELF interpreter, static binaries cannot use
+// the unshare re-exec of containers/storage
+func checkDynamicBinary(common.Config) checkResult {
+	exe, err := os.Executable()
+	if err != nil {
+		return checkResult{status: checkWarn, detail: err.Error()}
+	}
+	f, err := elf.Open(exe)
+	if err != nil {
+		return checkResult{status: checkWarn, detail: fmt.Sprintf("cannot read %s: %v", exe, err)}
+	}
+	defer f.Close()
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			return checkResult{status: checkOK, detail: exe + " is dynamically linked"}
+		}
+	}
+	return checkResult{status: checkFail, detail: exe + " is statically linked",
+		hint: "rebuild parallax with cgo enabled and without -static, rootless user namespaces need a dynamic binary"}
+}
+
+// checkSubIDs looks up the subordinate id ranges podman maps into the user namespace
+func checkSubIDs(common.Config) checkResult {
+	uid := unshare.GetRootlessUID()
+	if uid == 0 {
+		return checkResult{status: checkSkip, detail: "running as root"}
+	}
+	names := []string{strconv.Itoa(uid)}
+	username := names[0]
+	if u, err := user.LookupId(names[0]); err == nil {
+		username = u.Username
+		names = append(names, u.Username)
+	}
+	hint := fmt.Sprintf("ask an administrator to run 'usermod --add-subuids 100000-165535 --add-subgids 100000-165535 %s'", username)
+
+	var ranges []string
+	for _, file := range []string{"/etc/subuid", "/etc/subgid"} {
+		r, err := subIDRange(file, names)
+		if err != nil {
+			if nsswitchHasSubid() {
+				return checkResult{status: checkWarn, detail: fmt.Sprintf("%v, nsswitch.conf may provide it", err)}
+			}
+			return checkResult{status: checkFail, detail: err.Error(), hint: hint}
+		}
+		ranges = append(ranges, fmt.Sprintf("%s %s", filepath.Base(file), r))
+	}
+	for _, helper := range []string{"newuidmap", "newgidmap"} {
+		if _, err := exec.LookPath(helper); err != nil {
+			return checkResult{status: checkFail, detail: helper + " not found",
+				hint: "install the uidmap (Debian, Ubuntu) or shadow-utils (Fedora, RHEL) package"}
+		}
+	}
+	return checkResult{status: checkOK, detail: strings.Join(ranges, ", ")}
+}
+
+// subIDRange returns the first name:start:count entry of file for one of names
+func subIDRange(file string, names []string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Split(strings.TrimSpace(sc.Text()), ":")
+		if len(fields) == 3 && slices.Contains(names, fields[0]) {
+			return fields[1] + ":" + fields[2], nil
+		}
+	}
+	return "", fmt.Errorf("no range for %s in %s", names[len(names)-1], file)
+}
+
+// nsswitchHasSubid tells whether subordinate ids may come from a service like sssd
+func nsswitchHasSubid() bool {
+	data, err := os.ReadFile("/etc/nsswitch.conf")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "subid:") {
+			return true
+		}
+	}
+	return false
+}
+
+var versionRe = regexp.MustCompile(`version:? *((\d+)\.(\d+)(?:\.\d+)?)`)
+
+// toolVersion runs path with the version flag and returns the major and minor version
+func toolVersion(path, flag string) (string, int, int, error) {
+	out, _ := exec.Command(path, flag).CombinedOutput()
+	m := versionRe.FindStringSubmatch(string(out))
+	if m == nil {
+		return "", 0, 0, fmt.Errorf("no version in the output of %s %s", path, flag)
+	}
+	major, _ := strconv.Atoi(m[2])
+	minor, _ := strconv.Atoi(m[3])
+	return m[1], major, minor, nil
+}
+
+func checkRsync(common.Config) checkResult {
+	hint := "install rsync 3.1 or newer, migrate and rmi mirror the read-only store with it"
+	path, err := exec.LookPath("rsync")
+	if err != nil {
+		return checkResult{status: checkFail, detail: "rsync not found in PATH", hint: hint}
+	}
+	version, major, minor, err := toolVersion(path, "--version")
+	if err != nil {
+		return checkResult{status: checkFail, detail: err.Error(), hint: hint}
+	}
+	// --info=progress2 came with rsync 3.1
+	if major < 3 || major == 3 && minor < 1 {
+		return checkResult{status: checkFail, detail: fmt.Sprintf("%s version %s is too old", path, version), hint: hint}
+	}
+	return checkResult{status: checkOK, detail: fmt.Sprintf("%s version %s", path, version)}
+}
+
+// mountConfig loads the mount program configuration, the mount program check reports its errors
+func mountConfig() (*mountprogram.Config, checkResult) {
+	mpCfg, err := mountprogram.LoadConfig()
+	if err != nil {
+		return nil, checkResult{status: checkSkip, detail: "the mount program configuration is broken"}
+	}
+	return mpCfg, checkResult{}
+}
+
+func checkFusermount(common.Config) checkResult {
+	mpCfg, skipped := mountConfig()
+	if mpCfg == nil {
+		return skipped
+	}
+	if mpCfg.KernelMounts == mountprogram.KernelMountsAlways {
+		return checkResult{status: checkSkip, detail: "PARALLAX_MP_KERNEL_MOUNTS=always does not use FUSE"}
+	}
+	hint := "install fuse3 and make sure fusermount links to fusermount3, FUSE 2 fails with 'mountpoint is not empty'"
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		return checkResult{status: checkFail, detail: "/dev/fuse is missing",
+			hint: "load the fuse kernel module with 'modprobe fuse'"}
+	}
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			continue
+		}
+		version, major, _, err := toolVersion(path, "-V")
+		if err != nil {
+			return checkResult{status: checkFail, detail: err.Error(), hint: hint}
+		}
+		if major < 3 {
+			return checkResult{status: checkFail, detail: fmt.Sprintf("%s version %s is FUSE 2", path, version), hint: hint}
+		}
+		return checkResult{status: checkOK, detail: fmt.Sprintf("%s version %s", path, version)}
+	}
+	return checkResult{status: checkFail, detail: "neither fusermount3 nor fusermount found in PATH", hint: hint}
+}
+
+func checkFuseTools(common.Config) checkResult {
+	mpCfg, skipped := mountConfig()
+	if mpCfg == nil {
+		return skipped
+	}
+	if mpCfg.KernelMounts == mountprogram.KernelMountsAlways {
+		return checkResult{status: checkSkip, detail: "PARALLAX_MP_KERNEL_MOUNTS=always does not use FUSE"}
+	}
+	var found []string
+	for _, dep := range []string{mpCfg.Squashfuse, mpCfg.FuseOverlayfs} {
+		path, err := exec.LookPath(dep)
+		if err != nil {
+			return checkResult{status: checkFail, detail: dep + " not found in PATH",
+				hint: "install squashfuse and fuse-overlayfs, or set PARALLAX_MP_SQUASHFUSE_CMD and PARALLAX_MP_FUSE_OVERLAYFS_CMD"}
+		}
+		found = append(found, path)
+	}
+	return checkResult{status: checkOK, detail: strings.Join(found, ", ")}
+}
+
+// checkMountProgram checks the mount program configuration and that podman uses it
+func checkMountProgram(cfg common.Config) checkResult {
+	if _, err := mountprogram.LoadConfig(); err != nil {
+		return checkResult{status: checkFail, detail: err.Error(),
+			hint: "fix the PARALLAX_MP_* variables or " + mountprogram.DefaultConfigFile}
+	}
+	conf, err := common.ReadStorageConf()
+	if err != nil {
+		return checkResult{status: checkFail, detail: fmt.Sprintf("read storage configuration: %v", err)}
+	}
+	hint := "run 'parallax setup' to configure podman for the read-only store"
+	if conf.MountProgram == "" {
+		return checkResult{status: checkWarn, detail: conf.Source() + " sets no mount_program", hint: hint}
+	}
+	if err := common.IsExecutable(conf.MountProgram); err != nil {
+		return checkResult{status: checkFail, detail: err.Error(), hint: hint}
+	}
+	if cfg.RoStoragePath != "" {
+		store, _ := filepath.Abs(cfg.RoStoragePath)
+		if !slices.Contains(conf.ImageStores, store) && !slices.Contains(conf.ImageStores, cfg.RoStoragePath) {
+			return checkResult{status: checkWarn,
+				detail: fmt.Sprintf("%s is not an additional image store in %s", cfg.RoStoragePath, conf.Source()), hint: hint}
+		}
+	}
+	return checkResult{status: checkOK, detail: fmt.Sprintf("%s (%s)", conf.MountProgram, conf.Source())}
+}
+
+// writableDir checks that path, or the directory it will be created in, can be written
+func writableDir(path string) error {
+	dir := path
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			if err := unix.Access(dir, unix.W_OK|unix.X_OK); err != nil {
+				return fmt.Errorf("%s is not writable", dir)
+			}
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) || dir == filepath.Dir(dir) {
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func checkTempDir(common.Config) checkResult {
+	mpCfg, skipped := mountConfig()
+	if mpCfg == nil {
+		return skipped
+	}
+	dirs := []string{mpCfg.TempParent, mpCfg.TempMountRoot}
+	if mpCfg.LogSink == common.LogSinkFile {
+		dirs = append(dirs, filepath.Dir(mpCfg.LogFile))
+	}
+	for _, dir := range dirs {
+		if err := writableDir(dir); err != nil {
+			return checkResult{status: checkFail, detail: err.Error(),
+				hint: fmt.Sprintf("remove or chown %s, or point PARALLAX_MP_TMPDIR and PARALLAX_MP_LOGFILE elsewhere", dir)}
+		}
+	}
+	return checkResult{status: checkOK, detail: mpCfg.TempParent + " is writable"}
+}
+
+func checkPodmanStore(cfg common.Config) checkResult {
+	if cfg.PodmanRoot == "" {
+		return checkResult{status: checkWarn, detail: "no podman root configured",
+			hint: "pass --podmanRoot or set graphroot in storage.conf"}
+	}
+	if err := common.IsDir(cfg.PodmanRoot); err != nil {
+		return checkResult{status: checkWarn, detail: err.Error(),
+			hint: "pull an image with podman first, migrate copies images from this store"}
+	}
+	return checkResult{status: checkOK, detail: cfg.PodmanRoot}
+}
+
+// fsTypes names the filesystems a read-only store commonly lives on
+var fsTypes = map[int64]string{
+	unix.BTRFS_SUPER_MAGIC:     "btrfs",
+	unix.CEPH_SUPER_MAGIC:      "cephfs",
+	unix.CIFS_SUPER_MAGIC:      "cifs",
+	unix.EXT4_SUPER_MAGIC:      "ext4",
+	unix.FUSE_SUPER_MAGIC:      "fuse",
+	unix.NFS_SUPER_MAGIC:       "nfs",
+	unix.OVERLAYFS_SUPER_MAGIC: "overlay",
+	unix.SMB2_SUPER_MAGIC:      "smb2",
+	unix.TMPFS_MAGIC:           "tmpfs",
+	unix.XFS_SUPER_MAGIC:       "xfs",
+	0x0bd00bd0:                 "lustre",
+	0x47504653:                 "gpfs",
+	0x19830326:                 "beegfs",
+	0x2fc12fc1:                 "zfs",
+}
+
+// checkRoStore checks the store layout and the filesystem it lives on
+func checkRoStore(cfg common.Config) checkResult {
+	if cfg.RoStoragePath == "" {
+		return checkResult{status: checkFail, detail: "no read-only store configured",
+			hint: "pass --roStoragePath or --store, or add an additionalimagestore to storage.conf"}
+	}
+	if err := common.ValidateRoStore(cfg.RoStoragePath); err != nil {
+		return checkResult{status: checkFail, detail: err.Error(),
+			hint: fmt.Sprintf("create an empty directory with 'mkdir -p %s' or point --roStoragePath at a parallax store", cfg.RoStoragePath)}
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(cfg.RoStoragePath, &st); err != nil {
+		return checkResult{status: checkWarn, detail: err.Error()}
+	}
+	fsType, ok := fsTypes[int64(st.Type)]
+	if !ok {
+		fsType = fmt.Sprintf("filesystem type 0x%x", st.Type)
+	}
+	detail := fmt.Sprintf("%s on %s", cfg.RoStoragePath, fsType)
+	switch fsType {
+	case "tmpfs":
+		return checkResult{status: checkWarn, detail: detail,
+			hint: "tmpfs loses the store on reboot, use a persistent or shared filesystem"}
+	case "overlay", "fuse":
+		return checkResult{status: checkWarn, detail: detail,
+			hint: "squash files on overlay or FUSE mounts are slow to mount, prefer a local or network filesystem"}
+	}
+	return checkResult{status: checkOK, detail: detail}
+}
+
+// checkRoStoreAccess checks that migrate and rmi can change the store
+func checkRoStoreAccess(cfg common.Config) checkResult {
+	if common.IsDir(cfg.RoStoragePath) != nil {
+		return checkResult{status: checkSkip, detail: "no usable read-only store"}
+	}
+	if err := writableDir(cfg.RoStoragePath); err != nil {
+		return checkResult{status: checkWarn, detail: err.Error() + ", only reading images from it works",
+			hint: "migrate and rmi need write access, run them as the store owner"}
+	}
+	return checkResult{status: checkOK, detail: cfg.RoStoragePath + " is writable"}
+}
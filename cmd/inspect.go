@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containers/storage"
+	"github.com/sirupsen/logrus"
+
+	"parallax/common"
+)
+
+// inspectInfo is what inspect prints about a migrated image
+type inspectInfo struct {
+	ID            string                `json:"Id"`
+	Names         []string              `json:"Names"`
+	Created       time.Time             `json:"Created"`
+	Digest        string                `json:"Digest,omitempty"`
+	Store         string                `json:"Store"`
+	Squash        string                `json:"Squash"`
+	SquashSize    int64                 `json:"SquashSize"`
+	Checksum      string                `json:"Checksum,omitempty"`
+	SquashOptions *common.SquashOptions `json:"SquashOptions,omitempty"`
+	SquashReport  *common.SquashReport  `json:"SquashReport,omitempty"`
+	ReadyProbes   []string              `json:"ReadyProbes,omitempty"`
+}
+
+// RunInspect prints the details of a migrated image as JSON, including the
+// preset and mksquashfs options its squash side-car was built with
+func RunInspect(cfg common.Config) error {
+	log = log.WithFields(logrus.Fields{"sub": "inspect", "image": cfg.Image})
+	storeRoot := cfg.RoStoragePath
+
+	// inspect only reads, so the store is read from its files instead of being mirrored
+	img, err := common.FindStoreImage(storeRoot, cfg.Image)
+	if err != nil {
+		return fmt.Errorf("locate image %s: %w", cfg.Image, err)
+	}
+	ro, err := roImage(storage.Image{ID: img.ID, TopLayer: img.TopLayer}, cfg)
+	if err != nil {
+		return fmt.Errorf("read overlay link: %w", err)
+	}
+
+	info := inspectInfo{
+		ID:      img.ID,
+		Names:   img.Names,
+		Created: img.Created,
+		Digest:  img.Digest,
+		Store:   storeRoot,
+		Squash:  squashPathOf(cfg, strings.TrimSpace(ro.Link)),
+	}
+	if st, err := os.Stat(info.Squash); err == nil {
+		info.SquashSize = st.Size()
+	} else {
+		log.Warnf("Squash file of %s: %v", img.ID, err)
+	}
+	if info.Checksum, err = common.ReadChecksum(info.Squash); err != nil && !errors.Is(err, common.ErrNoChecksum) {
+		log.Warnf("Checksum of %s: %v", info.Squash, err)
+	}
+	if info.SquashOptions, err = common.ReadSquashOptions(storeRoot, img.ID); err != nil {
+		return err
+	}
+	if info.SquashReport, err = common.ReadSquashReport(storeRoot, img.ID); err != nil {
+		return err
+	}
+	if info.ReadyProbes, err = common.ReadReadyProbes(storeRoot, img.ID); err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(info, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containers/storage"
+	"github.com/docker/go-units"
+
+	"parallax/common"
+)
+
+// RunList prints the images of the read-only stores: the one selected with
+// --store, or every configured store and roStoragePath
+func RunList(cfg common.Config) error {
+	log = log.WithField("sub", "list")
+
+	var stores []common.StoreProfile
+	if cfg.Store != "" {
+		stores = []common.StoreProfile{cfg.Stores[cfg.Store]}
+	} else {
+		stores = common.SortedStores(cfg.Stores)
+		known := false
+		for _, s := range stores {
+			known = known || filepath.Clean(s.Path) == filepath.Clean(cfg.RoStoragePath)
+		}
+		if !known && common.IsDir(cfg.RoStoragePath) == nil {
+			stores = append(stores, common.StoreProfile{Path: cfg.RoStoragePath})
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STORE\tIMAGE ID\tNAME\tSQUASH SIZE\tPRESET")
+	for _, store := range stores {
+		name := store.Name
+		if name == "" {
+			name = store.Path
+		}
+		if err := common.ValidateRoStore(store.Path); err != nil {
+			log.Warnf("Skipping store %s: %v", name, err)
+			continue
+		}
+		imgs, err := common.ReadStoreImages(store.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Warnf("Skipping store %s: %v", name, err)
+			continue
+		}
+		for _, img := range imgs {
+			size := "-"
+			ro, err := roImage(storage.Image{ID: img.ID, TopLayer: img.TopLayer}, common.Config{RoStoragePath: store.Path})
+			if err == nil {
+				if info, err := os.Stat(filepath.Join(store.Path, "squash", strings.TrimSpace(ro.Link)+".squash")); err == nil {
+					size = units.HumanSize(float64(info.Size()))
+				}
+			}
+			preset := "-"
+			if opts, err := common.ReadSquashOptions(store.Path, img.ID); err != nil {
+				log.Warnf("Image %s: %v", shortID(img.ID), err)
+			} else if opts != nil {
+				preset = opts.Preset
+			}
+			names := img.Names
+			if len(names) == 0 {
+				names = []string{"<none>"}
+			}
+			for _, n := range names {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, shortID(img.ID), n, size, preset)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// shortID returns the first 12 characters of an image ID, IDs read from a
+// hand-edited or truncated images.json may be shorter
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
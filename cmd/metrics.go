@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/unshare"
+
+	"parallax/common"
+)
+
+// metrics collects what the running command reports to the node-exporter
+// textfile collector, the series carry the uid of the user running parallax
+var metrics = common.Metrics{Labels: map[string]string{"uid": strconv.Itoa(unshare.GetRootlessUID())}}
+
+// metricsImage is the image the last-run gauges of a migration are labelled
+// with, counters leave it out so their series do not grow with every image
+var metricsImage string
+
+// imageGauge sets a gauge of the last migration of metricsImage
+func imageGauge(name, help string, value float64, labels ...string) {
+	metrics.Gauge(name, help, value, append(labels, "image", metricsImage)...)
+}
+
+// flushMetrics merges the collected metrics into the command's file in dir, if set
+func flushMetrics(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := metrics.Flush(dir, common.MetricsFile("parallax")); err != nil {
+		log.Warnf("Could not write metrics to %s: %v", dir, err)
+	}
+}
+
+// recordMigration counts a finished migration, img is nil when there was nothing to do
+func recordMigration(img *storage.Image, err error) {
+	result := "migrated"
+	switch {
+	case err != nil:
+		result = "failed"
+	case img == nil:
+		result = "skipped"
+	}
+	metrics.Count("parallax_migrations_total", "Migrations by result", 1, "result", result)
+	if result == "migrated" {
+		imageGauge("parallax_migration_last_success_timestamp_seconds", "When the image was last migrated",
+			float64(time.Now().Unix()))
+	}
+}
+
+// recordSquash reports the size of the squash file and how much it shrank the layers
+func recordSquash(store storage.Store, img *storage.Image, squashPath string) {
+	info, err := os.Stat(squashPath)
+	if err != nil {
+		log.Warnf("Cannot stat %s for metrics: %v", squashPath, err)
+		return
+	}
+	imageGauge("parallax_squash_size_bytes", "Size of the squash file", float64(info.Size()))
+
+	layers, err := layerChain(store, img.TopLayer)
+	if err != nil || info.Size() == 0 {
+		return
+	}
+	var size int64
+	for _, id := range layers {
+		layer, err := store.Layer(id)
+		if err != nil || layer.UncompressedSize <= 0 {
+			return // unknown sizes would make the ratio meaningless
+		}
+		size += layer.UncompressedSize
+	}
+	imageGauge("parallax_squash_compression_ratio", "Uncompressed layer size divided by the squash file size",
+		float64(size)/float64(info.Size()))
+}
+
+// squashPathOf returns where the squash file of the layer with link lives in the read-only store
+func squashPathOf(cfg common.Config, link string) string {
+	return filepath.Join(cfg.RoStoragePath, "squash", link+".squash")
+}
@@ -7,9 +7,9 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	imgmanifest "github.com/containers/image/v5/manifest"
 	"github.com/containers/storage"
@@ -17,20 +17,37 @@ import (
 	"github.com/containers/storage/pkg/ioutils"
 	godigest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
 
 	"parallax/common"
 )
 
-func RunMigration(cfg common.Config) (*storage.Image, error) {
-	log = log.WithField("sub", "migration")
+// Prefix of the history comment recording which source image was flattened
+const flattenedComment = "Flattened layers from image "
+
+func RunMigration(cfg common.Config) (flatImg *storage.Image, err error) {
+	log = log.WithFields(logrus.Fields{"sub": "migration", "image": cfg.Image})
 	log.Infof("Starting migration for image: %s", cfg.Image)
+	metricsImage = cfg.Image
+	defer func() {
+		recordMigration(flatImg, err)
+		flushMetrics(cfg.MetricsDir)
+	}()
+	defer timePhase("total")()
 	log.Debugf("Podman Root: %s, Read-only Storage Path: %s, mksquashfs Path: %s",
 	cfg.PodmanRoot, cfg.RoStoragePath, cfg.MksquashfsPath)
 
+	if cfg.SquashBuilder == common.SquashBuilderMksquashfs {
+		caps, err := checkMksquashfs(cfg)
+		if err != nil { return nil, err }
+		log.Debugf("mksquashfs %s supports %s", caps.Version, strings.Join(caps.Compressors, ", "))
+	}
+
 	name := cfg.Image
 	_, names, err := resolveImageNames(name)
 	if err != nil { return nil, err }
 
+	setupDone := timePhase("setup_stores")
 	srcStore, cleanupSrcStore, err := setupSrcStore(cfg)
 	if err != nil { return nil, err }
 	defer cleanupSrcStore()
@@ -38,17 +55,35 @@ func RunMigration(cfg common.Config) (*storage.Image, error) {
 	scratchStore, cleanupScratch, err := setupScratchStore(&cfg)
 	if err != nil { return nil, err }
 	defer cleanupScratch()
+	setupDone()
+
+	srcImg, err := findSourceImage(name, srcStore)
+	if err != nil { return nil, err }
 
-	migrated, err := checkIfMigrated(name, cfg, scratchStore)
+	migrated, previous, err := checkIfMigrated(name, srcImg.ID, cfg, scratchStore)
 	if err != nil || migrated {
 		log.Infof("Image already migrated. Nothing to do.")
 		return nil, err
 	}
 
-	srcImg, mountPoint, cleanupSrc, err := prepareAndMountSourceImage(name, cfg, srcStore)
+	// Without a mount the squash file is built from the layer diffs further down
+	mountPoint := ""
+	if !cfg.NoMount {
+		mountDone := timePhase("mount_source")
+		prog := trackPhase("mount_source", 0)
+		mp, cleanupSrc, err := prepareAndMountSourceImage(srcImg, srcStore)
+		prog.Done()
+		if err != nil { return nil, err }
+		defer cleanupSrc()
+		mountPoint = mp
+		mountDone()
+	}
+
+	// before anything is written, a failing check leaves the stores untouched
+	scan, report, err := checkSource(srcStore, srcImg, mountPoint, cfg)
 	if err != nil { return nil, err }
-	defer cleanupSrc()
 
+	flattenDone := timePhase("flatten")
 	layerDigest, size, dummyDir, cleanupDummy, err := createDummyFlatLayer(name, srcImg)
 	if err != nil { return nil, err }
 	defer cleanupDummy()
@@ -58,19 +93,44 @@ func RunMigration(cfg common.Config) (*storage.Image, error) {
 
 	overlayLink, err := readOverlayLink(newLayer, cfg)
 	if err != nil { return nil, err }
+	flattenDone()
+	log = log.WithField("squash_link", overlayLink)
 
-	err = createSquashSidecarFromMount(mountPoint, overlayLink, cfg)
+	squashDone := timePhase("squash")
+	if cfg.NoMount {
+		err = createSquashSidecarFromLayers(srcImg, srcStore, overlayLink, cfg)
+	} else {
+		err = createSquashSidecarFromMount(mountPoint, overlayLink, scan, cfg)
+	}
 	if err != nil { return nil, err }
+	recordSquash(srcStore, srcImg, squashPathOf(cfg, overlayLink))
+	squashDone()
 
+	imageDone := timePhase("image_metadata")
 	cfgBlob, manifestBlob, manifestDigest, err := generateManifestAndConfig(srcImg, layerDigest, size, cfg, srcStore)
 	if err != nil { return nil, err }
 
-	flatImg, err := createFlattenedImageInStore(scratchStore, names, newLayer, srcImg, manifestDigest)
+	// On re-migration the names are only moved once the new image is complete
+	createNames := names
+	if previous != nil {
+		createNames = nil
+	}
+
+	flatImg, err = createFlattenedImageInStore(scratchStore, createNames, newLayer, srcImg, manifestDigest)
 	if err != nil { return nil, err }
 
 	err = attachMetadataToImage(scratchStore, flatImg, cfgBlob, manifestBlob, srcImg, cfg, srcStore)
 	if err != nil { return nil, err }
 
+	err = recordSquashReport(scratchStore, flatImg, report)
+	if err != nil { return nil, err }
+
+	if previous != nil {
+		err = replacePreviousImage(scratchStore, previous, flatImg, names, cfg)
+		if err != nil { return nil, err }
+	}
+	imageDone()
+
 	log.Infof("Migration successfully completed for image: %s", flatImg.ID)
 	return flatImg, nil
 }
@@ -91,27 +151,33 @@ func resolveImageNames(name string) (string, []string, error) {
 	return fqName, names, nil
 }
 
-func prepareAndMountSourceImage(name string, cfg common.Config, srcStore storage.Store) (*storage.Image, string, func(), error) {
-	sublog := log.WithField("fn", "prep&mount")
-	sublog.Info("Mounting source image")
-
+func findSourceImage(name string, srcStore storage.Store) (*storage.Image, error) {
+	sublog := log.WithField("fn", "findSourceImage")
 	sublog.Debug("Get source image")
+
 	srcImg, err := common.FindImage(srcStore, name)
 	if err != nil {
-		return nil, "", nil, err
+		return nil, err
 	}
+	sublog.Debugf("Source image %s has ID %s", name, srcImg.ID)
+	return &srcImg, nil
+}
+
+func prepareAndMountSourceImage(srcImg *storage.Image, srcStore storage.Store) (string, func(), error) {
+	sublog := log.WithField("fn", "prep&mount")
+	sublog.Info("Mounting source image")
 
 	sublog.Debug("Mounting image")
 	mountPoint, err := srcStore.MountImage(srcImg.ID, nil, "")
 	if err != nil {
-		return nil, "", nil, fmt.Errorf("failed to mount image: %w", err)
+		return "", nil, fmt.Errorf("failed to mount image: %w", err)
 	}
 
 	cleanup := func() {
 		srcStore.UnmountImage(srcImg.ID, true)
 	}
 
-	return &srcImg, mountPoint, cleanup, nil
+	return mountPoint, cleanup, nil
 }
 
 func createDummyFlatLayer(name string, srcImg *storage.Image) (godigest.Digest, int64, string, func(), error) {
@@ -124,7 +190,9 @@ func createDummyFlatLayer(name string, srcImg *storage.Image) (godigest.Digest,
 	}
 
 	sublog.Debug("Calculating digest as podman likes it")
+	prog := trackPhase("digest", 0)
 	layerDigest, size, err := FlattenViaTar(dummyDir, "rootfs")
+	prog.Done()
 	if err != nil {
 		cleanup()
 		return "", 0, "", nil, err
@@ -215,7 +283,7 @@ func setupScratchStore(cfg *common.Config) (storage.Store, func(), error) {
 	// we copy mirror the RoStoragePath to hide the fact that might be a networkedFS
 	mirror, mirrorCleanup, err := common.Mirror(cfg.RoStoragePath)
 	if err != nil {
-		sublog.Debug("Failed to copy mirror: %v", err)
+		sublog.Debugf("Failed to copy mirror: %v", err)
 		return nil, nil, err
 	}
 	sublog.Infof("Copy mirror of %s at %s", cfg.RoStoragePath, mirror)
@@ -242,7 +310,10 @@ func setupScratchStore(cfg *common.Config) (storage.Store, func(), error) {
 	return scratchStore, cleanup, nil
 }
 
-func checkIfMigrated(name string, cfg common.Config, roStore storage.Store) (bool, error) {
+// checkIfMigrated reports whether name is already fully migrated from the source image srcID.
+// When name points to a migration of a different source image, that stale image is
+// returned so the caller can re-migrate and move the name over to the new version.
+func checkIfMigrated(name, srcID string, cfg common.Config, roStore storage.Store) (bool, *storage.Image, error) {
 	sublog := log.WithField("fn", "checkIfMigrated")
 	sublog.Debug("Checking if image is migrated")
 
@@ -250,24 +321,24 @@ func checkIfMigrated(name string, cfg common.Config, roStore storage.Store) (boo
 	if err != nil {
 		if strings.Contains(err.Error(), "Image not found") {
 			sublog.Debugf("Image %s not found", name)
-			return false, nil
+			return false, nil, nil
 		}
-		return false, err
+		return false, nil, err
 	}
 	sublog.Debugf("Found image %s at %s", name, cfg.RoStoragePath)
 
 	// migrated has only one layer, so check TopLayer
 	top := img.TopLayer
 	if top == "" {
-		return false, fmt.Errorf("image %s has no top layer (!?)", name)
+		return false, nil, fmt.Errorf("image %s has no top layer (!?)", name)
 	}
 
 	linkBytes, err := os.ReadFile(filepath.Join(cfg.RoStoragePath, "overlay", top, "link"))
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			return false, nil
+			return false, nil, nil
 		}
-		return false, err
+		return false, nil, err
 	}
 	link := strings.TrimSpace(string(linkBytes))
 	sublog.Debugf("Found top layer link: %s", link)
@@ -277,19 +348,142 @@ func checkIfMigrated(name string, cfg common.Config, roStore storage.Store) (boo
 	squash    := filepath.Join(cfg.RoStoragePath, "squash",      link+".squash")
 	if _, err := os.Stat(lSidecar); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			return false, nil
+			return false, nil, nil
 		}
-		return false, err
+		return false, nil, err
 	}
 	if _, err := os.Stat(squash); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			return false, nil
+			return false, nil, nil
 		}
-		return false, err
+		return false, nil, err
+	}
+
+	sublog.Debug("Checking source image of the migration")
+	migratedFrom, err := migratedSourceID(roStore, &img, cfg)
+	if err != nil {
+		return false, nil, err
+	}
+	if migratedFrom == "" {
+		sublog.Warnf("Could not tell which source image %s was migrated from, assuming it is current", name)
+		return true, nil, nil
+	}
+	if migratedFrom != srcID {
+		sublog.Infof("Image %s was migrated from %s, source is now %s. Re-migrating.", name, migratedFrom, srcID)
+		return false, &img, nil
 	}
 
 	sublog.Debug("Image fully migrated.")
-	return true, nil
+	return true, nil, nil
+}
+
+// imageBigData reads the BigData items of images, from an open store or with roBigData
+// straight from the files of a read-only store
+type imageBigData interface {
+	ImageBigData(id, key string) ([]byte, error)
+}
+
+type roBigData string
+
+func (root roBigData) ImageBigData(id, key string) ([]byte, error) {
+	return common.ReadImageBigData(string(root), id, key)
+}
+
+// migratedSourceID returns the ID of the source image a migrated image was built from.
+// The .migrationv3-* marker in the flattened layer is preferred, the history comment
+// in the image config is used as fallback. An empty ID means it could not be told.
+func migratedSourceID(store imageBigData, img *storage.Image, cfg common.Config) (string, error) {
+	sublog := log.WithField("fn", "migratedSourceID")
+
+	markers, err := filepath.Glob(filepath.Join(cfg.RoStoragePath, "overlay", img.TopLayer, "diff", ".migrationv3-*"))
+	if err != nil {
+		return "", err
+	}
+	for _, marker := range markers {
+		data, err := os.ReadFile(marker)
+		if err != nil {
+			return "", fmt.Errorf("read migration marker: %w", err)
+		}
+		if id := strings.TrimSpace(string(data)); id != "" {
+			sublog.Debugf("Marker %s records source image %s", filepath.Base(marker), id)
+			return id, nil
+		}
+	}
+
+	sublog.Debug("No migration marker found, checking config history")
+	manifestBytes, err := store.ImageBigData(img.ID, storage.ImageDigestManifestBigDataNamePrefix)
+	if missingBigData(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read migrated manifest: %w", err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return "", fmt.Errorf("parsing migrated manifest: %w", err)
+	}
+	configBytes, err := store.ImageBigData(img.ID, manifest.Config.Digest.String())
+	if missingBigData(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read migrated config: %w", err)
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return "", fmt.Errorf("parsing migrated config: %w", err)
+	}
+	for i := len(config.History) - 1; i >= 0; i-- {
+		h := config.History[i]
+		if h.CreatedBy == "MV3" && strings.HasPrefix(h.Comment, flattenedComment) {
+			return strings.TrimPrefix(h.Comment, flattenedComment), nil
+		}
+	}
+	return "", nil
+}
+
+// missingBigData tells whether a BigData read failed because the item is not
+// there, rather than because the store could not be read
+func missingBigData(err error) bool {
+	return errors.Is(err, storage.ErrImageUnknown) || errors.Is(err, os.ErrNotExist)
+}
+
+// replacePreviousImage moves names from the previous migration onto img in a single
+// store update, then keeps the previous image or prunes it with its squash. Only
+// an image left without names is pruned, other tags keep using it.
+func replacePreviousImage(store storage.Store, previous, img *storage.Image, names []string, cfg common.Config) error {
+	sublog := log.WithField("fn", "replacePreviousImage")
+
+	sublog.Infof("Moving names %v from %s to %s", names, previous.ID, img.ID)
+	if err := store.AddNames(img.ID, names); err != nil {
+		return fmt.Errorf("move names to new image: %w", err)
+	}
+
+	previous, err := store.Image(previous.ID)
+	if err != nil {
+		return fmt.Errorf("re-read previous image: %w", err)
+	}
+	if len(previous.Names) > 0 {
+		sublog.Infof("Previous version %s kept, it is still tagged %s", previous.ID, strings.Join(previous.Names, ", "))
+		return nil
+	}
+	if !cfg.PrunePrevious {
+		sublog.Infof("Previous version %s kept untagged, remove it with --rmi --image %s", previous.ID, shortID(previous.ID))
+		return nil
+	}
+
+	sublog.Infof("Pruning previous version %s", previous.ID)
+	prev, err := roImage(*previous, cfg)
+	if err != nil {
+		return fmt.Errorf("locate previous image: %w", err)
+	}
+	if err := RemoveSquashFile(cfg, prev.Link); err != nil {
+		sublog.Warnf("Error removing squash side-cars for layer %s: %v", prev.Link, err)
+	}
+	if _, err := store.DeleteImage(prev.ID, true); err != nil {
+		return fmt.Errorf("delete previous image %s: %w", prev.ID, err)
+	}
+	return nil
 }
 
 // We do this to ensure the creation of a valid and unique layer which podman will accept
@@ -325,32 +519,103 @@ func readOverlayLink(layer *storage.Layer, cfg common.Config) (string, error) {
 	return strings.TrimSpace(string(linkBytes)), nil
 }
 
-func createSquashSidecarFromMount(srcDir, link string, cfg common.Config) error {
-	sublog := log.WithField("fn", "createSquash")
-	sublog.Info("Building squash file")
+// Flags used when no mksquashfs-opts are given, both builders understand them
+var defaultMksquashfsFlags = []string{
+	"-noappend",
+	"-comp", "zstd",
+	"-Xcompression-level", "1",
+	"-noD", "-no-xattrs",
+	"-e", "security.capability",
+}
 
-	squashPath := filepath.Join(cfg.RoStoragePath, "squash", link+".squash")
-	if _, err := os.Stat(squashPath); errors.Is(err, os.ErrNotExist) {
+// squashFlags chooses the default or user provided flags. The default and
+// preset flags drop xattrs unless the xattr policy preserves them.
+func squashFlags(cfg common.Config) []string {
+	if len(cfg.MksquashfsOpts) > 0 && cfg.Preset == "" {
+		return cfg.MksquashfsOpts
+	}
+	flags := defaultMksquashfsFlags
+	if cfg.Preset != "" {
+		flags = cfg.MksquashfsOpts
+	}
+	if cfg.XattrPolicy == common.XattrPolicyPreserve {
+		return preserveXattrFlags(flags)
+	}
+	return flags
+}
 
-		// Choose default or user provided flags
-		defaultFlags := []string {
-			"-noappend",
-			"-comp", "zstd",
-			"-Xcompression-level", "1",
-			"-noD", "-no-xattrs",
-			"-e", "security.capability", 
-		}
-		flags := defaultFlags
-		if len(cfg.MksquashfsOpts) > 0 {
-			flags = cfg.MksquashfsOpts
+// squashPreset names what the flags of squashFlags come from
+func squashPreset(cfg common.Config) string {
+	switch {
+	case cfg.Preset != "":
+		return cfg.Preset
+	case len(cfg.MksquashfsOpts) > 0:
+		return common.PresetCustom
+	}
+	return common.PresetDefault
+}
+
+// checkMksquashfs makes sure mksquashfs can build the squash file with our flags,
+// so a migration does not fail halfway leaving layers behind in the stores
+func checkMksquashfs(cfg common.Config) (*common.MksquashfsCaps, error) {
+	caps, err := common.ProbeMksquashfs(cfg.MksquashfsPath)
+	if err != nil {
+		return nil, fmt.Errorf("probe mksquashfs: %w", err)
+	}
+	flags := append(append([]string{}, squashFlags(cfg)...), ownerFlags(cfg.Ownership, "owners.pseudo")...)
+	if err := caps.Validate(flags); err != nil {
+		return caps, err
+	}
+	return caps, nil
+}
+
+// createSquashSidecarFromMount builds the squash file from the mounted source,
+// using what its scan found instead of walking it again
+func createSquashSidecarFromMount(srcDir, link string, scan *sourceScan, cfg common.Config) error {
+	return createSquashSidecar(link, cfg, func(squashPath string, flags []string) error {
+		if cfg.SquashBuilder == common.SquashBuilderBuiltin {
+			return buildSquashFromDir(srcDir, squashPath, flags, scan.size, cfg.Ownership)
 		}
 
+		ownerArgs, cleanup, err := mksquashfsOwnerArgs(scan.owners, cfg.Ownership)
+		if err != nil { return err }
+		defer cleanup()
+
 		// Build mksquashfs command
 		arg := append([]string{srcDir, squashPath}, flags...)
-		cmd := exec.Command(cfg.MksquashfsPath, arg...)
-		if out, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("mksquashfs: %v\n%s", err, out)
+		arg = append(arg, ownerArgs...)
+		return runMksquashfs(cfg.MksquashfsPath, scan.size, arg)
+	})
+}
+
+// createSquashSidecarFromLayers builds the squash file from the layer diffs, no mount needed
+func createSquashSidecarFromLayers(srcImg *storage.Image, srcStore storage.Store, link string, cfg common.Config) error {
+	return createSquashSidecar(link, cfg, func(squashPath string, flags []string) error {
+		return buildSquashFromLayers(srcStore, srcImg, squashPath, flags, cfg.Ownership)
+	})
+}
+
+func createSquashSidecar(link string, cfg common.Config, build func(squashPath string, flags []string) error) error {
+	sublog := log.WithField("fn", "createSquash")
+	sublog.Info("Building squash file")
+
+	squashPath := squashPathOf(cfg, link)
+	if _, err := os.Stat(squashPath); errors.Is(err, os.ErrNotExist) {
+
+		flags := squashFlags(cfg)
+		sublog.Infof("Squash options (%s): %s", squashPreset(cfg), strings.Join(flags, " "))
+		if !cfg.Ownership.IsZero() {
+			sublog.Infof("Squash owners: %s", ownershipSummary(cfg.Ownership))
 		}
+
+		start := time.Now()
+		if err := build(squashPath, flags); err != nil { return err }
+		imageGauge("parallax_squash_build_duration_seconds", "How long building the squash file took",
+			time.Since(start).Seconds(), "builder", cfg.SquashBuilder)
+
+		if err := recordSquashChecksum(squashPath); err != nil { return err }
+	} else if _, err := common.ReadChecksum(squashPath); errors.Is(err, common.ErrNoChecksum) {
+		if err := recordSquashChecksum(squashPath); err != nil { return err }
 	}
 
 	sublog.Info("Symlinking squash")
@@ -360,6 +625,18 @@ func createSquashSidecarFromMount(srcDir, link string, cfg common.Config) error
 	return ensureSymlink( filepath.Join("..", "..", "squash", link+".squash"), filepath.Join(lDir, link+".squash"))
 }
 
+func recordSquashChecksum(squashPath string) error {
+	sublog := log.WithField("fn", "recordSquashChecksum")
+	sublog.Info("Recording squash checksum")
+
+	sum, err := common.WriteChecksum(squashPath)
+	if err != nil {
+		return fmt.Errorf("record squash checksum: %w", err)
+	}
+	sublog.Debugf("sha256 of %s is %s", squashPath, sum)
+	return nil
+}
+
 func ensureSymlink(target, linkname string) error {
 	_, err := os.Lstat(linkname)
 	if err == nil { return nil }
@@ -396,7 +673,7 @@ func generateManifestAndConfig(srcImg *storage.Image, layerDigest godigest.Diges
 		DiffIDs: []godigest.Digest{layerDigest},
 	}
 	originalConfig.History = append(originalConfig.History, ocispec.History{
-		CreatedBy: "MV3", Comment: "Flattened layers from image " + srcImg.ID,
+		CreatedBy: "MV3", Comment: flattenedComment + srcImg.ID,
 	})
 	cfgBytes, err := json.Marshal(originalConfig)
 	if err != nil {
@@ -490,6 +767,34 @@ func attachMetadataToImage(store storage.Store, img *storage.Image, cfgBlob, man
 		}
 	}
 
+	sublog.Debug("Attaching squash options")
+	squashOpts, err := json.Marshal(common.SquashOptions{
+		Preset:  squashPreset(cfg),
+		Builder: cfg.SquashBuilder,
+		Options: squashFlags(cfg),
+		Xattrs:  keepsXattrs(squashFlags(cfg)),
+		Owner:   ownerString(cfg.Ownership),
+		UIDMap:  cfg.Ownership.UIDs.Strings(),
+		GIDMap:  cfg.Ownership.GIDs.Strings(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := store.SetImageBigData(img.ID, common.SquashOptionsKey, squashOpts, nil); err != nil {
+		return err
+	}
+
+	if len(cfg.ReadyProbes) > 0 {
+		sublog.Infof("Attaching readiness probes %v", cfg.ReadyProbes)
+		probes, err := json.Marshal(cfg.ReadyProbes)
+		if err != nil {
+			return err
+		}
+		if err := store.SetImageBigData(img.ID, common.ReadyProbesKey, probes, nil); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containers/storage"
+
+	"parallax/common"
+	"parallax/mountprogram"
+)
+
+// RunMountsGC unmounts the squash mounts left behind by crashed nodes or killed
+// watchers, removes their directories and rotates the mount program log
+func RunMountsGC() error {
+	log = log.WithField("sub", "mounts-gc")
+
+	cfg, err := mountprogram.LoadConfig()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(cfg.TempMountRoot); errors.Is(err, os.ErrNotExist) {
+		log.Infof("Nothing to clean up, %s does not exist", cfg.TempMountRoot)
+		return nil
+	}
+	log.Infof("Collecting stale mounts in %s", cfg.TempMountRoot)
+
+	report, err := mountprogram.CollectGarbage(cfg, log)
+	if err != nil {
+		return err
+	}
+	if report.RotatedLog != "" {
+		log.Infof("Rotated %s to %s", cfg.LogFile, report.RotatedLog)
+	}
+	log.Infof("Unmounted %d squash mounts, %d in use, removed %d leftover directories",
+		len(report.Unmounted), len(report.InUse), len(report.RemovedDirs))
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d squash mounts could not be unmounted", len(report.Failed))
+	}
+	return nil
+}
+
+// RunMountsList prints the squash mounts of the mount program, the image they
+// belong to and the containers stacked on them
+func RunMountsList(cfg common.Config) error {
+	log = log.WithField("sub", "mounts-list")
+
+	mpCfg, err := mountprogram.LoadConfig()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(mpCfg.TempMountRoot); errors.Is(err, os.ErrNotExist) {
+		log.Infof("No squash mounts, %s does not exist", mpCfg.TempMountRoot)
+		return nil
+	}
+	mounts, err := mountprogram.ListMounts(mpCfg)
+	if err != nil {
+		return err
+	}
+	images, err := imagesByLink(cfg)
+	if err != nil {
+		// the mounts are still worth showing
+		log.Warnf("Cannot map squash files to images in %s: %v", cfg.RoStoragePath, err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MOUNT POINT\tSQUASH\tIMAGE\tPID\tAGE")
+	for _, m := range mounts {
+		squash, image := "-", "-"
+		if m.Squash != "" {
+			squash = m.Squash
+			link := strings.TrimSuffix(filepath.Base(m.Squash), ".squash")
+			if names, ok := images[link]; ok {
+				image = strings.Join(names, ",")
+			}
+		}
+		pid := "-"
+		if m.PID > 0 {
+			pid = strconv.Itoa(m.PID)
+		}
+		age := "-"
+		if !m.Since.IsZero() {
+			age = time.Since(m.Since).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", m.Dir, squash, image, pid, age)
+		for _, o := range m.Users {
+			pid := "-"
+			if o.PID > 0 {
+				pid = strconv.Itoa(o.PID)
+			}
+			fmt.Fprintf(w, "  └ %s\t\t\t%s\t\n", o.Target, pid)
+		}
+	}
+	return w.Flush()
+}
+
+// imagesByLink maps the overlay links of the read-only store to the names of
+// their images, without opening the store
+func imagesByLink(cfg common.Config) (map[string][]string, error) {
+	imgs, err := common.ReadStoreImages(cfg.RoStoragePath)
+	if err != nil {
+		return nil, err
+	}
+
+	byLink := map[string][]string{}
+	for _, img := range imgs {
+		ro, err := roImage(storage.Image{ID: img.ID, TopLayer: img.TopLayer}, cfg)
+		if err != nil {
+			continue
+		}
+		names := img.Names
+		if len(names) == 0 {
+			names = []string{shortID(img.ID)}
+		}
+		link := strings.TrimSpace(ro.Link)
+		byLink[link] = append(byLink[link], names...)
+	}
+	return byLink, nil
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"parallax/common"
+	"parallax/squashfs"
+)
+
+// remapOwners rewrites the owners of the tree the builtin builder is about to write
+func remapOwners(root *squashfs.Node, o common.Ownership) {
+	if o.IsZero() {
+		return
+	}
+	seen := map[*squashfs.Node]bool{}
+	var walk func(n *squashfs.Node)
+	walk = func(n *squashfs.Node) {
+		// hard links share their node
+		if seen[n] {
+			return
+		}
+		seen[n] = true
+		n.UID, n.GID = o.Apply(n.UID, n.GID)
+		if n.Mode.IsDir() {
+			for _, name := range n.Children() {
+				walk(n.Child(name))
+			}
+		}
+	}
+	walk(root)
+}
+
+// ownerFlags are the mksquashfs options rewriting the owners, pseudoFile is
+// the file with the modify definitions of the ID maps
+func ownerFlags(o common.Ownership, pseudoFile string) []string {
+	switch {
+	case o.Owner != nil:
+		return []string{"-force-uid", strconv.FormatUint(uint64(o.Owner.UID), 10),
+			"-force-gid", strconv.FormatUint(uint64(o.Owner.GID), 10)}
+	case !o.IsZero():
+		return []string{"-pf", pseudoFile}
+	}
+	return nil
+}
+
+// mksquashfsOwnerArgs returns the mksquashfs options rewriting the owners, and
+// a cleanup removing the pseudo file holding the definitions the scan of the
+// source collected for the ID maps
+func mksquashfsOwnerArgs(definitions []string, o common.Ownership) ([]string, func(), error) {
+	if o.IsZero() || o.Owner != nil {
+		return ownerFlags(o, ""), func() {}, nil
+	}
+	dir, cleanup, err := common.TempDir("parallax-owners-")
+	if err != nil {
+		return nil, nil, err
+	}
+	pseudoFile := filepath.Join(dir, "owners.pseudo")
+	if err := os.WriteFile(pseudoFile, []byte(strings.Join(definitions, "")), 0o644); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("owner pseudo file: %w", err)
+	}
+	log.Infof("Rewriting the owners of %d entries", len(definitions))
+	return ownerFlags(o, pseudoFile), cleanup, nil
+}
+
+// ownerPseudoLine returns the pseudo file definition changing the owner of the
+// entry at rel below the source as the ID maps rewrite it, keeping its
+// permissions, and false when they keep its owner
+func ownerPseudoLine(rel string, info fs.FileInfo, st *syscall.Stat_t, o common.Ownership) (string, bool) {
+	uid, gid := o.Apply(st.Uid, st.Gid)
+	if uid == st.Uid && gid == st.Gid {
+		return "", false
+	}
+	return fmt.Sprintf("%s m %04o %d %d\n", pseudoName(rel), unixPerm(info.Mode()), uid, gid), true
+}
+
+// pseudoName quotes a path of the source for a pseudo file definition
+func pseudoName(rel string) string {
+	if rel == "." {
+		return "/"
+	}
+	name := path.Clean(filepath.ToSlash(rel))
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
+
+// unixPerm returns the permission bits of mode as the kernel has them
+func unixPerm(mode fs.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		perm |= syscall.S_ISUID
+	}
+	if mode&fs.ModeSetgid != 0 {
+		perm |= syscall.S_ISGID
+	}
+	if mode&fs.ModeSticky != 0 {
+		perm |= syscall.S_ISVTX
+	}
+	return perm
+}
+
+// ownershipSummary describes the owner rewriting for logs and the recorded squash options
+func ownershipSummary(o common.Ownership) string {
+	var parts []string
+	if o.Owner != nil {
+		parts = append(parts, "owner "+o.Owner.String())
+	}
+	if len(o.UIDs) > 0 {
+		parts = append(parts, "uids "+strings.Join(o.UIDs.Strings(), ","))
+	}
+	if len(o.GIDs) > 0 {
+		parts = append(parts, "gids "+strings.Join(o.GIDs.Strings(), ","))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func ownerString(o common.Ownership) string {
+	if o.Owner == nil {
+		return ""
+	}
+	return o.Owner.String()
+}
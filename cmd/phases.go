@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// timePhase starts timing a phase of a command, the returned func logs its
+// duration and records it in the metrics
+func timePhase(name string) func() {
+	start := time.Now()
+	return func() {
+		d := time.Since(start)
+		log.WithFields(logrus.Fields{"phase": name, "duration_ms": d.Milliseconds()}).
+			Infof("Phase %s took %s", name, d.Round(time.Millisecond))
+		imageGauge("parallax_migration_phase_duration_seconds", "Duration of the phases of the last migration",
+			d.Seconds(), "phase", name)
+	}
+}
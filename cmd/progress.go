@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"parallax/common"
+)
+
+// trackPhase starts reporting the progress of a phase, total is in bytes or 0 when unknown
+func trackPhase(name string, total int64) *common.Progress {
+	return common.StartProgress(log, name, total)
+}
+
+// dirSize adds up the sizes of the regular files below dir, the bytes a squash builder reads
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// mksquashfsPercent matches the progress bar of mksquashfs, "[===|   ] 123/456  27%",
+// and the bare numbers it prints with -percentage
+var mksquashfsPercent = regexp.MustCompile(`^(?:\[.*\]\s+\d+/\d+\s+|\s*)(\d{1,3})%?\s*$`)
+
+// runMksquashfs runs mksquashfs with progress for the squash phase. The
+// percentage mksquashfs prints is used when there is one, otherwise the bytes
+// it read so far are compared to size, the bytes of the files it packs.
+func runMksquashfs(path string, size int64, args []string) error {
+	prog := trackPhase("squash", size)
+	defer prog.Done()
+
+	var out bytes.Buffer
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = &out
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("mksquashfs: %w", err)
+	}
+
+	stopPolling := make(chan struct{})
+	go pollBytesRead(cmd.Process.Pid, prog, stopPolling)
+	var other bytes.Buffer
+	prog.TrackPercent(stdout, mksquashfsPercent, &other)
+	err = cmd.Wait()
+	close(stopPolling)
+	if err != nil {
+		return fmt.Errorf("mksquashfs: %v\n%s%s", err, other.Bytes(), out.Bytes())
+	}
+	return nil
+}
+
+// pollBytesRead sets the bytes done to what the process read, from /proc/<pid>/io
+func pollBytesRead(pid int, prog *common.Progress, stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if n, ok := readBytesRead(pid); ok {
+				prog.SetDone(n)
+			}
+		}
+	}
+}
+
+func readBytesRead(pid int) (int64, bool) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/io", pid))
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "rchar: "); ok {
+			n, err := strconv.ParseInt(v, 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,441 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containers/storage"
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"parallax/common"
+	"parallax/squashfs"
+)
+
+// RunResquash rebuilds the squash side-car of a migrated image with the current
+// mksquashfs options. The source image is not needed: the old side-car is read
+// back, the new one is compared with it and then replaces it in place, so the
+// image ID and overlay link stay the same.
+func RunResquash(cfg common.Config) error {
+	log = log.WithFields(logrus.Fields{"sub": "resquash", "image": cfg.Image})
+	log.Infof("Starting resquash for image: %s", cfg.Image)
+
+	// the side-car already has the owners its migration gave it
+	if !cfg.Ownership.IsZero() {
+		log.Warnf("Squash owners (%s) only apply when migrating, the side-car keeps its owners", ownershipSummary(cfg.Ownership))
+		cfg.Ownership = common.Ownership{}
+	}
+	if cfg.SquashBuilder == common.SquashBuilderMksquashfs {
+		if _, err := checkMksquashfs(cfg); err != nil {
+			return err
+		}
+	}
+	storeRoot := cfg.RoStoragePath
+
+	// the store is only mirrored to record the new squash options at the end
+	img, err := common.FindStoreImage(storeRoot, cfg.Image)
+	if err != nil {
+		return fmt.Errorf("locate image %s: %w", cfg.Image, err)
+	}
+	ro, err := roImage(storage.Image{ID: img.ID, TopLayer: img.TopLayer}, cfg)
+	if err != nil {
+		return fmt.Errorf("read overlay link: %w", err)
+	}
+	link := strings.TrimSpace(ro.Link)
+	log = log.WithField("squash_link", link)
+	squashPath := squashPathOf(common.Config{RoStoragePath: storeRoot}, link)
+
+	// a damaged side-car would be carried over into the new one
+	if err := common.VerifyChecksum(squashPath); err != nil && !errors.Is(err, common.ErrNoChecksum) {
+		return err
+	}
+	oldInfo, err := os.Stat(squashPath)
+	if err != nil {
+		return err
+	}
+
+	// built next to the old file, so the final rename replaces it atomically
+	newPath := squashPath + ".resquash"
+	defer os.Remove(newPath)
+
+	flags := squashFlags(cfg)
+	log.Infof("Squash options (%s): %s", squashPreset(cfg), strings.Join(flags, " "))
+	start := time.Now()
+	if cfg.SquashBuilder == common.SquashBuilderBuiltin {
+		err = buildSquashFromSquash(squashPath, newPath, flags)
+	} else {
+		err = resquashWithMksquashfs(squashPath, newPath, flags, cfg)
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("Built %s in %s", newPath, time.Since(start).Round(time.Millisecond))
+
+	excludes, err := excludedPaths(flags)
+	if err != nil {
+		return err
+	}
+	diffs, err := compareSquashFiles(squashPath, newPath, excludes)
+	if err != nil {
+		return err
+	}
+	if len(diffs) > 0 {
+		for _, d := range diffs {
+			log.Warnf("DIFF %s", d)
+		}
+		return fmt.Errorf("%d differences between the rebuilt and the old squash file, keeping the old one", len(diffs))
+	}
+
+	newInfo, err := os.Stat(newPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(newPath, squashPath); err != nil {
+		return fmt.Errorf("replace %s: %w", squashPath, err)
+	}
+	if err := recordSquashChecksum(squashPath); err != nil {
+		return err
+	}
+
+	recorded := common.SquashOptions{
+		Preset:  squashPreset(cfg),
+		Builder: cfg.SquashBuilder,
+		Options: flags,
+		Xattrs:  keepsXattrs(flags),
+	}
+	if prev, err := common.ReadSquashOptions(storeRoot, img.ID); err == nil && prev != nil {
+		recorded.Owner, recorded.UIDMap, recorded.GIDMap = prev.Owner, prev.UIDMap, prev.GIDMap
+	}
+	squashOpts, err := json.Marshal(recorded)
+	if err != nil {
+		return err
+	}
+	if err := recordResquashOptions(cfg, img.ID, squashOpts); err != nil {
+		return err
+	}
+
+	log.Infof("Resquash successfully completed for image %s: %s -> %s", img.ID,
+		units.HumanSize(float64(oldInfo.Size())), units.HumanSize(float64(newInfo.Size())))
+	return nil
+}
+
+// recordResquashOptions stores the options the side-car was rebuilt with, the
+// one write to the image records of the store
+func recordResquashOptions(cfg common.Config, imageID string, squashOpts []byte) error {
+	store, cleanup, err := setupScratchStore(&cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if err := store.SetImageBigData(imageID, common.SquashOptionsKey, squashOpts, nil); err != nil {
+		return fmt.Errorf("record squash options: %w", err)
+	}
+	return nil
+}
+
+// excludedPaths returns the paths given to -e or listed in -ef files, relative to the image root
+func excludedPaths(flags []string) ([]string, error) {
+	var excludes []string
+	for i := 0; i < len(flags); i++ {
+		switch {
+		case flags[i] == "-e":
+			for i+1 < len(flags) && !strings.HasPrefix(flags[i+1], "-") {
+				i++
+				excludes = append(excludes, path.Clean("/"+flags[i]))
+			}
+		case flags[i] == "-ef" && i+1 < len(flags):
+			i++
+			paths, err := squashfs.ReadExcludeFile(flags[i])
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range paths {
+				excludes = append(excludes, path.Clean("/"+p))
+			}
+		}
+	}
+	return excludes, nil
+}
+
+// buildSquashFromSquash streams the tree of oldPath into a new squash file
+// written by the builtin builder, without unpacking it
+func buildSquashFromSquash(oldPath, newPath string, flags []string) error {
+	opts, _, err := squashfs.ParseMksquashfsArgs(flags)
+	if err != nil {
+		return err
+	}
+	excludes, err := excludedPaths(flags)
+	if err != nil {
+		return err
+	}
+	skip := map[string]bool{}
+	for _, e := range excludes {
+		skip[e] = true
+	}
+
+	in, err := os.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, err := squashfs.Open(in)
+	if err != nil {
+		return fmt.Errorf("read squash file %s: %w", oldPath, err)
+	}
+
+	tmp := newPath + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	w, err := squashfs.NewWriter(out, opts)
+	if err != nil {
+		return err
+	}
+
+	prog := trackPhase("squash", squashContentSize(r))
+	defer prog.Done()
+
+	var root *squashfs.Node
+	links := map[uint32]*squashfs.Node{}
+	err = r.Walk(func(e *squashfs.Entry) error {
+		if skip[e.Path] {
+			if e.Mode.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		node := links[e.Inode]
+		if node == nil {
+			node = &squashfs.Node{Mode: e.Mode, UID: e.UID, GID: e.GID, ModTime: e.ModTime, Xattrs: e.Xattrs,
+				Target: e.Target, Major: e.Major, Minor: e.Minor}
+			switch {
+			case e.Mode.IsDir():
+				node = squashfs.NewDir(e.Mode&^fs.ModeType, e.UID, e.GID, e.ModTime)
+				node.Xattrs = e.Xattrs
+			case e.Mode.IsRegular():
+				rd, err := r.Open(e)
+				if err != nil {
+					return err
+				}
+				if node.Data, err = w.WriteFile(prog.Reader(rd)); err != nil {
+					return fmt.Errorf("%s: %w", e.Path, err)
+				}
+			}
+			if !e.Mode.IsDir() && e.Nlink > 1 {
+				links[e.Inode] = node
+			}
+		}
+		if e.Path == "/" {
+			root = node
+			return nil
+		}
+		parent := root.Lookup(path.Dir(e.Path))
+		if parent == nil {
+			return fmt.Errorf("%s: parent directory missing", e.Path)
+		}
+		return parent.SetChild(path.Base(e.Path), node)
+	})
+	if err != nil {
+		return fmt.Errorf("builtin squash builder: %w", err)
+	}
+	if err := w.Finish(root); err != nil {
+		return fmt.Errorf("builtin squash builder: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, newPath)
+}
+
+// squashContentSize adds up the size of the regular files of a squash file
+func squashContentSize(r *squashfs.Reader) int64 {
+	var size int64
+	r.Walk(func(e *squashfs.Entry) error {
+		if e.Mode.IsRegular() {
+			size += e.Size
+		}
+		return nil
+	})
+	return size
+}
+
+// resquashWithMksquashfs unpacks oldPath into a temporary directory and runs mksquashfs on it
+func resquashWithMksquashfs(oldPath, newPath string, flags []string, cfg common.Config) error {
+	dir, err := os.MkdirTemp("", "resquash-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := unsquash(oldPath, dir); err != nil {
+		return fmt.Errorf("unpack %s: %w", oldPath, err)
+	}
+	return runMksquashfs(cfg.MksquashfsPath, dirSize(dir), append([]string{dir, newPath}, flags...))
+}
+
+// unsquash writes the tree of a squash file below dir, keeping owners, modes,
+// xattrs, hard links and modification times
+func unsquash(squashPath, dir string) error {
+	f, err := os.Open(squashPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := squashfs.Open(f)
+	if err != nil {
+		return err
+	}
+
+	prog := trackPhase("unsquash", squashContentSize(r))
+	defer prog.Done()
+
+	links := map[uint32]string{}
+	var dirs []*squashfs.Entry
+	err = r.Walk(func(e *squashfs.Entry) error {
+		p := filepath.Join(dir, filepath.FromSlash(e.Path))
+		if first, ok := links[e.Inode]; ok {
+			return os.Link(first, p)
+		}
+		switch {
+		case e.Mode.IsDir():
+			// writable until its entries are in, the real mode is set afterwards
+			if e.Path != "/" {
+				if err := os.Mkdir(p, 0o700); err != nil {
+					return err
+				}
+			}
+			dirs = append(dirs, e)
+			return nil
+		case e.Mode.IsRegular():
+			rd, err := r.Open(e)
+			if err != nil {
+				return err
+			}
+			if err := writeFile(p, prog.Reader(rd)); err != nil {
+				return err
+			}
+		case e.Mode&fs.ModeSymlink != 0:
+			if err := os.Symlink(e.Target, p); err != nil {
+				return err
+			}
+		default:
+			if err := unix.Mknod(p, specialFileType(e.Mode), int(unix.Mkdev(e.Major, e.Minor))); err != nil {
+				return fmt.Errorf("create %s: %w", e.Path, err)
+			}
+		}
+		if !e.Mode.IsDir() && e.Nlink > 1 {
+			links[e.Inode] = p
+		}
+		return setEntryMetadata(p, e)
+	})
+	if err != nil {
+		return err
+	}
+	// children first, so setting a directory's time is not undone by its entries
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setEntryMetadata(filepath.Join(dir, filepath.FromSlash(dirs[i].Path)), dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFile(p string, r io.Reader) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", p, err)
+	}
+	return f.Close()
+}
+
+func specialFileType(m fs.FileMode) uint32 {
+	switch {
+	case m&fs.ModeCharDevice != 0:
+		return unix.S_IFCHR
+	case m&fs.ModeDevice != 0:
+		return unix.S_IFBLK
+	case m&fs.ModeNamedPipe != 0:
+		return unix.S_IFIFO
+	}
+	return unix.S_IFSOCK
+}
+
+// setEntryMetadata applies owner, mode, xattrs and modification time of e to p
+func setEntryMetadata(p string, e *squashfs.Entry) error {
+	if err := os.Lchown(p, int(e.UID), int(e.GID)); err != nil {
+		return err
+	}
+	// after chown, which clears the setuid and setgid bits
+	if e.Mode&fs.ModeSymlink == 0 {
+		if err := os.Chmod(p, e.Mode&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	for name, value := range e.Xattrs {
+		if err := unix.Lsetxattr(p, name, value, 0); err != nil {
+			return fmt.Errorf("set xattr %s on %s: %w", name, e.Path, err)
+		}
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(e.ModTime.UnixNano()), unix.NsecToTimespec(e.ModTime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// compareSquashFiles lists the differences between the trees of two squash
+// files, leaving out the excluded paths of the old one
+func compareSquashFiles(oldPath, newPath string, excludes []string) ([]string, error) {
+	sublog := log.WithField("fn", "compareSquashFiles")
+
+	var readers []*squashfs.Reader
+	for _, p := range []string{oldPath, newPath} {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r, err := squashfs.Open(f)
+		if err != nil {
+			return nil, fmt.Errorf("read squash file %s: %w", p, err)
+		}
+		readers = append(readers, r)
+	}
+	want, err := squashTree(readers[0])
+	if err != nil {
+		return nil, err
+	}
+	got, err := squashTree(readers[1])
+	if err != nil {
+		return nil, err
+	}
+	for p := range want {
+		for _, e := range excludes {
+			if p == e || strings.HasPrefix(p, e+"/") {
+				delete(want, p)
+			}
+		}
+	}
+
+	withXattrs := readers[1].HasXattrs()
+	if !withXattrs {
+		if n := countWithXattrs(want); n > 0 {
+			sublog.Warnf("New squash file is built without xattrs, dropping the xattrs of %d entries", n)
+		}
+	}
+	sublog.Infof("Comparing %d old entries with %d new entries", len(want), len(got))
+	return compareTrees(want, got, withXattrs)
+}
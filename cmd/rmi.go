@@ -20,14 +20,14 @@ type RoImage struct {
 var log = logrus.WithField("component", "cmd")
 
 func RunRmi(cfg common.Config) error {
-	log = log.WithField("sub", "rmi")
+	log = log.WithFields(logrus.Fields{"sub": "rmi", "image": cfg.Image})
 	log.Infof("Starting removal of image: %s", cfg.Image)
 	log.Debugf("Podman Root: %s, Read-only Storage Path: %s", cfg.PodmanRoot, cfg.RoStoragePath)
 
     // we copy mirror the RoStoragePath to hide the fact that might be a networkedFS
     mirror, mirrorCleanup, err := common.Mirror(cfg.RoStoragePath)
     if err != nil {
-        log.Debug("Failed to copy mirror: %v", err)
+        log.Debugf("Failed to copy mirror: %v", err)
         return err
     }
     log.Infof("Copy mirror of %s at %s", cfg.RoStoragePath, mirror)
@@ -81,7 +81,10 @@ func getImageRMI(store storage.Store, cfg common.Config, name string) (*RoImage,
 	if err != nil {
 		return nil, err
 	}
+	return roImage(img, cfg)
+}
 
+func roImage(img storage.Image, cfg common.Config) (*RoImage, error) {
 	// read the overlay “link” file under RoStoragePath/overlay/<TopLayer>/link
 	linkPath := filepath.Join(cfg.RoStoragePath, "overlay", img.TopLayer, "link")
 	data, err := os.ReadFile(linkPath)
@@ -100,6 +103,7 @@ func RemoveSquashFile(cfg common.Config, link string) error {
 	paths := []string{
 		filepath.Join(cfg.RoStoragePath, "overlay", "l", link+".squash"),
 		filepath.Join(cfg.RoStoragePath, "squash", link+".squash"),
+		common.ChecksumPath(filepath.Join(cfg.RoStoragePath, "squash", link+".squash")),
 	}
 	for _, p := range paths {
 		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"parallax/common"
+	"parallax/mountprogram"
+)
+
+// RunSetup points the user's podman at the read-only store: it adds the store
+// to the additionalimagestores of storage.conf and makes parallax-mount the
+// overlay mount program, so no --storage-opt is needed anymore
+func RunSetup(cfg common.Config, mountProgram string) error {
+	log = log.WithField("sub", "setup")
+
+	mountProgram, err := findMountProgram(mountProgram)
+	if err != nil {
+		return err
+	}
+	store, err := filepath.Abs(cfg.RoStoragePath)
+	if err != nil {
+		return err
+	}
+	conf, err := common.ReadStorageConf()
+	if err != nil {
+		return fmt.Errorf("read storage configuration: %w", err)
+	}
+
+	_, statErr := os.Stat(conf.Path)
+	existed := statErr == nil
+	changed, err := common.UpdateStorageConf(conf.Path, store, mountProgram)
+	if err != nil {
+		return fmt.Errorf("update %s: %w", conf.Path, err)
+	}
+	if !changed {
+		log.Infof("%s already uses %s with mount program %s", conf.Path, store, mountProgram)
+		return nil
+	}
+	log.Infof("Updated %s: additional image store %s, mount program %s", conf.Path, store, mountProgram)
+	if existed {
+		log.Warnf("Comments of %s were not kept, the previous version with its comments is in %s.bak", conf.Path, conf.Path)
+	} else {
+		// a user storage.conf replaces the system one, so it starts with what podman used so far
+		log.Infof("Created %s from the storage configuration podman used so far, graphroot %s", conf.Path, conf.GraphRoot)
+	}
+	return nil
+}
+
+// findMountProgram returns the absolute path of the mount program, by default
+// the parallax-mount link next to the running binary
+func findMountProgram(path string) (string, error) {
+	if path == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(filepath.Dir(exe), mountprogram.Name)
+		if _, err := os.Lstat(path); err != nil {
+			return "", fmt.Errorf("no %s next to %s, create it with 'ln -s %s %s' or pass --mount-program",
+				mountprogram.Name, exe, exe, path)
+		}
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if err := common.IsExecutable(path); err != nil {
+		return "", fmt.Errorf("mount-program: %w", err)
+	}
+	return path, nil
+}
@@ -0,0 +1,333 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/unshare"
+	"golang.org/x/sys/unix"
+
+	"parallax/common"
+)
+
+// idRange is a range of IDs mapped into the user namespace
+type idRange struct {
+	first, size uint32
+}
+
+// nsIDs are the ID mappings of the user namespace migration runs mksquashfs
+// in. Source files owned by IDs it does not map show the overflow IDs instead.
+type nsIDs struct {
+	uids, gids               []idRange
+	overflowUID, overflowGID uint32
+	// the layers of the source own files with IDs the namespace does not map
+	unmappedUIDs, unmappedGIDs bool
+}
+
+func currentIDs() (*nsIDs, error) {
+	uidmap, gidmap, err := unshare.GetHostIDMappings("")
+	if err != nil {
+		return nil, err
+	}
+	ids := &nsIDs{overflowUID: overflowID("uid"), overflowGID: overflowID("gid")}
+	for _, m := range uidmap {
+		ids.uids = append(ids.uids, idRange{first: m.ContainerID, size: m.Size})
+	}
+	for _, m := range gidmap {
+		ids.gids = append(ids.gids, idRange{first: m.ContainerID, size: m.Size})
+	}
+	return ids, nil
+}
+
+// overflowID is the ID the kernel shows for unmapped owners, kind is uid or gid
+func overflowID(kind string) uint32 {
+	data, err := os.ReadFile("/proc/sys/kernel/overflow" + kind)
+	if err != nil {
+		return 65534
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return 65534
+	}
+	return uint32(id)
+}
+
+func mapped(ranges []idRange, id uint32) bool {
+	for _, r := range ranges {
+		if id >= r.first && uint64(id) < uint64(r.first)+uint64(r.size) {
+			return true
+		}
+	}
+	return false
+}
+
+func mappedCount(ranges []idRange) uint64 {
+	var n uint64
+	for _, r := range ranges {
+		n += uint64(r.size)
+	}
+	return n
+}
+
+// checkLayerOwners looks up the owners the layers of img record, the IDs the
+// image really uses, for the ones the namespace does not map
+func (ids *nsIDs) checkLayerOwners(store storage.Store, img *storage.Image) error {
+	layers, err := layerChain(store, img.TopLayer)
+	if err != nil {
+		return err
+	}
+	for _, id := range layers {
+		layer, err := store.Layer(id)
+		if err != nil {
+			return err
+		}
+		for _, uid := range layer.UIDs {
+			ids.unmappedUIDs = ids.unmappedUIDs || !mapped(ids.uids, uid)
+		}
+		for _, gid := range layer.GIDs {
+			ids.unmappedGIDs = ids.unmappedGIDs || !mapped(ids.gids, gid)
+		}
+	}
+	return nil
+}
+
+// lost tells whether uid and gid stand for an owner the namespace does not
+// map. The overflow ID shows up for those when the layers hold unmapped IDs or
+// the namespace does not map the overflow ID itself. Files the image really
+// gives the overflow ID are then reported as well, they cannot be told apart.
+func (ids *nsIDs) lost(uid, gid uint32) bool {
+	return (uid == ids.overflowUID && (ids.unmappedUIDs || !mapped(ids.uids, uid))) ||
+		(gid == ids.overflowGID && (ids.unmappedGIDs || !mapped(ids.gids, gid)))
+}
+
+// sourceScan is what a walk over the mounted source found before the squash
+// file is built, the only walk of the source before the builder reads it
+type sourceScan struct {
+	size       int64 // bytes of the regular files the builder reads
+	xattrs     xattrFiles
+	unreadable []string // entries that cannot be read
+	excluded   []string // unreadable entries left out with -e or -ef
+	lostOwners []string // entries owned by IDs the user namespace does not map
+	owners     []string // pseudo file definitions of the owners the ID maps rewrite
+}
+
+// scanSourceDir walks the mounted source with the credentials mksquashfs gets,
+// finding what it could not read or record as it is, and collecting the size
+// and owner rewrites the build needs
+func scanSourceDir(dir string, excludes []string, ids *nsIDs, withXattrs bool, o common.Ownership) (*sourceScan, error) {
+	scan := &sourceScan{xattrs: xattrFiles{}}
+	pseudoOwners := !o.IsZero() && o.Owner == nil
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		rel, relErr := filepath.Rel(dir, p)
+		if relErr != nil {
+			return relErr
+		}
+		name := filepath.Join("/", rel)
+		if err != nil {
+			// a directory that cannot be listed
+			if d != nil && d.IsDir() && p != dir {
+				scan.addUnreadable(name, isExcluded(name, excludes))
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		excluded := isExcluded(name, excludes)
+		if !readable(p, d) {
+			scan.addUnreadable(name, excluded)
+			return skipEntry(d)
+		}
+		if excluded {
+			return skipEntry(d)
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("%s: no stat information", p)
+		}
+		if info.Mode().IsRegular() {
+			scan.size += info.Size()
+		}
+		if ids.lost(st.Uid, st.Gid) {
+			scan.lostOwners = append(scan.lostOwners, name)
+		}
+		if pseudoOwners {
+			if line, ok := ownerPseudoLine(rel, info, st, o); ok {
+				scan.owners = append(scan.owners, line)
+			}
+		}
+		if withXattrs {
+			xattrs, err := listXattrs(p)
+			if err != nil {
+				return fmt.Errorf("xattrs of %s: %w", p, err)
+			}
+			scan.xattrs.add(name, xattrs)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan source: %w", err)
+	}
+	return scan, nil
+}
+
+func (s *sourceScan) addUnreadable(name string, excluded bool) {
+	if excluded {
+		s.excluded = append(s.excluded, name)
+	} else {
+		s.unreadable = append(s.unreadable, name)
+	}
+}
+
+// readable tells whether the content of a regular file or the listing of a
+// directory can be read, other entries need no read access
+func readable(p string, d fs.DirEntry) bool {
+	switch {
+	case d.Type().IsRegular():
+		return unix.Access(p, unix.R_OK) == nil
+	case d.IsDir():
+		return unix.Access(p, unix.R_OK|unix.X_OK) == nil
+	}
+	return true
+}
+
+func skipEntry(d fs.DirEntry) error {
+	if d.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// isExcluded tells whether name is one of the excluded paths or below one
+func isExcluded(name string, excludes []string) bool {
+	for _, e := range excludes {
+		if name == e || strings.HasPrefix(name, strings.TrimSuffix(e, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSource looks for what the squash file would not hold as it is in the
+// source: files carrying xattrs the flags drop, entries mksquashfs cannot read
+// and owners the user namespace does not map. Unreadable entries fail the
+// migration unless excluded, the rest is reported. The scan of a mounted
+// source is returned for the build, it is nil with cfg.NoMount.
+func checkSource(srcStore storage.Store, srcImg *storage.Image, mountPoint string, cfg common.Config) (*sourceScan, *common.SquashReport, error) {
+	flags := squashFlags(cfg)
+	withXattrs := !keepsXattrs(flags) && cfg.XattrPolicy != common.XattrPolicyIgnore
+
+	// layer diffs carry the owners of the image, whatever the namespace maps
+	if cfg.NoMount {
+		if !withXattrs {
+			return nil, nil, nil
+		}
+		found, err := scanLayerXattrs(srcStore, srcImg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, checkXattrs(found, cfg.XattrPolicy)
+	}
+
+	excludes, err := excludedPaths(flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids, err := currentIDs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("user namespace mappings: %w", err)
+	}
+	log.Debugf("User namespace maps %d uids and %d gids", mappedCount(ids.uids), mappedCount(ids.gids))
+	if err := ids.checkLayerOwners(srcStore, srcImg); err != nil {
+		return nil, nil, fmt.Errorf("owners of the source layers: %w", err)
+	}
+	if mappedCount(ids.uids) == 1 || mappedCount(ids.gids) == 1 {
+		log.Warnf("The user namespace maps a single uid or gid, files of other owners are recorded as %d:%d. "+
+			"Add ranges for the user to /etc/subuid and /etc/subgid", ids.overflowUID, ids.overflowGID)
+	}
+
+	scan, err := scanSourceDir(mountPoint, excludes, ids, withXattrs, cfg.Ownership)
+	if err != nil {
+		return nil, nil, err
+	}
+	if withXattrs {
+		if err := checkXattrs(scan.xattrs, cfg.XattrPolicy); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(scan.unreadable) > 0 {
+		ef, err := writeExcludeFile(shortID(srcImg.ID), scan.unreadable)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("%d source entries cannot be read: %s. Leave them out with -ef %s in --mksquashfs-opts",
+			len(scan.unreadable), examples(scan.unreadable), ef)
+	}
+	if len(scan.excluded) > 0 {
+		log.Warnf("%d unreadable source entries are left out of the squash file: %s", len(scan.excluded), examples(scan.excluded))
+	}
+	if len(scan.lostOwners) > 0 {
+		log.Warnf("%d source entries are owned by IDs the user namespace does not map, they are recorded as %d:%d: %s",
+			len(scan.lostOwners), ids.overflowUID, ids.overflowGID, examples(scan.lostOwners))
+	}
+	if len(scan.excluded) == 0 && len(scan.lostOwners) == 0 {
+		return scan, nil, nil
+	}
+	return scan, &common.SquashReport{Excluded: scan.excluded, LostOwners: scan.lostOwners}, nil
+}
+
+// writeExcludeFile writes the paths into a new mksquashfs exclude file and
+// returns its name, the file is created so that it cannot be a planted link
+func writeExcludeFile(id string, paths []string) (string, error) {
+	f, err := os.CreateTemp("", "parallax-unreadable-"+id+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	for _, p := range paths {
+		if _, err := fmt.Fprintln(f, strings.TrimPrefix(p, "/")); err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// examples names the first few paths
+func examples(paths []string) string {
+	if len(paths) > 5 {
+		return strings.Join(paths[:5], " ") + " ..."
+	}
+	return strings.Join(paths, " ")
+}
+
+// recordSquashReport keeps the entries the side-car could not hold as they were with the image
+func recordSquashReport(store storage.Store, img *storage.Image, report *common.SquashReport) error {
+	if report == nil {
+		return nil
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if err := store.SetImageBigData(img.ID, common.SquashReportKey, data, nil); err != nil {
+		return fmt.Errorf("record squash report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"parallax/common"
+	"parallax/squashfs"
+)
+
+// buildSquashFromDir writes the tree below srcDir, holding size bytes of files, to
+// squashPath with the builtin squashfs writer. The mksquashfs flags are translated
+// so both builders share options, the owners are rewritten as the ownership says.
+func buildSquashFromDir(srcDir, squashPath string, flags []string, size int64, owners common.Ownership) error {
+	sublog := log.WithField("fn", "buildSquashFromDir")
+
+	opts, excludes, err := squashfs.ParseMksquashfsArgs(flags)
+	if err != nil {
+		return err
+	}
+	skip := map[string]bool{}
+	for _, e := range excludes {
+		skip[filepath.Clean(e)] = true
+	}
+
+	// write next to the final file so a failed build never leaves a partial side-car behind
+	tmp := squashPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	w, err := squashfs.NewWriter(f, opts)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	prog := trackPhase("squash", size)
+	root, err := addDirToSquash(w, srcDir, skip, prog)
+	prog.Done()
+	if err != nil {
+		return fmt.Errorf("builtin squash builder: %w", err)
+	}
+	remapOwners(root, owners)
+	if err := w.Finish(root); err != nil {
+		return fmt.Errorf("builtin squash builder: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	sublog.Debugf("Built %s with %s compression in %s", squashPath, opts.Compression, time.Since(start))
+	return os.Rename(tmp, squashPath)
+}
+
+type inodeKey struct {
+	dev, ino uint64
+}
+
+// addDirToSquash streams the file contents of srcDir into w and returns the tree describing them,
+// counting the bytes read in prog
+func addDirToSquash(w *squashfs.Writer, srcDir string, skip map[string]bool, prog *common.Progress) (*squashfs.Node, error) {
+	links := map[inodeKey]*squashfs.Node{}
+	var root *squashfs.Node
+
+	err := filepath.WalkDir(srcDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, p)
+		if err != nil {
+			return err
+		}
+		if skip[rel] {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("%s: no stat information", p)
+		}
+		key := inodeKey{uint64(st.Dev), st.Ino}
+
+		var node *squashfs.Node
+		if !info.IsDir() && st.Nlink > 1 {
+			node = links[key]
+		}
+		if node == nil {
+			if node, err = squashNode(w, p, info, st, prog); err != nil {
+				return err
+			}
+			if !info.IsDir() && st.Nlink > 1 {
+				links[key] = node
+			}
+		}
+
+		if rel == "." {
+			root = node
+			return nil
+		}
+		parent := root.Lookup(filepath.ToSlash(filepath.Dir(rel)))
+		if parent == nil {
+			return fmt.Errorf("%s: parent directory missing", p)
+		}
+		return parent.SetChild(d.Name(), node)
+	})
+	return root, err
+}
+
+func squashNode(w *squashfs.Writer, p string, info fs.FileInfo, st *syscall.Stat_t, prog *common.Progress) (*squashfs.Node, error) {
+	xattrs, err := listXattrs(p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	node := &squashfs.Node{
+		Mode:    info.Mode(),
+		UID:     st.Uid,
+		GID:     st.Gid,
+		ModTime: info.ModTime(),
+		Xattrs:  xattrs,
+	}
+
+	switch {
+	case info.IsDir():
+		node = squashfs.NewDir(info.Mode()&^fs.ModeType, st.Uid, st.Gid, info.ModTime())
+		node.Xattrs = xattrs
+	case info.Mode().IsRegular():
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if node.Data, err = w.WriteFile(prog.Reader(f)); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+	case info.Mode()&fs.ModeSymlink != 0:
+		if node.Target, err = os.Readlink(p); err != nil {
+			return nil, err
+		}
+	case info.Mode()&fs.ModeDevice != 0:
+		node.Major, node.Minor = unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))
+	}
+	return node, nil
+}
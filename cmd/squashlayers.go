@@ -0,0 +1,320 @@
+package cmd
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/archive"
+
+	"parallax/common"
+	"parallax/squashfs"
+)
+
+// Prefix of the PAX records carrying xattrs in layer tars
+const paxXattrPrefix = "SCHILY.xattr."
+
+// buildSquashFromLayers writes the flattened file system of img to squashPath
+// without mounting it. The layer diffs are read twice: the first pass applies
+// entries and whiteouts to build the final tree, the second streams the content
+// of the files that survived into the builtin squashfs writer.
+func buildSquashFromLayers(store storage.Store, img *storage.Image, squashPath string, flags []string, owners common.Ownership) error {
+	sublog := log.WithField("fn", "buildSquashFromLayers")
+
+	opts, excludes, err := squashfs.ParseMksquashfsArgs(flags)
+	if err != nil {
+		return err
+	}
+
+	layers, err := layerChain(store, img.TopLayer)
+	if err != nil {
+		return err
+	}
+	sublog.Infof("Applying %d layer diffs", len(layers))
+
+	// every diff is read twice, once for the tree and once for the content
+	var size int64
+	for _, id := range layers {
+		if layer, err := store.Layer(id); err == nil && layer.UncompressedSize > 0 {
+			size += 2 * layer.UncompressedSize
+		}
+	}
+	prog := trackPhase("squash", size)
+	defer prog.Done()
+
+	t, err := flattenLayerTree(store, layers, prog)
+	if err != nil {
+		return err
+	}
+	for _, e := range excludes {
+		if parent := t.root.Lookup(path.Dir(cleanTarPath(e))); parent != nil && parent.Mode.IsDir() {
+			parent.RemoveChild(path.Base(cleanTarPath(e)))
+		}
+	}
+
+	// only the files reachable in the final tree get their content written
+	wanted := make([]map[string]*squashfs.Node, len(layers))
+	for i := range wanted {
+		wanted[i] = map[string]*squashfs.Node{}
+	}
+	collectFiles(t.root, func(n *squashfs.Node) {
+		if src, ok := t.sources[n]; ok {
+			wanted[src.layer][src.name] = n
+		}
+	})
+
+	tmp := squashPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	w, err := squashfs.NewWriter(f, opts)
+	if err != nil {
+		return err
+	}
+	for i, id := range layers {
+		if len(wanted[i]) == 0 {
+			continue
+		}
+		err := forEachDiffEntry(store, id, prog, func(hdr *tar.Header, r io.Reader) error {
+			n := wanted[i][cleanTarPath(hdr.Name)]
+			if n == nil || hdr.Typeflag != tar.TypeReg {
+				return nil
+			}
+			data, err := w.WriteFile(r)
+			n.Data = data
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("copy layer %s: %w", id, err)
+		}
+	}
+	// a file the second pass did not find would silently end up empty
+	for i := range wanted {
+		for name, n := range wanted[i] {
+			if n.Data == nil && t.sources[n].size > 0 {
+				return fmt.Errorf("content of %s not found in layer %s", name, layers[i])
+			}
+		}
+	}
+	remapOwners(t.root, owners)
+	if err := w.Finish(t.root); err != nil {
+		return fmt.Errorf("builtin squash builder: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, squashPath)
+}
+
+// flattenLayerTree applies the entries and whiteouts of the layer diffs in
+// order and returns the resulting tree, without any file content
+func flattenLayerTree(store storage.Store, layers []string, prog *common.Progress) (*layerTree, error) {
+	t := &layerTree{
+		root:    squashfs.NewDir(0o755, 0, 0, layerEpoch),
+		added:   map[*squashfs.Node]int{},
+		sources: map[*squashfs.Node]fileSource{},
+	}
+	for i, id := range layers {
+		err := forEachDiffEntry(store, id, prog, func(hdr *tar.Header, _ io.Reader) error {
+			return t.apply(i, hdr)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("apply layer %s: %w", id, err)
+		}
+	}
+	return t, nil
+}
+
+// layerChain returns the layer IDs from the base layer up to top
+func layerChain(store storage.Store, top string) ([]string, error) {
+	var chain []string
+	for id := top; id != ""; {
+		layer, err := store.Layer(id)
+		if err != nil {
+			return nil, fmt.Errorf("lookup layer %s: %w", id, err)
+		}
+		chain = append([]string{id}, chain...)
+		id = layer.Parent
+	}
+	return chain, nil
+}
+
+// forEachDiffEntry calls fn for every entry of the layer diff, counting the bytes read in prog
+func forEachDiffEntry(store storage.Store, layerID string, prog *common.Progress, fn func(*tar.Header, io.Reader) error) error {
+	uncompressed := archive.Uncompressed
+	diff, err := store.Diff("", layerID, &storage.DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return err
+	}
+	defer diff.Close()
+
+	tr := tar.NewReader(prog.Reader(diff))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, tr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// fileSource records which layer entry holds the content of a regular file
+type fileSource struct {
+	layer int
+	name  string
+	size  int64
+}
+
+// layerEpoch is the mtime of directories no layer lists, such as the root of
+// images built without a "./" entry, so builds from the same layers match
+var layerEpoch = time.Unix(0, 0)
+
+// layerTree is the file system being flattened. It remembers the layer that
+// last touched each node so opaque directories only hide lower layers.
+type layerTree struct {
+	root    *squashfs.Node
+	added   map[*squashfs.Node]int
+	sources map[*squashfs.Node]fileSource
+}
+
+func (t *layerTree) apply(layer int, hdr *tar.Header) error {
+	name := cleanTarPath(hdr.Name)
+	dir, base := path.Split(name)
+	dir = path.Clean("/" + dir)
+
+	if name == "" {
+		t.setAttrs(t.root, hdr)
+		t.added[t.root] = layer
+		return nil
+	}
+
+	parent, err := t.mkdirAll(dir, layer)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case base == archive.WhiteoutOpaqueDir:
+		t.hideLower(parent, layer)
+		return nil
+	case strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+		// other metadata entries, such as hard link directories, are not part of the tree
+		return nil
+	case strings.HasPrefix(base, archive.WhiteoutPrefix):
+		parent.RemoveChild(strings.TrimPrefix(base, archive.WhiteoutPrefix))
+		return nil
+	}
+
+	if hdr.Typeflag == tar.TypeLink {
+		target := t.root.Lookup(cleanTarPath(hdr.Linkname))
+		if target == nil || target.Mode.IsDir() {
+			return fmt.Errorf("hard link target %q not found", hdr.Linkname)
+		}
+		return parent.SetChild(base, target)
+	}
+
+	existing := parent.Child(base)
+	if hdr.Typeflag == tar.TypeDir && existing != nil && existing.Mode.IsDir() {
+		// directories are merged with the lower layers
+		t.setAttrs(existing, hdr)
+		t.added[existing] = layer
+		return nil
+	}
+
+	n := &squashfs.Node{}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		n = squashfs.NewDir(0, 0, 0, time.Time{})
+	case tar.TypeReg:
+		t.sources[n] = fileSource{layer: layer, name: name, size: hdr.Size}
+	case tar.TypeSymlink:
+		n.Target = hdr.Linkname
+	case tar.TypeChar, tar.TypeBlock:
+		n.Major, n.Minor = uint32(hdr.Devmajor), uint32(hdr.Devminor)
+	case tar.TypeFifo:
+	default:
+		return fmt.Errorf("unsupported tar entry type %q", hdr.Typeflag)
+	}
+	t.setAttrs(n, hdr)
+	t.added[n] = layer
+	return parent.SetChild(base, n)
+}
+
+func (t *layerTree) setAttrs(n *squashfs.Node, hdr *tar.Header) {
+	n.Mode = hdr.FileInfo().Mode()
+	n.UID, n.GID = uint32(hdr.Uid), uint32(hdr.Gid)
+	n.ModTime = hdr.ModTime
+	n.Xattrs = nil
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+			if n.Xattrs == nil {
+				n.Xattrs = map[string][]byte{}
+			}
+			n.Xattrs[name] = []byte(value)
+		}
+	}
+}
+
+// mkdirAll returns the directory at p, creating missing parents the layer did not list
+func (t *layerTree) mkdirAll(p string, layer int) (*squashfs.Node, error) {
+	cur := t.root
+	for _, part := range strings.Split(strings.Trim(p, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		next := cur.Child(part)
+		if next == nil || !next.Mode.IsDir() {
+			// the entry of the directory itself replaces these attributes if it comes later
+			next = squashfs.NewDir(0o755, 0, 0, layerEpoch)
+			t.added[next] = layer
+			if err := cur.SetChild(part, next); err != nil {
+				return nil, err
+			}
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// hideLower drops everything below dir that comes from layers before layer
+func (t *layerTree) hideLower(dir *squashfs.Node, layer int) {
+	for _, name := range dir.Children() {
+		child := dir.Child(name)
+		if t.added[child] < layer {
+			dir.RemoveChild(name)
+		} else if child.Mode.IsDir() {
+			t.hideLower(child, layer)
+		}
+	}
+}
+
+func collectFiles(dir *squashfs.Node, fn func(*squashfs.Node)) {
+	for _, name := range dir.Children() {
+		child := dir.Child(name)
+		if child.Mode.IsDir() {
+			collectFiles(child, fn)
+		} else if child.Mode.IsRegular() {
+			fn(child)
+		}
+	}
+}
+
+// cleanTarPath turns "./etc/", "/etc" and "etc" into "etc", and the root into ""
+func cleanTarPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
@@ -0,0 +1,312 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containers/storage"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"parallax/common"
+	"parallax/squashfs"
+)
+
+// treeEntry is the part of a file we compare between a source tree and a squash file
+type treeEntry struct {
+	mode   fs.FileMode
+	size   int64
+	target string
+	xattrs map[string][]byte
+	open   func() (io.ReadCloser, error)
+}
+
+func RunVerify(cfg common.Config) error {
+	log = log.WithFields(logrus.Fields{"sub": "verify", "image": cfg.Image})
+	log.Infof("Starting verification for image: %s", cfg.Image)
+	log.Debugf("Podman Root: %s, Read-only Storage Path: %s", cfg.PodmanRoot, cfg.RoStoragePath)
+
+	name := cfg.Image
+
+	srcStore, cleanupSrcStore, err := setupSrcStore(cfg)
+	if err != nil { return err }
+	defer cleanupSrcStore()
+
+	srcImg, err := findSourceImage(name, srcStore)
+	if err != nil { return err }
+
+	// verify only reads, the shared store is never mirrored or written
+	ro, err := common.FindStoreImage(cfg.RoStoragePath, name)
+	if err != nil { return fmt.Errorf("locate migrated image: %w", err) }
+	img := storage.Image{ID: ro.ID, TopLayer: ro.TopLayer}
+	roImg, err := roImage(img, cfg)
+	if err != nil { return fmt.Errorf("read overlay link: %w", err) }
+
+	migratedFrom, err := migratedSourceID(roBigData(cfg.RoStoragePath), &img, cfg)
+	if err != nil { return err }
+	if migratedFrom != "" && migratedFrom != srcImg.ID {
+		return fmt.Errorf("image %s was migrated from %s but the source is now %s, re-migrate first", name, migratedFrom, srcImg.ID)
+	}
+
+	mountPoint, cleanupSrc, err := prepareAndMountSourceImage(srcImg, srcStore)
+	if err != nil { return err }
+	defer cleanupSrc()
+
+	squashPath := squashPathOf(cfg, strings.TrimSpace(roImg.Link))
+	diffs, err := verifySquashAgainstDir(squashPath, mountPoint)
+	if err != nil { return err }
+
+	if len(diffs) > 0 {
+		for _, d := range diffs {
+			log.Warnf("DIFF %s", d)
+		}
+		return fmt.Errorf("%d differences between %s and source image %s", len(diffs), squashPath, srcImg.ID)
+	}
+
+	log.Infof("Verification successfully completed for image: %s", name)
+	return nil
+}
+
+func verifySquashAgainstDir(squashPath, dir string) ([]string, error) {
+	sublog := log.WithField("fn", "verifySquashAgainstDir")
+
+	f, err := os.Open(squashPath)
+	if err != nil {
+		return nil, fmt.Errorf("open squash file: %w", err)
+	}
+	defer f.Close()
+	reader, err := squashfs.Open(f)
+	if err != nil {
+		return nil, fmt.Errorf("read squash file %s: %w", squashPath, err)
+	}
+
+	sublog.Infof("Reading squash tree from %s", squashPath)
+	squashed, err := squashTree(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	sublog.Infof("Reading source tree from %s", dir)
+	source, err := dirTree(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	withXattrs := reader.HasXattrs()
+	if !withXattrs {
+		if n := countWithXattrs(source); n > 0 {
+			sublog.Warnf("Squash file was built without xattrs, ignoring xattrs of %d source entries", n)
+		}
+	}
+
+	sublog.Infof("Comparing %d source entries with %d squash entries", len(source), len(squashed))
+	return compareTrees(source, squashed, withXattrs)
+}
+
+func squashTree(r *squashfs.Reader) (map[string]*treeEntry, error) {
+	tree := map[string]*treeEntry{}
+	err := r.Walk(func(e *squashfs.Entry) error {
+		entry := &treeEntry{mode: e.Mode, size: e.Size, target: e.Target, xattrs: e.Xattrs}
+		if e.Mode.IsRegular() {
+			entry.open = func() (io.ReadCloser, error) {
+				rd, err := r.Open(e)
+				return io.NopCloser(rd), err
+			}
+		}
+		tree[e.Path] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk squash file: %w", err)
+	}
+	return tree, nil
+}
+
+func dirTree(root string) (map[string]*treeEntry, error) {
+	tree := map[string]*treeEntry{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		entry := &treeEntry{mode: info.Mode()}
+		switch {
+		case info.Mode().IsRegular():
+			entry.size = info.Size()
+			entry.open = func() (io.ReadCloser, error) { return os.Open(p) }
+		case info.Mode()&fs.ModeSymlink != 0:
+			if entry.target, err = os.Readlink(p); err != nil {
+				return err
+			}
+			entry.size = int64(len(entry.target))
+		}
+		if entry.xattrs, err = listXattrs(p); err != nil {
+			return fmt.Errorf("xattrs of %s: %w", p, err)
+		}
+		tree[filepath.Join("/", rel)] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk source tree: %w", err)
+	}
+	return tree, nil
+}
+
+func listXattrs(p string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(p, buf); err != nil {
+		return nil, err
+	}
+	xattrs := map[string][]byte{}
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(p, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(p, string(name), value); err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value[:vsize]
+	}
+	return xattrs, nil
+}
+
+func countWithXattrs(tree map[string]*treeEntry) int {
+	n := 0
+	for _, e := range tree {
+		if len(e.xattrs) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// compareTrees returns a human readable line for every difference between want and got
+func compareTrees(want, got map[string]*treeEntry, withXattrs bool) ([]string, error) {
+	var diffs []string
+
+	paths := make([]string, 0, len(want))
+	for p := range want {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		w := want[p]
+		g, ok := got[p]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: missing", p))
+			continue
+		}
+		if w.mode != g.mode {
+			diffs = append(diffs, fmt.Sprintf("%s: mode %v, expected %v", p, g.mode, w.mode))
+			continue
+		}
+		if w.target != g.target {
+			diffs = append(diffs, fmt.Sprintf("%s: symlink target %q, expected %q", p, g.target, w.target))
+		}
+		if w.mode.IsRegular() {
+			if w.size != g.size {
+				diffs = append(diffs, fmt.Sprintf("%s: size %d, expected %d", p, g.size, w.size))
+			} else {
+				same, err := sameContent(w, g)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", p, err)
+				}
+				if !same {
+					diffs = append(diffs, fmt.Sprintf("%s: content differs", p))
+				}
+			}
+		}
+		if withXattrs && !sameXattrs(w.xattrs, g.xattrs) {
+			diffs = append(diffs, fmt.Sprintf("%s: xattrs %v, expected %v", p, xattrNames(g.xattrs), xattrNames(w.xattrs)))
+		}
+	}
+
+	var extra []string
+	for p := range got {
+		if _, ok := want[p]; !ok {
+			extra = append(extra, p)
+		}
+	}
+	sort.Strings(extra)
+	for _, p := range extra {
+		diffs = append(diffs, fmt.Sprintf("%s: unexpected entry", p))
+	}
+	return diffs, nil
+}
+
+func sameContent(a, b *treeEntry) (bool, error) {
+	ha, err := hashEntry(a)
+	if err != nil {
+		return false, err
+	}
+	hb, err := hashEntry(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ha, hb), nil
+}
+
+func hashEntry(e *treeEntry) ([]byte, error) {
+	rc, err := e.open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func sameXattrs(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || !bytes.Equal(v, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func xattrNames(x map[string][]byte) []string {
+	names := make([]string, 0, len(x))
+	for k := range x {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
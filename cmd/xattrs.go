@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/containers/storage"
+
+	"parallax/common"
+	"parallax/squashfs"
+)
+
+// hostXattrs are put on the mounted source by the host, they are not part of the image
+var hostXattrs = []string{"security.selinux"}
+
+// xattrFiles maps the paths of files carrying xattrs to the names of their xattrs
+type xattrFiles map[string][]string
+
+// preserveXattrFlags turns the default or preset flags into ones keeping xattrs,
+// which both builders store unless told otherwise
+func preserveXattrFlags(flags []string) []string {
+	var kept []string
+	for i := 0; i < len(flags); i++ {
+		switch {
+		case flags[i] == "-no-xattrs":
+			continue
+		case flags[i] == "-e" && i+1 < len(flags) && flags[i+1] == "security.capability" &&
+			(i+2 == len(flags) || strings.HasPrefix(flags[i+2], "-")):
+			i++
+			continue
+		}
+		kept = append(kept, flags[i])
+	}
+	return kept
+}
+
+// keepsXattrs tells whether a side-car built with flags carries xattrs, the last
+// of -xattrs and -no-xattrs wins like in mksquashfs
+func keepsXattrs(flags []string) bool {
+	keep := true
+	for _, f := range flags {
+		switch f {
+		case "-xattrs":
+			keep = true
+		case "-no-xattrs":
+			keep = false
+		}
+	}
+	return keep
+}
+
+// scanLayerXattrs finds the files carrying xattrs in the flattened layers of img
+func scanLayerXattrs(store storage.Store, img *storage.Image) (xattrFiles, error) {
+	layers, err := layerChain(store, img.TopLayer)
+	if err != nil {
+		return nil, err
+	}
+	prog := trackPhase("xattr_scan", 0)
+	defer prog.Done()
+	t, err := flattenLayerTree(store, layers, prog)
+	if err != nil {
+		return nil, err
+	}
+	found := xattrFiles{}
+	var walk func(p string, n *squashfs.Node)
+	walk = func(p string, n *squashfs.Node) {
+		found.add(p, n.Xattrs)
+		if n.Mode.IsDir() {
+			for _, name := range n.Children() {
+				walk(path.Join(p, name), n.Child(name))
+			}
+		}
+	}
+	walk("/", t.root)
+	return found, nil
+}
+
+func (f xattrFiles) add(p string, xattrs map[string][]byte) {
+	for name := range xattrs {
+		if !slices.Contains(hostXattrs, name) {
+			f[p] = append(f[p], name)
+		}
+	}
+	sort.Strings(f[p])
+}
+
+// summary counts the files per xattr name and names a few of the files
+func (f xattrFiles) summary() string {
+	counts := map[string]int{}
+	paths := make([]string, 0, len(f))
+	for p, names := range f {
+		paths = append(paths, p)
+		for _, name := range names {
+			counts[name]++
+		}
+	}
+	var names []string
+	for name, n := range counts {
+		names = append(names, fmt.Sprintf("%s on %d", name, n))
+	}
+	sort.Strings(names)
+	sort.Strings(paths)
+	return fmt.Sprintf("%s, e.g. %s", strings.Join(names, ", "), examples(paths))
+}
+
+// checkXattrs applies the xattr policy to the files of the source carrying
+// xattrs, which the squash file is about to drop
+func checkXattrs(found xattrFiles, policy string) error {
+	if len(found) == 0 {
+		log.Debug("No source files carry xattrs")
+		return nil
+	}
+	msg := fmt.Sprintf("%d source files carry xattrs the squash file drops: %s", len(found), found.summary())
+	switch policy {
+	case common.XattrPolicyIgnore:
+		log.Debug(msg)
+	case common.XattrPolicyWarn:
+		log.Warnf("%s. Migrate with --xattr-policy preserve to keep them", msg)
+	default:
+		return fmt.Errorf("%s, use --xattr-policy preserve to keep them or warn to drop them", msg)
+	}
+	return nil
+}
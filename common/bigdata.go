@@ -0,0 +1,129 @@
+package common
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Image BigData keys recorded by parallax. containers/storage keeps keys made
+// of [.0-9a-z] as plain file names in overlay-images/<image ID>/, so the mount
+// program can read them straight from the read-only store.
+const (
+	ReadyProbesKey   = "parallax.probes"       // JSON list of paths to be readable before a container starts
+	SquashOptionsKey = "parallax.squashopts"   // JSON SquashOptions the side-car was built with
+	SquashReportKey  = "parallax.squashreport" // JSON SquashReport of the entries the side-car could not keep
+)
+
+// SquashOptions records how the squash side-car of an image was built
+type SquashOptions struct {
+	Preset  string   `json:"preset"` // preset name, PresetDefault or PresetCustom
+	Builder string   `json:"builder"`
+	Options []string `json:"options"`
+	Xattrs  bool     `json:"xattrs"`           // the side-car carries the xattrs of the image
+	Owner   string   `json:"owner,omitempty"`  // uid:gid every entry got with --squash-owner
+	UIDMap  []string `json:"uidMap,omitempty"` // from:to:size ranges the uids were rewritten with
+	GIDMap  []string `json:"gidMap,omitempty"`
+}
+
+// SquashReport lists the entries of the source image the squash side-car does
+// not hold as they were, the paths are absolute in the image
+type SquashReport struct {
+	Excluded   []string `json:"excluded,omitempty"`   // unreadable entries left out with -e or -ef
+	LostOwners []string `json:"lostOwners,omitempty"` // entries owned by IDs the user namespace does not map
+}
+
+// ImageBigDataPath is where a store keeps a BigData item of an image. Keys with
+// other characters than [.0-9a-z] are base64 encoded, like containers/storage does.
+func ImageBigDataPath(storeRoot, imageID, key string) string {
+	name := key
+	if strings.IndexFunc(key, func(r rune) bool {
+		return r != '.' && (r < '0' || r > '9') && (r < 'a' || r > 'z')
+	}) >= 0 {
+		name = "=" + base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	return filepath.Join(storeRoot, "overlay-images", imageID, name)
+}
+
+// ReadImageBigData reads a BigData item of an image without opening the store
+func ReadImageBigData(storeRoot, imageID, key string) ([]byte, error) {
+	return os.ReadFile(ImageBigDataPath(storeRoot, imageID, key))
+}
+
+// StoreImage is the part of an overlay-images/images.json entry parallax reads directly
+type StoreImage struct {
+	ID       string    `json:"id"`
+	Names    []string  `json:"names,omitempty"`
+	TopLayer string    `json:"layer,omitempty"`
+	Digest   string    `json:"digest,omitempty"`
+	Created  time.Time `json:"created,omitempty"`
+}
+
+// ReadStoreImages reads overlay-images/images.json without opening the store
+func ReadStoreImages(storeRoot string) ([]StoreImage, error) {
+	path := filepath.Join(storeRoot, "overlay-images", "images.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var imgs []StoreImage
+	if err := json.Unmarshal(data, &imgs); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return imgs, nil
+}
+
+// ReadReadyProbes returns the readiness probes recorded for an image, none if there are none
+func ReadReadyProbes(storeRoot, imageID string) ([]string, error) {
+	data, err := os.ReadFile(ImageBigDataPath(storeRoot, imageID, ReadyProbesKey))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var probes []string
+	if err := json.Unmarshal(data, &probes); err != nil {
+		return nil, fmt.Errorf("parse %s of image %s: %w", ReadyProbesKey, imageID, err)
+	}
+	return probes, nil
+}
+
+// ReadSquashOptions returns how the side-car of an image was built, nil for
+// images migrated before parallax recorded it
+func ReadSquashOptions(storeRoot, imageID string) (*SquashOptions, error) {
+	data, err := os.ReadFile(ImageBigDataPath(storeRoot, imageID, SquashOptionsKey))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var opts SquashOptions
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return nil, fmt.Errorf("parse %s of image %s: %w", SquashOptionsKey, imageID, err)
+	}
+	return &opts, nil
+}
+
+// ReadSquashReport returns the entries the side-car of an image could not keep,
+// nil when it kept all of them
+func ReadSquashReport(storeRoot, imageID string) (*SquashReport, error) {
+	data, err := os.ReadFile(ImageBigDataPath(storeRoot, imageID, SquashReportKey))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var report SquashReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("parse %s of image %s: %w", SquashReportKey, imageID, err)
+	}
+	return &report, nil
+}
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoChecksum is returned when a squash file has no recorded checksum
+var ErrNoChecksum = errors.New("no checksum recorded")
+
+// ChecksumPath returns the side-car holding the sha256 of a squash file.
+// The file uses the sha256sum format so it can be checked with "sha256sum -c".
+func ChecksumPath(squashPath string) string {
+	return squashPath + ".sha256"
+}
+
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hashing %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WriteChecksum hashes the finished squashPath and records the result next to it
+func WriteChecksum(squashPath string) (string, error) {
+	sum, err := FileSHA256(squashPath)
+	if err != nil {
+		return "", err
+	}
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(squashPath))
+
+	// write to a temp file first so readers never see a partial checksum
+	tmp := ChecksumPath(squashPath) + ".tmp"
+	if err := os.WriteFile(tmp, []byte(line), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, ChecksumPath(squashPath)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return sum, nil
+}
+
+func ReadChecksum(squashPath string) (string, error) {
+	f, err := os.Open(ChecksumPath(squashPath))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", ErrNoChecksum
+		}
+		return "", err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("malformed checksum file %s", ChecksumPath(squashPath))
+	}
+	return fields[0], nil
+}
+
+// VerifyChecksum re-hashes squashPath and compares it with the recorded checksum.
+// It returns ErrNoChecksum if nothing was recorded for the file.
+func VerifyChecksum(squashPath string) error {
+	want, err := ReadChecksum(squashPath)
+	if err != nil {
+		return err
+	}
+	got, err := FileSHA256(squashPath)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("checksum mismatch for %s: got %s, recorded %s", squashPath, got, want)
+	}
+	return nil
+}
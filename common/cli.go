@@ -5,9 +5,17 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/mattn/go-shellwords"
+	"github.com/containers/storage/pkg/unshare"
+
+	"parallax/squashfs"
 )
 
 func usage_banner() {
@@ -21,23 +29,21 @@ OCI image migration tool for Podman on HPC systems
 Usage:
   parallax --migrate --image <image[:tag]> [options]
   parallax --rmi     --image <image[:tag]> [options]
+  parallax verify    --image <image[:tag]> [options]
+  parallax checksum  [--image <image[:tag]>] [options]
+  parallax list      [--store <name>] [options]
+  parallax inspect   --image <image[:tag]> [options]
+  parallax resquash  --image <image[:tag]> [--preset <name>] [options]
+  parallax doctor    [options]
+  parallax mounts gc
+  parallax mounts list [--roStoragePath <path>]
+  parallax config show [options]
+  parallax setup       [--roStoragePath <path>] [--mount-program <path>]
 
 Options:
 `)
 
-    // New flag section
-	order := []string{
-        "migrate",
-        "rmi",
-        "image",
-        "podmanRoot",
-        "roStoragePath",
-        "mksquashfsPath",
-		"mksquashfs-opts",
-        "log-level",
-        "version",
-    }
-    for _, name := range order {
+    for _, name := range flagOrder {
         if f := flag.CommandLine.Lookup(name); f != nil {
             printFlag(out, f)
         }
@@ -47,11 +53,73 @@ Options:
     fmt.Fprintf(out, `
 Examples:
   parallax --migrate --image ubuntu:latest
+  parallax --migrate --image ubuntu:latest --squash-builder builtin
+  parallax --migrate --image ubuntu:latest --preset small
+  parallax --migrate --image ubuntu:latest --xattr-policy preserve
+  parallax --migrate --image myapp:1.0 --uid-map 1000:2000:1000 --gid-map 1000:2000:1000
+  parallax --migrate --image ubuntu:latest --squash-builder builtin --no-mount
+  parallax --migrate --image myapp:1.0 --ready-probe /opt/app/bin/start
   parallax --rmi     --image alpine:3.18
+  parallax verify    --image ubuntu:latest
+  parallax checksum
+  parallax --migrate --image ubuntu:latest --store project
+  parallax list
+  parallax inspect --image ubuntu:latest
+  parallax resquash --image ubuntu:latest --preset small
+  parallax doctor --mksquashfs-opts "-comp xz"
+  parallax --migrate --image ubuntu:latest --log-format json --log-output syslog
+  parallax --migrate --image ubuntu:latest --metrics-dir /var/lib/node_exporter/textfile
+  podman unshare parallax mounts gc
+  podman unshare parallax mounts list
+  PARALLAX_CONFIG=./site.conf parallax config show
+  parallax setup --roStoragePath /mnt/nfs/podman
+
+Options can also be set in TOML config files, named as the flags, e.g.
+  roStoragePath = "/mnt/nfs/podman"
+  ready-probe = ["/bin/sh"]
+read from /etc/parallax.conf, ~/.config/parallax/parallax.conf and
+$PARALLAX_CONFIG, later files and flags taking precedence. podmanRoot
+defaults to the graphroot of podman's storage.conf, roStoragePath to its
+first additionalimagestores entry holding squash files.
+
+Named read-only stores, selected with --store, are tables of the config files:
+  [stores.project]
+  path = "/mnt/nfs/project"
+  preset = "small"
+  users = ["alice", "1001"]
+  description = "Images of the project"
 
 `)
 }
 
+// Options in the order of the usage text and "config show"
+var flagOrder = []string{
+	"migrate",
+	"rmi",
+	"image",
+	"podmanRoot",
+	"roStoragePath",
+	"store",
+	"mksquashfsPath",
+	"mksquashfs-opts",
+	"preset",
+	"squash-builder",
+	"xattr-policy",
+	"no-mount",
+	"prune-previous",
+	"uid-map",
+	"gid-map",
+	"squash-owner",
+	"ready-probe",
+	"mount-program",
+	"log-level",
+	"log-format",
+	"log-output",
+	"metrics-dir",
+	"progress-interval",
+	"version",
+}
+
 func printFlag(out io.Writer, f *flag.Flag) {
     // double-dashed name!
     line := fmt.Sprintf("  --%s", f.Name)
@@ -75,18 +143,65 @@ func printFlag(out io.Writer, f *flag.Flag) {
 }
 
 
+// stringList collects the values of a flag given several times
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
 // Track we are being asked
 type Operation int
 const (
 	OpUnknown Operation = iota
 	OpMigrate
 	OpRmi
+	OpVerify
+	OpChecksum
+	OpMountsGC
+	OpMountsList
+	OpConfigShow
+	OpSetup
+	OpList
+	OpDoctor
+	OpInspect
+	OpResquash
 )
 
+// Commands can also be given as first argument, e.g. "parallax verify --image ubuntu"
+var commands = map[string]Operation{
+	"migrate":  OpMigrate,
+	"rmi":      OpRmi,
+	"verify":   OpVerify,
+	"checksum": OpChecksum,
+	"setup":    OpSetup,
+	"list":     OpList,
+	"doctor":   OpDoctor,
+	"inspect":  OpInspect,
+	"resquash": OpResquash,
+}
+
+// Commands taking a subcommand: "mounts" works on the mount program's mounts
+// and "config" on the settings of parallax itself
+var subCommands = map[string]map[string]Operation{
+	"mounts": {
+		"gc":   OpMountsGC,
+		"list": OpMountsList,
+	},
+	"config": {
+		"show": OpConfigShow,
+	},
+}
+
 type CLI struct {
 	Config Config
 	Op Operation
 	LogLevel logrus.Level
+	LogFormat string // text or json
+	LogSink string   // stdout, stderr, syslog or file
+	LogFile string   // path for the file sink
+	ProgressInterval time.Duration
+	Settings []Setting // every option with its source, for config show
+	MountProgram string // for setup
 	ShowUsage bool //use for -h
 }
 
@@ -94,10 +209,27 @@ func ParseAndValidateFlags(fs *flag.FlagSet, args []string) (*CLI, error) {
 	// flag declaration
 	podmanRoot := fs.String("podmanRoot", "/var/lib/containers/storage", "Path to Podman root storage directory")
 	roStorage  := fs.String("roStoragePath", "/mnt/nfs/podman", "Path to read-only storage location")
+	storeF     := fs.String("store", "", "Named read-only store of the config files, instead of roStoragePath")
 	mksquashfs := fs.String("mksquashfsPath", "/usr/bin/mksquashfs", "Path to mksquashfs binary")
 	mksOptsF   := fs.String("mksquashfs-opts", "", "Parameters for mksquashfs")
+	presetF    := fs.String("preset", "", "Named set of mksquashfs options: "+PresetNames())
+	builderF   := fs.String("squash-builder", SquashBuilderMksquashfs, "Tool building squash files: mksquashfs or builtin")
+	xattrF     := fs.String("xattr-policy", XattrPolicyWarn, "Source files with xattrs or file capabilities: ignore, warn, fail or preserve")
+	noMountF   := fs.Bool("no-mount", false, "Build the squash file from the layer diffs instead of mounting the source image (needs --squash-builder builtin)")
+	pruneF     := fs.Bool("prune-previous", false, "Remove the previous version when a re-migration moves the tag")
+	var uidMaps, gidMaps stringList
+	fs.Var(&uidMaps, "uid-map", "Rewrite the uids of the squash file, from:to:size (repeatable)")
+	fs.Var(&gidMaps, "gid-map", "Rewrite the gids of the squash file, from:to:size (repeatable)")
+	ownerF     := fs.String("squash-owner", "", "Give every entry of the squash file this uid:gid")
+	var probes stringList
+	fs.Var(&probes, "ready-probe", "Path in the image that must be readable before a container starts (repeatable)")
+	mountProgramF := fs.String("mount-program", "", "parallax-mount binary setup puts in storage.conf (default: next to parallax)")
 	image      := fs.String("image", "", "the name (:tag) of the image to remove")
 	logLevelF  := fs.String("log-level", "info", "Logging level (debug, info, warn, error, fatal, panic)")
+	logFormatF := fs.String("log-format", LogFormatText, "Log line format: text or json")
+	logOutputF := fs.String("log-output", LogSinkStdout, "Where logs go: stdout, stderr, syslog or a file path")
+	metricsDirF := fs.String("metrics-dir", "", "node-exporter textfile collector directory to write metrics to")
+	progressF  := fs.Duration("progress-interval", ProgressInterval, "How often long phases log progress when not on a terminal")
 	migrateF   := fs.Bool("migrate", false, "Migrates an image")
 	rmiF       := fs.Bool("rmi", false, "Removes an image")
 	versionF   := fs.Bool("version", false, "Print version")
@@ -105,10 +237,80 @@ func ParseAndValidateFlags(fs *flag.FlagSet, args []string) (*CLI, error) {
 	// Pass the new help banner
 	fs.Usage = usage_banner
 
+	// Pick up a leading command word before the flags
+	op := OpUnknown
+	command := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		known := false
+		if op, known = commands[command]; !known && subCommands[command] == nil {
+			return nil, fmt.Errorf("Unknown command %q", command)
+		}
+		args = args[1:]
+	}
+	if subs := subCommands[command]; subs != nil {
+		if len(args) == 0 {
+			names := make([]string, 0, len(subs))
+			for name := range subs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("Command %q needs a subcommand: %s", command, strings.Join(names, " or "))
+		}
+		known := false
+		if op, known = subs[args[0]]; !known {
+			return nil, fmt.Errorf("Unknown %s subcommand %q", command, args[0])
+		}
+		command += " " + args[0]
+		args = args[1:]
+	}
+
 	err := fs.Parse(args)
 	if err != nil {
 		return nil, err
 	}
+	// config files fill in what the command line left out
+	sources, profiles, err := applyConfigFiles(fs)
+	if err != nil {
+		return nil, err
+	}
+	// and podman's storage.conf knows where its images are
+	if conf, err := ReadStorageConf(); err == nil {
+		if sources["podmanRoot"] == "" && conf.GraphRoot != "" {
+			fs.Set("podmanRoot", conf.GraphRoot)
+			sources["podmanRoot"] = conf.Source()
+		}
+		if store := conf.RoStoreCandidate(); sources["roStoragePath"] == "" && store != "" {
+			fs.Set("roStoragePath", store)
+			sources["roStoragePath"] = conf.Source() + " (additionalimagestores)"
+		}
+	}
+	// a store profile brings its path and mksquashfs options
+	var profile *StoreProfile
+	if *storeF != "" {
+		p, ok := profiles[*storeF]
+		if !ok {
+			names := []string{}
+			for _, p := range SortedStores(profiles) {
+				names = append(names, p.Name)
+			}
+			return nil, fmt.Errorf("Unknown store %q (configured: %s)", *storeF, strings.Join(names, ", "))
+		}
+		if sources["roStoragePath"] == SourceFlag {
+			return nil, fmt.Errorf("--store and --roStoragePath cannot be combined")
+		}
+		profile = &p
+		fs.Set("roStoragePath", p.Path)
+		sources["roStoragePath"] = "store " + p.Name
+		if p.MksquashfsOpts != "" && sources["mksquashfs-opts"] != SourceFlag {
+			fs.Set("mksquashfs-opts", p.MksquashfsOpts)
+			sources["mksquashfs-opts"] = "store " + p.Name
+		}
+		if p.Preset != "" && sources["preset"] != SourceFlag {
+			fs.Set("preset", p.Preset)
+			sources["preset"] = "store " + p.Name
+		}
+	}
 
 	// Fast version exit
 	if *versionF {
@@ -116,34 +318,83 @@ func ParseAndValidateFlags(fs *flag.FlagSet, args []string) (*CLI, error) {
 		os.Exit(0)
 	}
 
-	// Validate that options flags migrate and rmi are exclusive
-	if *migrateF == *rmiF {
-		return nil, fmt.Errorf("Must specify either -migrate or -rmi")
+	if op == OpUnknown {
+		// Validate that options flags migrate and rmi are exclusive
+		if *migrateF == *rmiF {
+			return nil, fmt.Errorf("Must specify either -migrate or -rmi (or a command such as verify)")
+		}
+		op = map[bool]Operation{true: OpMigrate, false: OpRmi}[*migrateF] // inlined if/else
+	} else if *migrateF || *rmiF {
+		return nil, fmt.Errorf("Command %q cannot be combined with -migrate or -rmi", command)
 	}
-	// Validate that image is present
-	if *image == "" {
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("Unexpected argument %q", fs.Arg(0))
+	}
+
+	// Validate that image is present for the commands working on one image. checksum
+	// works on the whole store, the mounts commands only look at the mount program's
+	// directories, config show only prints the settings and setup writes storage.conf
+	imageOp := op == OpMigrate || op == OpRmi || op == OpVerify
+	if *image == "" && (imageOp || op == OpInspect || op == OpResquash) {
 		return nil, fmt.Errorf("Must specify -image image (e.g. -image ubuntu:latest)")
 	}
 
 	// Argument validation
-	if err := IsDir(*podmanRoot); err != nil {
-		return nil, fmt.Errorf("podmanRoot. Podman root directory: %w", err)
+	if imageOp {
+		if err := IsDir(*podmanRoot); err != nil {
+			return nil, fmt.Errorf("podmanRoot. Podman root directory: %w", err)
+		}
+	}
+	// list checks each store itself, doctor reports what is wrong with it and
+	// mounts list only names the images when it can read the store
+	if op != OpMountsGC && op != OpMountsList && op != OpConfigShow && op != OpList && op != OpDoctor {
+		if err := IsDir(*roStorage); err != nil {
+			return nil, fmt.Errorf("roStoragePath. Read-only storage path: %w", err)
+		}
+	}
+	if profile != nil && (op == OpMigrate || op == OpRmi || op == OpResquash) && !profile.Allows() {
+		return nil, fmt.Errorf("Store %q does not allow user %d to change it", profile.Name, unshare.GetRootlessUID())
 	}
-	if err := IsDir(*roStorage); err != nil {
-		return nil, fmt.Errorf("roStoragePath. Read-only storage path: %w", err)
+	switch *builderF {
+	case SquashBuilderMksquashfs, SquashBuilderBuiltin:
+	default:
+		return nil, fmt.Errorf("Invalid squash-builder %q (mksquashfs or builtin)", *builderF)
 	}
-	if err := IsExecutable(*mksquashfs); err != nil {
-		return nil, fmt.Errorf("mksquashfsPath. mksquashfs binary: %w", err)
+	if *noMountF && *builderF != SquashBuilderBuiltin {
+		return nil, fmt.Errorf("--no-mount streams layers into the builtin builder, add --squash-builder builtin")
+	}
+	// the builtin builder does not need the mksquashfs binary
+	if (op == OpMigrate || op == OpResquash) && *builderF == SquashBuilderMksquashfs {
+		if err := IsExecutable(*mksquashfs); err != nil {
+			return nil, fmt.Errorf("mksquashfsPath. mksquashfs binary: %w", err)
+		}
 	}
 	// Setting up logging
 	level, err := logrus.ParseLevel(*logLevelF)
 	if err != nil {
 		return nil, fmt.Errorf("Invalid log level %q", *logLevelF)
 	}
+	if *logFormatF != LogFormatText && *logFormatF != LogFormatJSON {
+		return nil, fmt.Errorf("Invalid log format %q (text or json)", *logFormatF)
+	}
+	logSink, logFile := *logOutputF, ""
+	switch logSink {
+	case LogSinkStdout, LogSinkStderr, LogSinkSyslog:
+	default:
+		logSink, logFile = LogSinkFile, *logOutputF
+	}
 
 	// Lets parse the mksquashfs options into a string[]
 	var opts []string
-	if *mksOptsF != "" {
+	usePreset, err := choosePreset(*presetF, sources["preset"], sources["mksquashfs-opts"])
+	if err != nil {
+		return nil, err
+	}
+	preset := ""
+	if usePreset {
+		preset = *presetF
+		opts = SquashPresets[preset]
+	} else if *mksOptsF != "" {
 		parser := shellwords.NewParser()
 		parser.ParseBacktick = true
 		parsed, err := parser.Parse(*mksOptsF)
@@ -152,6 +403,51 @@ func ParseAndValidateFlags(fs *flag.FlagSet, args []string) (*CLI, error) {
 		}
 		opts = parsed
 	}
+	if *progressF <= 0 {
+		return nil, fmt.Errorf("progress-interval must be positive")
+	}
+	if *metricsDirF != "" {
+		if err := IsDir(*metricsDirF); err != nil {
+			return nil, fmt.Errorf("metrics-dir. Metrics directory: %w", err)
+		}
+	}
+	for i, p := range probes {
+		if !filepath.IsAbs(p) {
+			return nil, fmt.Errorf("ready-probe %q must be an absolute path in the image", p)
+		}
+		probes[i] = filepath.Clean(p)
+	}
+	if *builderF == SquashBuilderBuiltin {
+		if _, _, err := squashfs.ParseMksquashfsArgs(opts); err != nil {
+			return nil, fmt.Errorf("invalid mksquashfs-opts for the builtin builder: %w", err)
+		}
+	}
+
+	switch *xattrF {
+	case XattrPolicyIgnore, XattrPolicyWarn, XattrPolicyFail:
+	case XattrPolicyPreserve:
+		if !usePreset && slices.Contains(opts, "-no-xattrs") {
+			return nil, fmt.Errorf("--xattr-policy preserve cannot keep xattrs with -no-xattrs in mksquashfs-opts")
+		}
+	default:
+		return nil, fmt.Errorf("Invalid xattr-policy %q (ignore, warn, fail or preserve)", *xattrF)
+	}
+
+	var ownership Ownership
+	if ownership.UIDs, err = ParseIDMap(uidMaps); err != nil {
+		return nil, fmt.Errorf("uid-map. %w", err)
+	}
+	if ownership.GIDs, err = ParseIDMap(gidMaps); err != nil {
+		return nil, fmt.Errorf("gid-map. %w", err)
+	}
+	if *ownerF != "" {
+		if len(uidMaps) > 0 || len(gidMaps) > 0 {
+			return nil, fmt.Errorf("--squash-owner cannot be combined with --uid-map or --gid-map")
+		}
+		if ownership.Owner, err = ParseOwner(*ownerF); err != nil {
+			return nil, fmt.Errorf("squash-owner. %w", err)
+		}
+	}
 
 	// We made it through checks we can init the CLI struct
 	return &CLI {
@@ -161,9 +457,25 @@ func ParseAndValidateFlags(fs *flag.FlagSet, args []string) (*CLI, error) {
 			MksquashfsPath: *mksquashfs,
 			Image: *image,
 			MksquashfsOpts: opts,
+			Preset: preset,
+			SquashBuilder: *builderF,
+			XattrPolicy: *xattrF,
+			Ownership: ownership,
+			NoMount: *noMountF,
+			PrunePrevious: *pruneF,
+			ReadyProbes: probes,
+			MetricsDir: *metricsDirF,
+			Store: *storeF,
+			Stores: profiles,
 		},
-		Op: map[bool]Operation{true: OpMigrate, false: OpRmi}[*migrateF], // inlined if/else
+		Op: op,
 		LogLevel: level,
+		LogFormat: *logFormatF,
+		LogSink: logSink,
+		LogFile: logFile,
+		ProgressInterval: *progressF,
+		MountProgram: *mountProgramF,
+		Settings: effectiveSettings(fs, sources, profiles),
 	}, nil
 }
 
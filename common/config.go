@@ -12,8 +12,33 @@ type Config struct {
     MksquashfsPath    string
     Image             string
 	MksquashfsOpts    []string
+	Preset            string   // preset the MksquashfsOpts come from, if any
+	SquashBuilder     string
+	XattrPolicy       string   // what migration does about source files carrying xattrs
+	Ownership         Ownership // owners rewritten in the squash file
+	NoMount           bool
+	PrunePrevious     bool
+	ReadyProbes       []string // paths the mount program waits for before a container starts
+	MetricsDir        string   // node-exporter textfile collector directory, empty disables metrics
+	Store             string   // name of the selected store profile, if any
+	Stores            map[string]StoreProfile // every configured store profile
 }
 
+// Squash builders, mksquashfs runs the external binary while builtin uses the squashfs package
+const (
+	SquashBuilderMksquashfs = "mksquashfs"
+	SquashBuilderBuiltin    = "builtin"
+)
+
+// Xattr policies: ignore and warn drop xattrs from the side-car, warn reporting
+// the files losing them, fail refuses to migrate such images and preserve keeps them
+const (
+	XattrPolicyIgnore   = "ignore"
+	XattrPolicyWarn     = "warn"
+	XattrPolicyFail     = "fail"
+	XattrPolicyPreserve = "preserve"
+)
+
 func IsDir(path string) error {
 	info, err := os.Stat(path)
 	if err != nil {
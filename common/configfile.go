@@ -0,0 +1,143 @@
+package common
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+// SystemConfigFile is the site wide config file of parallax
+const SystemConfigFile = "/etc/parallax.conf"
+
+// Sources of a setting besides the config files
+const (
+	SourceDefault = "default"
+	SourceFlag    = "flag"
+)
+
+// Flags naming what to do rather than how, they cannot be set in config files
+var commandFlags = map[string]bool{"migrate": true, "rmi": true, "image": true, "version": true}
+
+// Setting is the effective value of an option and where it came from
+type Setting struct {
+	Name   string
+	Value  string
+	Source string // default, flag or the path of a config file
+}
+
+// ConfigFiles lists the config files in the order they are applied, later ones
+// override earlier ones: the system file, the user file and $PARALLAX_CONFIG.
+// Only PARALLAX_CONFIG must exist.
+func ConfigFiles() []string {
+	files := []string{SystemConfigFile}
+	if dir, err := os.UserConfigDir(); err == nil {
+		files = append(files, filepath.Join(dir, "parallax", "parallax.conf"))
+	}
+	if env := os.Getenv("PARALLAX_CONFIG"); env != "" {
+		files = append(files, env)
+	}
+	return files
+}
+
+// applyConfigFiles sets the flags not given on the command line from the
+// config files and returns the source of every flag that is not a default,
+// and the store profiles. The keys of the TOML files are the flag names, or
+// "stores" for the profiles.
+func applyConfigFiles(fs *flag.FlagSet) (map[string]string, map[string]StoreProfile, error) {
+	sources := map[string]string{}
+	profiles := map[string]StoreProfile{}
+	fs.Visit(func(f *flag.Flag) { sources[f.Name] = SourceFlag })
+
+	for _, path := range ConfigFiles() {
+		values := map[string]any{}
+		_, err := toml.DecodeFile(path, &values)
+		if errors.Is(err, os.ErrNotExist) && path != os.Getenv("PARALLAX_CONFIG") {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+		if err := decodeStoreProfiles(path, profiles); err != nil {
+			return nil, nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+		delete(values, "stores")
+
+		// sorted for stable error messages
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			f := fs.Lookup(name)
+			if f == nil {
+				return nil, nil, fmt.Errorf("config file %s: unknown option %q", path, name)
+			}
+			if commandFlags[name] {
+				return nil, nil, fmt.Errorf("config file %s: %q can only be given on the command line", path, name)
+			}
+			if sources[name] == SourceFlag {
+				continue
+			}
+			if err := setFromConfig(f, values[name]); err != nil {
+				return nil, nil, fmt.Errorf("config file %s: option %q: %w", path, name, err)
+			}
+			sources[name] = path
+		}
+	}
+	return sources, profiles, nil
+}
+
+// setFromConfig sets f to a TOML value, lists are only taken by repeatable flags
+// and replace the values of earlier files
+func setFromConfig(f *flag.Flag, value any) error {
+	if list, ok := f.Value.(*stringList); ok {
+		items, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("must be a list of strings")
+		}
+		*list = nil
+		for _, item := range items {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("must be a list of strings")
+			}
+			list.Set(s)
+		}
+		return nil
+	}
+	switch value.(type) {
+	case string, bool, int64, float64:
+		return f.Value.Set(fmt.Sprint(value))
+	}
+	return fmt.Errorf("must be a string, number or boolean")
+}
+
+// effectiveSettings returns the value and source of every option in usage order,
+// followed by the paths of the store profiles
+func effectiveSettings(fs *flag.FlagSet, sources map[string]string, profiles map[string]StoreProfile) []Setting {
+	var settings []Setting
+	for _, name := range flagOrder {
+		f := fs.Lookup(name)
+		if f == nil || commandFlags[name] {
+			continue
+		}
+		source := sources[name]
+		if source == "" {
+			source = SourceDefault
+		}
+		settings = append(settings, Setting{Name: name, Value: f.Value.String(), Source: source})
+	}
+	for _, p := range SortedStores(profiles) {
+		settings = append(settings, Setting{Name: "stores." + p.Name + ".path", Value: p.Path, Source: p.Source})
+		if p.Description != "" {
+			settings = append(settings, Setting{Name: "stores." + p.Name + ".description", Value: p.Description, Source: p.Source})
+		}
+	}
+	return settings
+}
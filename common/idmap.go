@@ -0,0 +1,110 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IDRange maps Size IDs starting at From to the IDs starting at To
+type IDRange struct {
+	From, To, Size uint32
+}
+
+// IDMap rewrites owner IDs, the IDs no range covers are kept
+type IDMap []IDRange
+
+// ParseIDMap reads ranges written as from:to:size, like podman's --uidmap
+func ParseIDMap(specs []string) (IDMap, error) {
+	var m IDMap
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("ID map %q must be from:to:size", spec)
+		}
+		var nums [3]uint32
+		for i, part := range parts {
+			n, err := strconv.ParseUint(part, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("ID map %q: %q is not an ID", spec, part)
+			}
+			nums[i] = uint32(n)
+		}
+		r := IDRange{From: nums[0], To: nums[1], Size: nums[2]}
+		if r.Size == 0 || uint64(r.From)+uint64(r.Size) > 1<<32 || uint64(r.To)+uint64(r.Size) > 1<<32 {
+			return nil, fmt.Errorf("ID map %q: the range is empty or too large", spec)
+		}
+		for _, o := range m {
+			if r.From < o.From+o.Size && o.From < r.From+r.Size {
+				return nil, fmt.Errorf("ID map %q overlaps %d:%d:%d", spec, o.From, o.To, o.Size)
+			}
+		}
+		m = append(m, r)
+	}
+	return m, nil
+}
+
+// Map returns the ID id is rewritten to
+func (m IDMap) Map(id uint32) uint32 {
+	for _, r := range m {
+		if id >= r.From && id-r.From < r.Size {
+			return r.To + (id - r.From)
+		}
+	}
+	return id
+}
+
+// Strings returns the ranges the way ParseIDMap reads them
+func (m IDMap) Strings() []string {
+	var specs []string
+	for _, r := range m {
+		specs = append(specs, fmt.Sprintf("%d:%d:%d", r.From, r.To, r.Size))
+	}
+	return specs
+}
+
+// Ownership rewrites the owners of the entries of a squash side-car while it
+// is built. Owner replaces every owner, otherwise UIDs and GIDs map them.
+type Ownership struct {
+	UIDs, GIDs IDMap
+	Owner      *Owner
+}
+
+// Owner is a numeric uid and gid
+type Owner struct {
+	UID, GID uint32
+}
+
+func (o Owner) String() string {
+	return fmt.Sprintf("%d:%d", o.UID, o.GID)
+}
+
+// ParseOwner reads an owner written as uid:gid
+func ParseOwner(s string) (*Owner, error) {
+	uid, gid, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("owner %q must be uid:gid", s)
+	}
+	u, err := strconv.ParseUint(uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("owner %q: %q is not a uid", s, uid)
+	}
+	g, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("owner %q: %q is not a gid", s, gid)
+	}
+	return &Owner{UID: uint32(u), GID: uint32(g)}, nil
+}
+
+// IsZero tells whether the owners are kept as they are
+func (o Ownership) IsZero() bool {
+	return o.Owner == nil && len(o.UIDs) == 0 && len(o.GIDs) == 0
+}
+
+// Apply returns the owner an entry owned by uid and gid gets
+func (o Ownership) Apply(uid, gid uint32) (uint32, uint32) {
+	if o.Owner != nil {
+		return o.Owner.UID, o.Owner.GID
+	}
+	return o.UIDs.Map(uid), o.GIDs.Map(gid)
+}
@@ -2,6 +2,7 @@ package common
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/containers/image/v5/pkg/shortnames"
@@ -74,6 +75,77 @@ func FindImage(store storage.Store, name string) (storage.Image, error) {
         return storage.Image{}, fmt.Errorf("List images: %w", err)
     }
 
+    matches := imageNameMatcher(name)
+	// loop over all images and its name for a match
+    for _, img := range imgs {
+        if slices.ContainsFunc(img.Names, matches) {
+            return img, nil
+        }
+    }
+
+	// untagged images, like previous versions kept by a re-migration, only have their ID
+	ids := make([]string, len(imgs))
+	for i := range imgs {
+		ids[i] = imgs[i].ID
+	}
+	if i, err := matchImageID(ids, name); err != nil || i >= 0 {
+		if err != nil {
+			return storage.Image{}, err
+		}
+		return imgs[i], nil
+	}
+
+    return storage.Image{}, fmt.Errorf("Image not found: %q", name)
+}
+
+// FindStoreImage looks an image up in overlay-images/images.json of a store
+// without opening it, so read-only commands never write to a shared store
+func FindStoreImage(storeRoot, name string) (*StoreImage, error) {
+	imgs, err := ReadStoreImages(storeRoot)
+	if err != nil {
+		return nil, fmt.Errorf("List images: %w", err)
+	}
+	matches := imageNameMatcher(name)
+	for i := range imgs {
+		if slices.ContainsFunc(imgs[i].Names, matches) {
+			return &imgs[i], nil
+		}
+	}
+	ids := make([]string, len(imgs))
+	for i := range imgs {
+		ids[i] = imgs[i].ID
+	}
+	if i, err := matchImageID(ids, name); err != nil || i >= 0 {
+		if err != nil {
+			return nil, err
+		}
+		return &imgs[i], nil
+	}
+	return nil, fmt.Errorf("Image not found: %q", name)
+}
+
+// matchImageID returns the index of the ID name is, or a prefix of at least 12
+// characters of, -1 when there is none. Prefixes of several IDs are an error.
+func matchImageID(ids []string, name string) (int, error) {
+	if len(name) < 12 || strings.ContainsFunc(name, func(r rune) bool { return !strings.ContainsRune("0123456789abcdef", r) }) {
+		return -1, nil
+	}
+	found := -1
+	for i, id := range ids {
+		if !strings.HasPrefix(id, name) {
+			continue
+		}
+		if found >= 0 {
+			return -1, fmt.Errorf("Image ID %q is ambiguous", name)
+		}
+		found = i
+	}
+	return found, nil
+}
+
+// imageNameMatcher tells whether an image name stands for name as given, normalized
+// with its tag, under localhost or fully qualified
+func imageNameMatcher(name string) func(string) bool {
     base, tag := splitNameTag(name)
 
     // Build candidate name options
@@ -89,20 +161,13 @@ func FindImage(store storage.Store, name string) (storage.Image, error) {
         canonical = fq
     }
 
-	// loop over all images and its name for a match
-    for _, img := range imgs {
-        for _, n := range img.Names {
-            isExactName := (n == name)
-			isNormalized := (n == normalized)
-			isLocalhost := (n == localhostName)
-			isCanonical := (n == canonical)
-
-			if isExactName || isNormalized || isLocalhost || isCanonical {
-                return img, nil
-            }
-        }
-    }
+	return func(n string) bool {
+		isExactName := (n == name)
+		isNormalized := (n == normalized)
+		isLocalhost := (n == localhostName)
+		isCanonical := (n == canonical)
 
-    return storage.Image{}, fmt.Errorf("Image not found: %q", name)
+		return isExactName || isNormalized || isLocalhost || isCanonical
+	}
 }
 
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// Log formats and sinks shared by the parallax binary and the mount program
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	LogSinkStdout = "stdout"
+	LogSinkStderr = "stderr"
+	LogSinkSyslog = "syslog" // the local syslog socket, which journald also serves
+	LogSinkFile   = "file"
+)
+
+// JSONFormatter writes one JSON object per line, fields included
+func JSONFormatter() logrus.Formatter {
+	return &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+}
+
+// SetLogSink sends the lines of logger to sink, appending to path for LogSinkFile.
+// Syslog messages are tagged with tag.
+func SetLogSink(logger *logrus.Logger, sink, path, tag string) error {
+	switch sink {
+	case LogSinkStdout:
+		logger.SetOutput(os.Stdout)
+	case LogSinkStderr:
+		logger.SetOutput(os.Stderr)
+	case LogSinkFile:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return fmt.Errorf("open log file: %w", err)
+		}
+		logger.SetOutput(f)
+	case LogSinkSyslog:
+		hook, err := lsyslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_USER, tag)
+		if err != nil {
+			return fmt.Errorf("connect to syslog: %w", err)
+		}
+		logger.AddHook(hook)
+		logger.SetOutput(io.Discard)
+	default:
+		return fmt.Errorf("unknown log sink %q (stdout, stderr, syslog or file)", sink)
+	}
+	return nil
+}
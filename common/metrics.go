@@ -0,0 +1,219 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containers/storage/pkg/unshare"
+	"golang.org/x/sys/unix"
+)
+
+// Metric types of the Prometheus text exposition format
+const (
+	MetricGauge   = "gauge"
+	MetricCounter = "counter"
+)
+
+// Metrics collects samples to merge into a textfile of the node-exporter
+// textfile collector. Gauges replace the value in the file, counters add to it.
+type Metrics struct {
+	Labels  map[string]string // added to every sample
+	samples []metricSample
+}
+
+type metricSample struct {
+	name, help, typ string
+	labels          map[string]string
+	value           float64
+}
+
+// Gauge records the current value of name, labels are given as key, value pairs
+func (m *Metrics) Gauge(name, help string, value float64, labels ...string) {
+	m.add(name, help, MetricGauge, value, labels)
+}
+
+// Count adds delta to the counter name, labels are given as key, value pairs
+func (m *Metrics) Count(name, help string, delta float64, labels ...string) {
+	m.add(name, help, MetricCounter, delta, labels)
+}
+
+func (m *Metrics) add(name, help, typ string, value float64, labels []string) {
+	s := metricSample{name: name, help: help, typ: typ, labels: map[string]string{}, value: value}
+	for i := 0; i+1 < len(labels); i += 2 {
+		s.labels[labels[i]] = labels[i+1]
+	}
+	m.samples = append(m.samples, s)
+}
+
+// Flush merges the collected samples into dir/file under a file lock, so
+// concurrent parallax processes can share the file, and forgets them.
+func (m *Metrics) Flush(dir, file string) error {
+	if dir == "" || len(m.samples) == 0 {
+		return nil
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, "."+file+".lock"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open metrics lock: %w", err)
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("lock metrics file: %w", err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	path := filepath.Join(dir, file)
+	families, err := readMetrics(path)
+	if err != nil {
+		return err
+	}
+	for _, s := range m.samples {
+		for k, v := range m.Labels {
+			if _, ok := s.labels[k]; !ok {
+				s.labels[k] = v
+			}
+		}
+		f := families[s.name]
+		if f == nil {
+			f = &metricFamily{values: map[string]float64{}}
+			families[s.name] = f
+		}
+		f.help, f.typ = s.help, s.typ
+		key := formatLabels(s.labels)
+		if s.typ == MetricCounter {
+			f.values[key] += s.value
+		} else {
+			f.values[key] = s.value
+		}
+	}
+
+	// the collector only reads *.prom files, the temporary one is skipped
+	tmp := filepath.Join(dir, "."+file+".tmp")
+	if err := os.WriteFile(tmp, []byte(formatMetrics(families)), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	m.samples = nil
+	return nil
+}
+
+type metricFamily struct {
+	help, typ string
+	values    map[string]float64 // by formatted label set
+}
+
+// readMetrics parses a textfile written by Flush
+func readMetrics(path string) (map[string]*metricFamily, error) {
+	families := map[string]*metricFamily{}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return families, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	family := func(name string) *metricFamily {
+		if families[name] == nil {
+			families[name] = &metricFamily{typ: MetricGauge, values: map[string]float64{}}
+		}
+		return families[name]
+	}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			name, help, _ := strings.Cut(strings.TrimPrefix(line, "# HELP "), " ")
+			family(name).help = help
+		case strings.HasPrefix(line, "# TYPE "):
+			name, typ, _ := strings.Cut(strings.TrimPrefix(line, "# TYPE "), " ")
+			family(name).typ = typ
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			i := strings.LastIndexByte(line, ' ')
+			if i < 0 {
+				continue
+			}
+			value, err := strconv.ParseFloat(line[i+1:], 64)
+			if err != nil {
+				continue
+			}
+			series := line[:i]
+			name, labels := series, ""
+			if j := strings.IndexByte(series, '{'); j >= 0 {
+				name, labels = series[:j], series[j:]
+			}
+			family(name).values[labels] = value
+		}
+	}
+	return families, sc.Err()
+}
+
+func formatMetrics(families map[string]*metricFamily) string {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		f := families[name]
+		if f.help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", name, f.help)
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, f.typ)
+		keys := make([]string, 0, len(f.values))
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%s%s %s\n", name, k, formatValue(f.values[k]))
+		}
+	}
+	return b.String()
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i, k := range keys {
+		parts[i] = k + `="` + replacer.Replace(labels[k]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// MetricsFile is the textfile name for the metrics of program, one per user
+// so users never wait on each other's lock
+func MetricsFile(program string) string {
+	return fmt.Sprintf("%s-%d.prom", program, unshare.GetRootlessUID())
+}
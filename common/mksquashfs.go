@@ -0,0 +1,128 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// MksquashfsCaps is what a mksquashfs binary reports it supports
+type MksquashfsCaps struct {
+	Path        string
+	Version     string
+	Compressors []string
+	Default     string              // compressor used without -comp
+	Options     map[string]bool     // general options, e.g. -noappend
+	CompOptions map[string][]string // compressor specific -X options by compressor
+}
+
+var (
+	mksquashfsVersion = regexp.MustCompile(`version (\d+(?:\.\d+)*)`)
+	helpOption        = regexp.MustCompile(`^\s*(-[A-Za-z0-9][-A-Za-z0-9_]*)`)
+	helpCompressor    = regexp.MustCompile(`^\s+([a-z0-9]+)(\s+\(default\))?\s*$`)
+)
+
+// ProbeMksquashfs runs mksquashfs -version and -help to find out its
+// compressors and options
+func ProbeMksquashfs(path string) (*MksquashfsCaps, error) {
+	if err := IsExecutable(path); err != nil {
+		return nil, err
+	}
+	caps := &MksquashfsCaps{Path: path, Options: map[string]bool{}, CompOptions: map[string][]string{}}
+
+	// like -help, -version exits with an error on some versions, only the output counts
+	out, _ := exec.Command(path, "-version").CombinedOutput()
+	if m := mksquashfsVersion.FindSubmatch(out); m != nil {
+		caps.Version = string(m[1])
+	}
+	// newer versions only list every option with -help-all
+	out, _ = exec.Command(path, "-help-all").CombinedOutput()
+	caps.parseHelp(string(out))
+	if len(caps.Options) == 0 {
+		out, _ = exec.Command(path, "-help").CombinedOutput()
+		caps.parseHelp(string(out))
+	}
+	if len(caps.Options) == 0 || len(caps.Compressors) == 0 {
+		return nil, fmt.Errorf("%s -help lists no options or compressors, is it mksquashfs?", path)
+	}
+	sort.Strings(caps.Compressors)
+	return caps, nil
+}
+
+// parseHelp picks the options and the "Compressors available" list out of the usage text
+func (c *MksquashfsCaps) parseHelp(help string) {
+	inCompressors := false
+	compressor := ""
+	sc := bufio.NewScanner(strings.NewReader(help))
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.Contains(line, "Compressors available"):
+			inCompressors = true
+			compressor = ""
+		case inCompressors && helpCompressor.MatchString(line):
+			m := helpCompressor.FindStringSubmatch(line)
+			compressor = m[1]
+			if !slices.Contains(c.Compressors, compressor) {
+				c.Compressors = append(c.Compressors, compressor)
+			}
+			if m[2] != "" {
+				c.Default = compressor
+			}
+		case inCompressors && compressor != "" && helpOption.MatchString(line) && strings.HasPrefix(strings.TrimSpace(line), "-X"):
+			opt := helpOption.FindStringSubmatch(line)[1]
+			if !slices.Contains(c.CompOptions[compressor], opt) {
+				c.CompOptions[compressor] = append(c.CompOptions[compressor], opt)
+			}
+		case len(line) > 0 && line[0] == '-':
+			// options start in the first column, the compressor list ends before them
+			inCompressors = false
+			c.Options[helpOption.FindStringSubmatch(line)[1]] = true
+		case len(line) > 0 && line[0] != ' ' && line[0] != '\t':
+			inCompressors = false
+		}
+	}
+}
+
+// Validate checks that mksquashfs supports the compressor and options of args
+func (c *MksquashfsCaps) Validate(args []string) error {
+	comp := c.Default
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-comp" && i+1 < len(args) {
+			comp = args[i+1]
+		}
+	}
+	if comp != "" && !slices.Contains(c.Compressors, comp) {
+		return fmt.Errorf("mksquashfs %s does not support %s compression (available: %s)",
+			c.Version, comp, strings.Join(c.Compressors, ", "))
+	}
+
+	// only validate -X options when the help text documents them
+	checkComp := false
+	for _, opts := range c.CompOptions {
+		checkComp = checkComp || len(opts) > 0
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case !strings.HasPrefix(arg, "-"):
+			// an option argument
+		case arg == "-e":
+			// every following argument up to the next option is an exclude
+			for i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+			}
+		case strings.HasPrefix(arg, "-X"):
+			if checkComp && !slices.Contains(c.CompOptions[comp], arg) {
+				return fmt.Errorf("mksquashfs option %s is not supported by the %s compressor", arg, comp)
+			}
+		case !c.Options[arg]:
+			return fmt.Errorf("mksquashfs %s does not know option %s", c.Version, arg)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Names recorded for side-cars not built from a preset
+const (
+	PresetDefault = "default" // the built-in flags, no preset or mksquashfs-opts given
+	PresetCustom  = "custom"  // mksquashfs-opts given
+)
+
+// SquashPresets are named sets of mksquashfs options, selected with --preset.
+// Both builders understand them.
+var SquashPresets = map[string][]string{
+	"fast":   {"-noappend", "-comp", "zstd", "-Xcompression-level", "1", "-no-xattrs"},
+	"small":  {"-noappend", "-comp", "zstd", "-Xcompression-level", "19", "-b", "1M", "-no-xattrs"},
+	"compat": {"-noappend", "-comp", "gzip", "-no-xattrs"},
+}
+
+// PresetNames lists the presets for error and usage messages
+func PresetNames() string {
+	names := make([]string, 0, len(SquashPresets))
+	for name := range SquashPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// sourceRank orders where a setting came from, the more specific source wins
+func sourceRank(source string) int {
+	switch {
+	case source == SourceFlag:
+		return 3
+	case strings.HasPrefix(source, "store "):
+		return 2
+	case source != "" && source != SourceDefault:
+		return 1
+	}
+	return 0
+}
+
+// choosePreset tells whether the preset replaces the mksquashfs-opts: the one
+// from the more specific source wins, both from the same source is an error
+func choosePreset(preset, presetSource, optsSource string) (bool, error) {
+	if preset == "" {
+		return false, nil
+	}
+	if _, ok := SquashPresets[preset]; !ok {
+		return false, fmt.Errorf("Unknown preset %q (%s)", preset, PresetNames())
+	}
+	pr, or := sourceRank(presetSource), sourceRank(optsSource)
+	if pr == or && presetSource == SourceFlag {
+		return false, fmt.Errorf("--preset and --mksquashfs-opts cannot be combined")
+	}
+	if pr == or {
+		return false, fmt.Errorf("preset and mksquashfs-opts cannot both be set in %s", presetSource)
+	}
+	return pr > or, nil
+}
@@ -0,0 +1,213 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+)
+
+// ProgressBar draws a progress bar on stderr instead of logging progress
+// events, main sets it when stderr is a terminal and logs are text
+var ProgressBar bool
+
+// ProgressInterval is how often a running phase logs a progress event
+var ProgressInterval = 10 * time.Second
+
+const (
+	barWidth   = 30
+	barRefresh = 200 * time.Millisecond
+)
+
+// Progress reports how far a long running phase got. The amount done is
+// counted in bytes against a total, or set as a percentage by the caller when
+// a tool reports it. Without either only the elapsed time is shown.
+type Progress struct {
+	log   logrus.FieldLogger
+	phase string
+	start time.Time
+
+	mu      sync.Mutex
+	done    int64
+	total   int64
+	percent float64 // reported by the caller, negative when unknown
+
+	stop     chan struct{}
+	finished sync.WaitGroup
+}
+
+// StartProgress starts reporting the progress of phase, total is in bytes or 0 when unknown
+func StartProgress(log logrus.FieldLogger, phase string, total int64) *Progress {
+	p := &Progress{log: log, phase: phase, start: time.Now(), total: total, percent: -1, stop: make(chan struct{})}
+	p.finished.Add(1)
+	go p.report()
+	return p
+}
+
+// Add counts n more bytes done
+func (p *Progress) Add(n int64) {
+	p.mu.Lock()
+	p.done += n
+	p.mu.Unlock()
+}
+
+// SetDone sets the number of bytes done, for counts taken from elsewhere
+func (p *Progress) SetDone(n int64) {
+	p.mu.Lock()
+	p.done = n
+	p.mu.Unlock()
+}
+
+// SetTotal sets the number of bytes the phase will go through
+func (p *Progress) SetTotal(total int64) {
+	p.mu.Lock()
+	p.total = total
+	p.mu.Unlock()
+}
+
+// SetPercent sets the progress as reported by an external tool
+func (p *Progress) SetPercent(percent float64) {
+	p.mu.Lock()
+	p.percent = min(percent, 100)
+	p.mu.Unlock()
+}
+
+// Reader counts the bytes read from r as done
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, p: p}
+}
+
+// Done stops reporting, the bar is left at its last state
+func (p *Progress) Done() {
+	close(p.stop)
+	p.finished.Wait()
+}
+
+func (p *Progress) report() {
+	defer p.finished.Done()
+	interval := ProgressInterval
+	if ProgressBar {
+		interval = barRefresh
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			if ProgressBar {
+				fmt.Fprintf(os.Stderr, "%s\n", p.bar())
+			}
+			return
+		case <-ticker.C:
+			if ProgressBar {
+				fmt.Fprint(os.Stderr, p.bar())
+			} else {
+				p.event()
+			}
+		}
+	}
+}
+
+// state returns the percentage done, negative when unknown, and the byte counts
+func (p *Progress) state() (float64, int64, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	percent := p.percent
+	if percent < 0 && p.total > 0 {
+		percent = min(float64(p.done)*100/float64(p.total), 100)
+	}
+	return percent, p.done, p.total
+}
+
+func (p *Progress) event() {
+	percent, done, total := p.state()
+	elapsed := time.Since(p.start)
+	fields := logrus.Fields{"event": "progress", "phase": p.phase, "elapsed_ms": elapsed.Milliseconds()}
+	msg := fmt.Sprintf("Phase %s running for %s", p.phase, elapsed.Round(time.Second))
+	if done > 0 {
+		fields["bytes_done"] = done
+		msg += ", " + units.BytesSize(float64(done))
+	}
+	if total > 0 {
+		fields["bytes_total"] = total
+		msg += " of " + units.BytesSize(float64(total))
+	}
+	if percent >= 0 {
+		fields["percent"] = int(percent)
+		msg += fmt.Sprintf(" (%d%%)", int(percent))
+	}
+	p.log.WithFields(fields).Info(msg)
+}
+
+func (p *Progress) bar() string {
+	percent, done, total := p.state()
+	elapsed := time.Since(p.start).Round(time.Second)
+	line := fmt.Sprintf("\r\033[K%-14s ", p.phase)
+	if percent < 0 {
+		// nothing to measure, a marker bounces to show the phase is alive
+		pos := int(time.Since(p.start)/barRefresh) % (2 * (barWidth - 1))
+		if pos >= barWidth {
+			pos = 2*(barWidth-1) - pos
+		}
+		line += "[" + strings.Repeat(" ", pos) + "=" + strings.Repeat(" ", barWidth-pos-1) + "]     "
+	} else {
+		filled := int(percent * barWidth / 100)
+		line += fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), int(percent))
+	}
+	if total > 0 {
+		line += fmt.Sprintf(" %s/%s", units.BytesSize(float64(done)), units.BytesSize(float64(total)))
+	} else if done > 0 {
+		line += " " + units.BytesSize(float64(done))
+	}
+	return line + " " + elapsed.String()
+}
+
+// TrackPercent reads the output of a tool until EOF, with lines ended by \r or
+// \n, and sets the progress from the first group of re. The other lines are
+// copied to out.
+func (p *Progress) TrackPercent(r io.Reader, re *regexp.Regexp, out io.Writer) {
+	sc := bufio.NewScanner(r)
+	sc.Split(scanLines)
+	for sc.Scan() {
+		if m := re.FindSubmatch(sc.Bytes()); m != nil {
+			if percent, err := strconv.ParseFloat(string(m[1]), 64); err == nil {
+				p.SetPercent(percent)
+				continue
+			}
+		}
+		out.Write(append(sc.Bytes(), '\n'))
+	}
+	// keep the tool from blocking on a full pipe should a line be too long
+	io.Copy(out, r)
+}
+
+// scanLines splits at \r too, which progress meters use to redraw their line
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+type progressReader struct {
+	r io.Reader
+	p *Progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.Add(int64(n))
+	return n, err
+}
@@ -1,10 +1,14 @@
 package common
 
 import (
+    "bytes"
     "fmt"
     "os"
     "os/exec"
     "path/filepath"
+    "regexp"
+    "strconv"
+    "sync"
 
     log "github.com/sirupsen/logrus"
 )
@@ -42,15 +46,14 @@ func Mirror(srcDir string) (mirrorDir string, cleanup func() error, err error) {
         includePatterns = append(includePatterns, fmt.Sprintf("--include=%s", pattern))
     }
 
-	rsyncArgs := append([]string{"-a"}, includePatterns...)
+	rsyncArgs := append([]string{"-a"}, rsyncProgressFlags()...)
+	rsyncArgs = append(rsyncArgs, includePatterns...)
     rsyncArgs = append(rsyncArgs, "--exclude=*", "--delete")
 
     log.Infof("Mirror setup: rsync from %s to %s", srcPath, mirrorPath)
     rsyncCmd := append(rsyncArgs, srcPath, mirrorPath)
     log.Infof("  rsync args %v", rsyncCmd)
-    cmd := exec.Command("rsync", rsyncCmd...)
-
-    if out, err2 := cmd.CombinedOutput(); err2 != nil {
+    if out, err2 := rsync("mirror", rsyncCmd); err2 != nil {
         os.RemoveAll(mp)
         return "", nil, fmt.Errorf("Initial rsync failed: %v\n%s", err2, out)
     }
@@ -76,9 +79,7 @@ func Mirror(srcDir string) (mirrorDir string, cleanup func() error, err error) {
 
         log.Infof("Mirror-cleanup: rsync back from %s to %s", mirrorPath, srcPath)
         rsyncCmd = append(rsyncArgs, mirrorPath, srcPath)
-        cmdBack := exec.Command("rsync", rsyncCmd...)
-
-        if out, err2 := cmdBack.CombinedOutput(); err2 != nil {
+        if out, err2 := rsync("sync_back", rsyncCmd); err2 != nil {
             return fmt.Errorf("rsync back failed: %v\n%s", err2, out)
         }
 
@@ -91,3 +92,54 @@ func Mirror(srcDir string) (mirrorDir string, cleanup func() error, err error) {
     return mp, cleanup, nil
 }
 
+// rsyncProgressFlags returns the flags making rsync report its overall progress,
+// none for rsync older than 3.1 which does not know them
+func rsyncProgressFlags() []string {
+	rsyncProgressOnce.Do(func() {
+		out, err := exec.Command("rsync", "--version").Output()
+		m := rsyncVersion.FindSubmatch(out)
+		if err != nil || m == nil {
+			log.Warnf("Cannot tell the rsync version, mirroring without progress: %v", err)
+			return
+		}
+		major, _ := strconv.Atoi(string(m[1]))
+		minor, _ := strconv.Atoi(string(m[2]))
+		if major < 3 || major == 3 && minor < 1 {
+			log.Warnf("rsync %s.%s reports no progress, 3.1 or newer does", m[1], m[2])
+			return
+		}
+		rsyncProgress = []string{"--info=progress2", "--no-inc-recursive"}
+	})
+	return rsyncProgress
+}
+
+var (
+	rsyncProgressOnce sync.Once
+	rsyncProgress     []string
+	// the first line of rsync --version, e.g. "rsync  version 3.2.7  protocol version 31"
+	rsyncVersion = regexp.MustCompile(`version v?(\d+)\.(\d+)`)
+)
+
+// rsync shows the progress reported by rsync as phase and returns its other output
+func rsync(phase string, args []string) ([]byte, error) {
+    var out bytes.Buffer
+    cmd := exec.Command("rsync", args...)
+    cmd.Stderr = &out
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return nil, err
+    }
+    if err := cmd.Start(); err != nil {
+        return nil, err
+    }
+
+    p := StartProgress(log.WithField("fn", "Mirror"), phase, 0)
+    var other bytes.Buffer
+    p.TrackPercent(stdout, rsyncPercent, &other)
+    err = cmd.Wait()
+    p.Done()
+    return append(other.Bytes(), out.Bytes()...), err
+}
+
+// rsyncPercent matches the lines of --info=progress2, e.g. "  1,234,567  45%  1.23MB/s  0:00:01"
+var rsyncPercent = regexp.MustCompile(`^\s*[\d,.]+[KMGT]?\s+(\d{1,3})%`)
@@ -0,0 +1,210 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containers/storage/pkg/fileutils"
+	"github.com/containers/storage/types"
+)
+
+// StorageConf is what parallax takes from the containers-storage configuration
+// podman uses for the current user
+type StorageConf struct {
+	Path         string   // storage.conf of the user, possibly not existing yet
+	GraphRoot    string
+	ImageStores  []string // additionalimagestores
+	MountProgram string
+}
+
+// ReadStorageConf reads the storage configuration with the defaults of containers/storage
+func ReadStorageConf() (*StorageConf, error) {
+	opts, err := types.DefaultStoreOptions()
+	if err != nil {
+		return nil, err
+	}
+	path, err := types.DefaultConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	conf := &StorageConf{Path: path, GraphRoot: opts.GraphRoot}
+	for _, opt := range opts.GraphDriverOptions {
+		key, val, ok := strings.Cut(opt, "=")
+		if !ok {
+			continue
+		}
+		// keys may be prefixed with the driver name, e.g. overlay.imagestore
+		switch key[strings.LastIndexByte(key, '.')+1:] {
+		case "imagestore", "additionalimagestore":
+			conf.ImageStores = append(conf.ImageStores, strings.Split(val, ",")...)
+		case "mount_program":
+			conf.MountProgram = val
+		}
+	}
+	return conf, nil
+}
+
+// Source names where the values came from, for config show
+func (c *StorageConf) Source() string {
+	if err := fileutils.Exists(c.Path); err == nil {
+		return c.Path
+	}
+	return "containers-storage defaults"
+}
+
+// RoStoreCandidate returns the first additional image store holding squash
+// files, a store parallax migrated to, or "" when there is none
+func (c *StorageConf) RoStoreCandidate() string {
+	for _, store := range c.ImageStores {
+		if IsDir(filepath.Join(store, "squash")) == nil {
+			return store
+		}
+	}
+	return ""
+}
+
+// UpdateStorageConf adds store to the additionalimagestores of the storage.conf
+// at path and sets its overlay mount_program, keeping the other settings.
+// Comments do not survive, so an existing file is first copied to path.bak.
+// A missing file is seeded with the configuration podman uses without it, as
+// a user storage.conf replaces the system one instead of adding to it.
+// It reports whether anything had to change.
+func UpdateStorageConf(path, store, mountProgram string) (bool, error) {
+	conf := map[string]any{}
+	old, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if conf, err = effectiveStorageConf(); err != nil {
+			return false, fmt.Errorf("read effective storage configuration: %w", err)
+		}
+	case err != nil:
+		return false, err
+	default:
+		if _, err := toml.Decode(string(old), &conf); err != nil {
+			return false, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+
+	changed := false
+	storage := tomlTable(conf, "storage")
+	if storage["driver"] == nil {
+		storage["driver"] = "overlay"
+		changed = true
+	}
+	options := tomlTable(storage, "options")
+	var stores []string
+	if list, ok := options["additionalimagestores"].([]any); ok {
+		for _, s := range list {
+			if s, ok := s.(string); ok {
+				stores = append(stores, s)
+			}
+		}
+	}
+	if !slices.Contains(stores, store) {
+		stores = append(stores, store)
+		changed = true
+	}
+	options["additionalimagestores"] = stores
+	// the deprecated [storage.options] key would compete with the overlay one
+	if _, ok := options["mount_program"]; ok {
+		delete(options, "mount_program")
+		changed = true
+	}
+	overlay := tomlTable(options, "overlay")
+	if overlay["mount_program"] != mountProgram {
+		overlay["mount_program"] = mountProgram
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(conf); err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return false, err
+	}
+	if old != nil {
+		if err := os.WriteFile(path+".bak", old, 0o644); err != nil {
+			return false, err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// effectiveStorageConf returns the storage.conf settings containers/storage
+// uses for the current user without a user storage.conf: those of the system
+// file, with graphroot and runroot as they are for the user
+func effectiveStorageConf() (map[string]any, error) {
+	opts, err := types.DefaultStoreOptions()
+	if err != nil {
+		return nil, err
+	}
+	conf := map[string]any{}
+	storage := tomlTable(conf, "storage")
+	if opts.GraphDriverName != "" {
+		storage["driver"] = opts.GraphDriverName
+	}
+	if len(opts.GraphDriverPriority) > 0 {
+		storage["driver_priority"] = opts.GraphDriverPriority
+	}
+	storage["graphroot"] = opts.GraphRoot
+	storage["runroot"] = opts.RunRoot
+	if opts.ImageStore != "" {
+		storage["imagestore"] = opts.ImageStore
+	}
+	if opts.TransientStore {
+		storage["transient_store"] = true
+	}
+
+	options := tomlTable(storage, "options")
+	if len(opts.PullOptions) > 0 {
+		options["pull_options"] = opts.PullOptions
+	}
+	var stores []string
+	for _, opt := range opts.GraphDriverOptions {
+		key, val, ok := strings.Cut(opt, "=")
+		if !ok {
+			continue
+		}
+		// keys are prefixed with the driver name, e.g. overlay.mountopt
+		driver, name, ok := strings.Cut(key, ".")
+		if !ok {
+			driver, name = "", key
+		}
+		switch {
+		case name == "imagestore" || name == "additionalimagestore":
+			stores = append(stores, strings.Split(val, ",")...)
+		case driver == "":
+			options[name] = val
+		default:
+			tomlTable(options, driver)[name] = val
+		}
+	}
+	if len(stores) > 0 {
+		options["additionalimagestores"] = stores
+	}
+	return conf, nil
+}
+
+// tomlTable returns the table name of t, adding it when missing
+func tomlTable(t map[string]any, name string) map[string]any {
+	if sub, ok := t[name].(map[string]any); ok {
+		return sub
+	}
+	sub := map[string]any{}
+	t[name] = sub
+	return sub
+}
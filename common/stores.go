@@ -0,0 +1,72 @@
+package common
+
+import (
+	"fmt"
+	"os/user"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containers/storage/pkg/unshare"
+)
+
+// StoreProfile is a named read-only store from the [stores.<name>] tables of the config files
+type StoreProfile struct {
+	Name           string   `toml:"-"`
+	Path           string   `toml:"path"`
+	MksquashfsOpts string   `toml:"mksquashfs-opts"` // used unless --mksquashfs-opts is given
+	Preset         string   `toml:"preset"`          // used unless --preset or --mksquashfs-opts is given
+	Users          []string `toml:"users"`           // user names or uids allowed to change it, empty for everyone
+	Description    string   `toml:"description"`
+	Source         string   `toml:"-"` // config file defining it
+}
+
+// decodeStoreProfiles reads the store profiles of a config file, profiles of a
+// later file replace the ones of the same name
+func decodeStoreProfiles(path string, profiles map[string]StoreProfile) error {
+	var file struct {
+		Stores map[string]StoreProfile `toml:"stores"`
+	}
+	md, err := toml.DecodeFile(path, &file)
+	if err != nil {
+		return err
+	}
+	for _, key := range md.Undecoded() {
+		if len(key) > 2 && key[0] == "stores" {
+			return fmt.Errorf("store %q: unknown option %q", key[1], strings.Join(key[2:], "."))
+		}
+	}
+	for name, p := range file.Stores {
+		if p.Path == "" {
+			return fmt.Errorf("store %q has no path", name)
+		}
+		p.Name, p.Source = name, path
+		profiles[name] = p
+	}
+	return nil
+}
+
+// SortedStores returns the profiles ordered by name
+func SortedStores(profiles map[string]StoreProfile) []StoreProfile {
+	stores := make([]StoreProfile, 0, len(profiles))
+	for _, p := range profiles {
+		stores = append(stores, p)
+	}
+	sort.Slice(stores, func(i, j int) bool { return stores[i].Name < stores[j].Name })
+	return stores
+}
+
+// Allows reports whether the user running parallax may change the store
+func (p StoreProfile) Allows() bool {
+	if len(p.Users) == 0 {
+		return true
+	}
+	uid := strconv.Itoa(unshare.GetRootlessUID())
+	if slices.Contains(p.Users, uid) {
+		return true
+	}
+	u, err := user.LookupId(uid)
+	return err == nil && slices.Contains(p.Users, u.Username)
+}
@@ -4,23 +4,41 @@ import (
 	"flag"
 	"os"
 	"fmt"
+	"path/filepath"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/containers/storage/pkg/unshare"
 	"github.com/containers/storage/pkg/reexec"
+	"golang.org/x/term"
 
 	"parallax/cmd"
 	"parallax/common"
+	"parallax/mountprogram"
 )
 
+// Commands running without the rootless user namespace
+var noUserNamespace = map[string]bool{"mounts": true, "config": true, "setup": true, "doctor": true}
+
 func main() {
 	// Registering reexec for unshare
 	if reexec.Init() {
 		return
 	}
-	// Enter new user-namespace needed for rootless storage
-	unshare.MaybeReexecUsingUserNamespace(true)
+	// Podman runs us as mount program, already inside its user namespace
+	if filepath.Base(os.Args[0]) == mountprogram.Name {
+		os.Exit(mountprogram.Main(os.Args[1:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "mount-program" {
+		os.Exit(mountprogram.Main(os.Args[2:]))
+	}
+
+	// Enter new user-namespace needed for rootless storage. The mounts commands
+	// must stay in the caller's mount namespace to see the containers' mounts,
+	// config, setup and doctor do not touch any storage.
+	if len(os.Args) < 2 || !noUserNamespace[os.Args[1]] {
+		unshare.MaybeReexecUsingUserNamespace(true)
+	}
 
 	cli, err := common.ParseAndValidateFlags(flag.CommandLine, os.Args[1:])
 	if err != nil {
@@ -30,11 +48,21 @@ func main() {
 	}
 
 	logrus.SetLevel(cli.LogLevel)
-	logrus.SetOutput(os.Stdout)
-	logrus.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp:   true,
-		TimestampFormat: time.RFC3339,
-	})
+	if err := common.SetLogSink(logrus.StandardLogger(), cli.LogSink, cli.LogFile, "parallax"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	common.ProgressInterval = cli.ProgressInterval
+	if cli.LogFormat == common.LogFormatJSON {
+		logrus.SetFormatter(common.JSONFormatter())
+	} else {
+		logrus.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp:   true,
+			TimestampFormat: time.RFC3339,
+		})
+		// long phases draw a bar for people watching, everything else gets progress events
+		common.ProgressBar = term.IsTerminal(int(os.Stderr.Fd()))
+	}
 
 	switch cli.Op {
 		case common.OpMigrate:
@@ -53,6 +81,68 @@ func main() {
 			if err != nil {
 				logrus.Fatalf("RMI operation failed for image '%s': %v", cli.Config.Image, err)
 			}
+		case common.OpVerify:
+			if err := common.ValidateRoStore(cli.Config.RoStoragePath); err != nil {
+				logrus.Fatalf("Storage validation failed before verify: %v", err)
+			}
+			err = cmd.RunVerify(cli.Config)
+			if err != nil {
+				logrus.Fatalf("Verification failed for image '%s': %v", cli.Config.Image, err)
+			}
+		case common.OpChecksum:
+			if err := common.ValidateRoStore(cli.Config.RoStoragePath); err != nil {
+				logrus.Fatalf("Storage validation failed before checksum: %v", err)
+			}
+			err = cmd.RunChecksum(cli.Config)
+			if err != nil {
+				logrus.Fatalf("Checksum verification failed: %v", err)
+			}
+		case common.OpMountsGC:
+			err = cmd.RunMountsGC()
+			if err != nil {
+				logrus.Fatalf("Mount cleanup failed: %v", err)
+			}
+		case common.OpMountsList:
+			err = cmd.RunMountsList(cli.Config)
+			if err != nil {
+				logrus.Fatalf("Listing mounts failed: %v", err)
+			}
+		case common.OpDoctor:
+			err = cmd.RunDoctor(cli.Config)
+			if err != nil {
+				logrus.Fatalf("Doctor found problems: %v", err)
+			}
+		case common.OpResquash:
+			if err := common.ValidateRoStore(cli.Config.RoStoragePath); err != nil {
+				logrus.Fatalf("Storage validation failed before resquash: %v", err)
+			}
+			err = cmd.RunResquash(cli.Config)
+			if err != nil {
+				logrus.Fatalf("Resquash failed: %v", err)
+			}
+		case common.OpInspect:
+			err = cmd.RunInspect(cli.Config)
+			if err != nil {
+				logrus.Fatalf("Inspect failed: %v", err)
+			}
+		case common.OpList:
+			err = cmd.RunList(cli.Config)
+			if err != nil {
+				logrus.Fatalf("Listing images failed: %v", err)
+			}
+		case common.OpSetup:
+			if err := common.ValidateRoStore(cli.Config.RoStoragePath); err != nil {
+				logrus.Fatalf("Storage validation failed before setup: %v", err)
+			}
+			err = cmd.RunSetup(cli.Config, cli.MountProgram)
+			if err != nil {
+				logrus.Fatalf("Setup failed: %v", err)
+			}
+		case common.OpConfigShow:
+			err = cmd.RunConfigShow(cli.Settings)
+			if err != nil {
+				logrus.Fatalf("Showing the configuration failed: %v", err)
+			}
 		default:
 			panic("Unknown operation. We should never reach here!")
 	}
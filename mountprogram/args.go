@@ -0,0 +1,140 @@
+package mountprogram
+
+import (
+	"errors"
+	"strings"
+)
+
+// MountArgs holds what podman's overlay driver passes to a mount program:
+//
+//	-o lowerdir=l1:l2,upperdir=u,workdir=w[,more options] target
+//
+// Colons and commas inside paths are escaped with a backslash.
+type MountArgs struct {
+	Lower   []string // lower layers, top most first
+	Upper   string
+	Work    string
+	Options []string // other mount options, kept verbatim
+	Flags   []string // other command line flags, kept verbatim
+	Target  string
+}
+
+// ParseArgs parses the mount program command line. The option string may come
+// as a separate argument after -o or attached to it, as in "-o lowerdir=...".
+func ParseArgs(args []string) (*MountArgs, error) {
+	m := &MountArgs{}
+	var optStrings, positional []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-o":
+			if i+1 >= len(args) {
+				return nil, &ArgError{Arg: arg, Err: errors.New("missing option string")}
+			}
+			i++
+			optStrings = append(optStrings, args[i])
+		case strings.HasPrefix(arg, "-o"):
+			optStrings = append(optStrings, strings.TrimLeft(arg[2:], " "))
+		case strings.HasPrefix(arg, "-"):
+			m.Flags = append(m.Flags, arg)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	switch len(positional) {
+	case 0:
+		return nil, ErrNoMountPoint
+	case 1:
+		m.Target = positional[0]
+	default:
+		return nil, &ArgError{Arg: positional[1], Err: errors.New("unexpected argument")}
+	}
+
+	for _, s := range optStrings {
+		for _, opt := range splitUnescaped(s, ',', true) {
+			key, value, _ := strings.Cut(opt, "=")
+			switch key {
+			case "lowerdir":
+				for _, l := range splitUnescaped(value, ':', false) {
+					if l == "" {
+						return nil, &ArgError{Arg: opt, Err: errors.New("empty lower directory")}
+					}
+					m.Lower = append(m.Lower, unescape(l))
+				}
+			case "upperdir":
+				m.Upper = unescape(value)
+			case "workdir":
+				m.Work = unescape(value)
+			case "":
+			default:
+				m.Options = append(m.Options, opt)
+			}
+		}
+	}
+	if len(m.Lower) == 0 {
+		return nil, ErrNoLowerdir
+	}
+	return m, nil
+}
+
+// OptionString rebuilds the -o argument, escaping paths the same way podman does.
+func (m *MountArgs) OptionString() string {
+	lower := make([]string, len(m.Lower))
+	for i, l := range m.Lower {
+		lower[i] = escape(l)
+	}
+	opts := []string{"lowerdir=" + strings.Join(lower, ":")}
+	if m.Upper != "" {
+		opts = append(opts, "upperdir="+escape(m.Upper))
+	}
+	if m.Work != "" {
+		opts = append(opts, "workdir="+escape(m.Work))
+	}
+	return strings.Join(append(opts, m.Options...), ",")
+}
+
+// CommandLine returns the arguments to hand to fuse-overlayfs.
+func (m *MountArgs) CommandLine() []string {
+	args := append([]string{"-o", m.OptionString()}, m.Flags...)
+	return append(args, m.Target)
+}
+
+// splitUnescaped splits s at sep unless it is escaped with a backslash or,
+// when quotes is set, inside double quotes as SELinux contexts may be.
+// Escapes are kept in the returned parts.
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quotes:
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ":", `\:`, ",", `\,`).Replace(s)
+}
@@ -0,0 +1,235 @@
+package mountprogram
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"parallax/common"
+)
+
+// DefaultConfigFile is read when PARALLAX_MP_CONFIG is not set
+const DefaultConfigFile = "/etc/parallax-mount.conf"
+
+// Config is the mount program configuration. It is read from the PARALLAX_MP_*
+// environment variables, overridden by the assignments in the config file.
+type Config struct {
+	LogLevel            string
+	LogFile             string
+	LogMaxSize          int64  // bytes, "parallax mounts gc" rotates larger logs
+	LogFormat           string // text or json
+	LogSink             string // file, stderr or syslog
+	TempParent          string // /tmp/parallax-<uid>
+	TempMountRoot       string // where the squash files get mounted
+	FuseOverlayfs       string
+	Squashfuse          string
+	SquashfuseOpts      []string
+	SquashfuseXattrOpts []string // added for side-cars carrying xattrs, e.g. -o suid for file capabilities
+	Inotifywait         string   // kept for config compatibility, exit detection is native
+	OwnerUID            string   // uid/gid handed to squashfuse, only when both are set
+	OwnerGID            string
+	VerifyChecksum      bool
+	KernelMounts        string // auto, always or never
+	UmountRetries       int
+	UmountDelay         time.Duration
+	WatchInterval       time.Duration // upper bound between checks for the container exit
+	ReadyTimeout        time.Duration // how long mounts and readiness probes may take
+	ReadyInterval       time.Duration
+	MetricsDir          string // node-exporter textfile collector directory, empty disables metrics
+}
+
+var configVars = []string{
+	"PARALLAX_MP_LOGLEVEL",
+	"PARALLAX_MP_LOGFILE",
+	"PARALLAX_MP_LOG_MAX_SIZE",
+	"PARALLAX_MP_LOG_FORMAT",
+	"PARALLAX_MP_LOG_SINK",
+	"PARALLAX_MP_UID",
+	"PARALLAX_MP_GID",
+	"PARALLAX_MP_TMPDIR",
+	"PARALLAX_MP_FUSE_OVERLAYFS_CMD",
+	"PARALLAX_MP_SQUASHFUSE_CMD",
+	"PARALLAX_MP_SQUASHFUSE_FLAG",
+	"PARALLAX_MP_SQUASHFUSE_XATTR_FLAG",
+	"PARALLAX_MP_INOTIFYWAIT_CMD",
+	"PARALLAX_MP_VERIFY_CHECKSUM",
+	"PARALLAX_MP_KERNEL_MOUNTS",
+	"UMOUNT_WAIT_RETRIES",
+	"UMOUNT_WAIT_DELAY",
+	"PARALLAX_MP_WATCH_INTERVAL",
+	"PARALLAX_MP_READY_TIMEOUT",
+	"PARALLAX_MP_READY_INTERVAL",
+	"PARALLAX_MP_METRICS_DIR",
+}
+
+// LoadConfig builds the configuration from the environment and the config file.
+func LoadConfig() (*Config, error) {
+	vars := map[string]string{}
+	for _, name := range configVars {
+		if v, ok := os.LookupEnv(name); ok {
+			vars[name] = v
+		}
+	}
+
+	path := DefaultConfigFile
+	if v := os.Getenv("PARALLAX_MP_CONFIG"); v != "" {
+		path = v
+	}
+	// like the shell version a missing or unreadable file is silently skipped
+	if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		if err := parseConfigFile(f, path, vars); err != nil {
+			return nil, err
+		}
+	}
+
+	get := func(name, def string) string {
+		if v := vars[name]; v != "" {
+			return v
+		}
+		return def
+	}
+
+	uid := get("PARALLAX_MP_UID", strconv.Itoa(os.Getuid()))
+	// not $TMPDIR: podman starts the mount program with its own environment,
+	// gc and mounts list have to find the same directory from a shell
+	cfg := &Config{
+		LogLevel:            strings.ToUpper(get("PARALLAX_MP_LOGLEVEL", "INFO")),
+		TempParent:          filepath.Join("/tmp", "parallax-"+uid),
+		FuseOverlayfs:       get("PARALLAX_MP_FUSE_OVERLAYFS_CMD", "fuse-overlayfs"),
+		Squashfuse:          get("PARALLAX_MP_SQUASHFUSE_CMD", "squashfuse_ll"),
+		Inotifywait:         get("PARALLAX_MP_INOTIFYWAIT_CMD", "inotifywait"),
+		OwnerUID:            vars["PARALLAX_MP_UID"],
+		OwnerGID:            vars["PARALLAX_MP_GID"],
+		SquashfuseOpts:      strings.Fields(vars["PARALLAX_MP_SQUASHFUSE_FLAG"]),
+		SquashfuseXattrOpts: strings.Fields(vars["PARALLAX_MP_SQUASHFUSE_XATTR_FLAG"]),
+		VerifyChecksum:      vars["PARALLAX_MP_VERIFY_CHECKSUM"] == "1",
+		KernelMounts:        strings.ToLower(get("PARALLAX_MP_KERNEL_MOUNTS", KernelMountsAuto)),
+		LogFormat:           strings.ToLower(get("PARALLAX_MP_LOG_FORMAT", common.LogFormatText)),
+		LogSink:             strings.ToLower(get("PARALLAX_MP_LOG_SINK", common.LogSinkFile)),
+		MetricsDir:          vars["PARALLAX_MP_METRICS_DIR"],
+	}
+	if cfg.LogFormat != common.LogFormatText && cfg.LogFormat != common.LogFormatJSON {
+		return nil, &ConfigError{File: path, Err: fmt.Errorf("PARALLAX_MP_LOG_FORMAT must be text or json")}
+	}
+	switch cfg.LogSink {
+	case common.LogSinkFile, common.LogSinkStderr, common.LogSinkSyslog:
+	default:
+		return nil, &ConfigError{File: path, Err: fmt.Errorf("PARALLAX_MP_LOG_SINK must be file, stderr or syslog")}
+	}
+	switch cfg.KernelMounts {
+	case KernelMountsAuto, KernelMountsAlways, KernelMountsNever:
+	default:
+		return nil, &ConfigError{File: path, Err: fmt.Errorf("PARALLAX_MP_KERNEL_MOUNTS must be auto, always or never")}
+	}
+	cfg.TempMountRoot = get("PARALLAX_MP_TMPDIR", filepath.Join(cfg.TempParent, "mount_program"))
+	cfg.LogFile = get("PARALLAX_MP_LOGFILE", filepath.Join(cfg.TempParent, "mount_program.log"))
+
+	maxSize, err := strconv.ParseInt(get("PARALLAX_MP_LOG_MAX_SIZE", "10"), 10, 64)
+	if err != nil || maxSize < 0 {
+		return nil, &ConfigError{File: path, Err: fmt.Errorf("PARALLAX_MP_LOG_MAX_SIZE must be a number of MiB")}
+	}
+	cfg.LogMaxSize = maxSize << 20
+
+	if cfg.UmountRetries, err = strconv.Atoi(get("UMOUNT_WAIT_RETRIES", "100000")); err != nil || cfg.UmountRetries < 1 {
+		return nil, &ConfigError{File: path, Err: fmt.Errorf("UMOUNT_WAIT_RETRIES must be a positive number")}
+	}
+	delay, err := strconv.ParseFloat(get("UMOUNT_WAIT_DELAY", "30"), 64)
+	if err != nil || delay < 0 {
+		return nil, &ConfigError{File: path, Err: fmt.Errorf("UMOUNT_WAIT_DELAY must be a number of seconds")}
+	}
+	cfg.UmountDelay = time.Duration(delay * float64(time.Second))
+	interval, err := strconv.ParseFloat(get("PARALLAX_MP_WATCH_INTERVAL", "5"), 64)
+	if err != nil || interval <= 0 {
+		return nil, &ConfigError{File: path, Err: fmt.Errorf("PARALLAX_MP_WATCH_INTERVAL must be a positive number of seconds")}
+	}
+	cfg.WatchInterval = time.Duration(interval * float64(time.Second))
+	if cfg.ReadyTimeout, err = seconds(get("PARALLAX_MP_READY_TIMEOUT", "50")); err != nil {
+		return nil, &ConfigError{File: path, Err: fmt.Errorf("PARALLAX_MP_READY_TIMEOUT %w", err)}
+	}
+	if cfg.ReadyInterval, err = seconds(get("PARALLAX_MP_READY_INTERVAL", "0.1")); err != nil {
+		return nil, &ConfigError{File: path, Err: fmt.Errorf("PARALLAX_MP_READY_INTERVAL %w", err)}
+	}
+	return cfg, nil
+}
+
+// seconds parses a positive, possibly fractional, number of seconds
+func seconds(s string) (time.Duration, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return 0, errors.New("must be a positive number of seconds")
+	}
+	return time.Duration(v * float64(time.Second)), nil
+}
+
+var assignment = regexp.MustCompile(`^(?:export\s+)?([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
+
+// parseConfigFile applies the shell style assignments of a config file to vars.
+// Only plain assignments are supported: NAME=value, NAME="value", NAME='value',
+// optionally prefixed with export. $NAME and ${NAME} are expanded outside single quotes.
+func parseConfigFile(f *os.File, path string, vars map[string]string) error {
+	lookup := func(name string) string {
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		return os.Getenv(name)
+	}
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := assignment.FindStringSubmatch(line)
+		if m == nil {
+			return &ConfigError{File: path, Line: n, Err: errors.New("only NAME=value assignments are supported")}
+		}
+		value, err := shellValue(m[2], lookup)
+		if err != nil {
+			return &ConfigError{File: path, Line: n, Err: err}
+		}
+		vars[m[1]] = value
+	}
+	if err := sc.Err(); err != nil {
+		return &ConfigError{File: path, Err: err}
+	}
+	return nil
+}
+
+func shellValue(raw string, lookup func(string) string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, "'"):
+		end := strings.Index(raw[1:], "'")
+		if end < 0 {
+			return "", errors.New("unterminated single quote")
+		}
+		if rest := strings.TrimSpace(raw[end+2:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after value", rest)
+		}
+		return raw[1 : end+1], nil
+	case strings.HasPrefix(raw, `"`):
+		end := strings.LastIndex(raw, `"`)
+		if end == 0 {
+			return "", errors.New("unterminated double quote")
+		}
+		if rest := strings.TrimSpace(raw[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after value", rest)
+		}
+		return os.Expand(raw[1:end], lookup), nil
+	}
+	// unquoted values end at the first blank, anything after must be a comment
+	if i := strings.IndexAny(raw, " \t"); i >= 0 {
+		if rest := strings.TrimSpace(raw[i:]); !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after value", rest)
+		}
+		raw = raw[:i]
+	}
+	return os.Expand(raw, lookup), nil
+}
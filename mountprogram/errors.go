@@ -0,0 +1,57 @@
+package mountprogram
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrNoLowerdir   = errors.New("no lowerdir in mount options")
+	ErrNoMountPoint = errors.New("no mount point given")
+)
+
+// ArgError reports a malformed mount program argument.
+type ArgError struct {
+	Arg string
+	Err error
+}
+
+func (e *ArgError) Error() string { return fmt.Sprintf("invalid argument %q: %v", e.Arg, e.Err) }
+func (e *ArgError) Unwrap() error { return e.Err }
+
+// ConfigError reports an invalid config file line or value.
+type ConfigError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("config %s line %d: %v", e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("config %s: %v", e.File, e.Err)
+}
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// CommandError reports a failed helper such as squashfuse or fuse-overlayfs.
+type CommandError struct {
+	Cmd    []string
+	Output string
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s failed: %v: %s", e.Cmd[0], e.Err, strings.TrimSpace(e.Output))
+}
+func (e *CommandError) Unwrap() error { return e.Err }
+
+// MountError reports a mount that did not become usable.
+type MountError struct {
+	Path string
+	Err  error
+}
+
+func (e *MountError) Error() string { return fmt.Sprintf("mount %s: %v", e.Path, e.Err) }
+func (e *MountError) Unwrap() error { return e.Err }
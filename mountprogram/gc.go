@@ -0,0 +1,155 @@
+package mountprogram
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// gcUmountAttempts bounds the unmount tries of gc, a busy mount is reported as
+// failed and tried again on the next run rather than waited for like watchers do
+const gcUmountAttempts = 1
+
+// GCReport sums up what CollectGarbage did
+type GCReport struct {
+	Unmounted   []string // squash mounts no overlay used anymore
+	InUse       []string // squash mounts left alone
+	Failed      []string // squash mounts that could not be unmounted
+	RemovedDirs []string // leftover empty lowerdir directories
+	RotatedLog  string   // where the log file was rotated to, if it was
+}
+
+// CollectGarbage cleans up after crashed nodes and killed watchers: it unmounts the
+// squash mounts under the temp mount root that no overlay uses anymore, removes
+// the leftover lowerdir directories and rotates the log file once it is too large.
+// It has to run in the mount namespace of the containers.
+func CollectGarbage(cfg *Config, log logrus.FieldLogger) (*GCReport, error) {
+	mp := &mountProgram{cfg: cfg, log: log, metrics: newMetrics()}
+	defer mp.flushMetrics()
+	report := &GCReport{}
+	grace := mp.gcGrace()
+
+	if err := mp.pruneState(); err != nil {
+		return nil, err
+	}
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	mountPoints := map[string]bool{}
+	for _, m := range mounts {
+		mountPoints[m.MountPoint] = true
+	}
+	used := usedLowers(mounts, cfg.FuseOverlayfs)
+
+	dirs, err := filepath.Glob(filepath.Join(cfg.TempMountRoot, "lowerdir.*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		switch {
+		case used[dir]:
+			log.Infof("Squash mount %s is in use", dir)
+			report.InUse = append(report.InUse, dir)
+		case mountPoints[dir]:
+			recent := false
+			err := mp.unmountShared(dir, gcUmountAttempts, func(m *SharedMount) bool {
+				recent = m != nil && time.Since(m.Updated) < grace
+				return recent
+			})
+			switch {
+			case err != nil:
+				log.Error(err)
+				report.Failed = append(report.Failed, dir)
+			case recent:
+				log.Infof("Squash mount %s was just taken by a container, keeping it", dir)
+				report.InUse = append(report.InUse, dir)
+			default:
+				report.Unmounted = append(report.Unmounted, dir)
+			}
+		default:
+			// under the lock, containers create these before mounting
+			err := withSharedState(cfg.TempMountRoot, false, func(sharedState) error {
+				return os.Remove(dir)
+			})
+			if err != nil {
+				log.Warnf("Could not remove %s: %v", dir, err)
+				continue
+			}
+			log.Infof("Removed leftover lowerdir %s", dir)
+			report.RemovedDirs = append(report.RemovedDirs, dir)
+		}
+	}
+
+	if report.RotatedLog, err = rotateLog(cfg.LogFile, cfg.LogMaxSize); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// gcGrace protects mounts a container took recently and may still be stacking
+// its overlay on: probing the squash mount and waiting for the overlay
+func (mp *mountProgram) gcGrace() time.Duration {
+	return 2 * mp.cfg.ReadyTimeout
+}
+
+// pruneState forgets the users whose overlay is gone and the mounts that are gone
+func (mp *mountProgram) pruneState() error {
+	grace := mp.gcGrace()
+	return withSharedState(mp.cfg.TempMountRoot, true, func(st sharedState) error {
+		for key, m := range st {
+			if time.Since(m.Updated) < grace {
+				continue
+			}
+			if mounted, _ := IsMountPoint(m.Dir); !mounted {
+				mp.log.Infof("Forgetting squash mount %s, it is not mounted", m.Dir)
+				delete(st, key)
+				continue
+			}
+			m.Users = slices.DeleteFunc(m.Users, func(target string) bool {
+				mounted, _ := IsMountPoint(target)
+				if !mounted {
+					mp.log.Infof("Forgetting user %s of %s, it is not mounted", target, m.Dir)
+				}
+				return !mounted
+			})
+		}
+		return nil
+	})
+}
+
+// usedLowers collects the lower directories of the overlays currently mounted
+func usedLowers(mounts []MountInfo, fuseOverlayfs string) map[string]bool {
+	used := map[string]bool{}
+	for _, o := range mountedOverlays(mounts, fuseOverlayfs) {
+		for _, l := range o.Lower {
+			used[l] = true
+		}
+	}
+	return used
+}
+
+// rotateLog moves the log file aside as <file>.1 once it is larger than maxSize bytes
+func rotateLog(path string, maxSize int64) (string, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Size() <= maxSize {
+		return "", nil
+	}
+	// running mount programs keep appending to the old file until they exit
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		return "", fmt.Errorf("rotate %s: %w", path, err)
+	}
+	return rotated, nil
+}
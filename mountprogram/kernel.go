@@ -0,0 +1,113 @@
+package mountprogram
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Values of PARALLAX_MP_KERNEL_MOUNTS
+const (
+	KernelMountsAuto   = "auto"   // kernel squashfs and overlayfs for squash lowers where allowed, FUSE otherwise
+	KernelMountsAlways = "always" // kernel mounts only, failing instead of falling back
+	KernelMountsNever  = "never"  // squashfuse and fuse-overlayfs only
+)
+
+// kernelSquashfsAllowed reports whether squash files can go through loop devices:
+// neither loop devices nor squashfs can be mounted from a user namespace.
+func kernelSquashfsAllowed() bool {
+	return os.Geteuid() == 0 && !inUserNamespace()
+}
+
+// kernelOverlayAllowed reports whether overlayfs can be mounted here: as root
+// outside a user namespace, or in one from kernel 5.11 on once overlay is loaded
+func kernelOverlayAllowed() bool {
+	if !inUserNamespace() {
+		return os.Geteuid() == 0
+	}
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil || !kernelAtLeast(unix.ByteSliceToString(uts.Release[:]), 5, 11) {
+		return false
+	}
+	data, err := os.ReadFile("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if f := strings.Fields(line); len(f) > 0 && f[len(f)-1] == "overlay" {
+			return true
+		}
+	}
+	return false
+}
+
+// kernelAtLeast compares a kernel release such as 5.14.0-362.el9.x86_64 to major.minor
+func kernelAtLeast(release string, major, minor int) bool {
+	var maj, min int
+	if _, err := fmt.Sscanf(release, "%d.%d", &maj, &min); err != nil {
+		return false
+	}
+	return maj > major || (maj == major && min >= minor)
+}
+
+// inUserNamespace reports whether we run in a user namespace other than the initial one
+func inUserNamespace() bool {
+	data, err := os.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	f := strings.Fields(string(data))
+	return len(f) != 3 || f[0] != "0" || f[1] != "0" || f[2] != "4294967295"
+}
+
+// tryKernel runs mount when kernel mounts are configured and allowed and reports
+// whether it did. In auto mode a failed kernel mount falls back to FUSE.
+func (mp *mountProgram) tryKernel(what string, allowed bool, mount func() error) (bool, error) {
+	switch mp.cfg.KernelMounts {
+	case KernelMountsNever:
+		return false, nil
+	case KernelMountsAlways:
+		if !allowed {
+			return false, fmt.Errorf("kernel %s mounts are not allowed here and PARALLAX_MP_KERNEL_MOUNTS=%s", what, KernelMountsAlways)
+		}
+		return true, mount()
+	}
+	if !allowed {
+		mp.log.Infof("Kernel %s mounts are not allowed here, using FUSE", what)
+		return false, nil
+	}
+	if err := mount(); err != nil {
+		mp.log.Warnf("Kernel %s mount failed, falling back to FUSE: %v", what, err)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (mp *mountProgram) kernelSquashMount(squashPath, target string) error {
+	_, err := mp.runAndLog("Mounting squash file with the kernel.", "mount", "-t", "squashfs", "-o", "loop,ro", squashPath, target)
+	return err
+}
+
+func (mp *mountProgram) kernelOverlayMount(margs *MountArgs) error {
+	if len(margs.Flags) > 0 {
+		return fmt.Errorf("fuse-overlayfs flags %s have no kernel equivalent", strings.Join(margs.Flags, " "))
+	}
+	opts := margs.OptionString()
+	// trusted.* xattrs are out of reach in a user namespace
+	if inUserNamespace() && !slices.Contains(margs.Options, "userxattr") {
+		opts += ",userxattr"
+	}
+	mp.log.Infof("Running (Kernel overlay mount): mount -t overlay overlay -o %s %s", opts, margs.Target)
+	if err := unix.Mount("overlay", margs.Target, "overlay", 0, opts); err != nil {
+		if errors.Is(err, unix.EINVAL) {
+			err = fmt.Errorf("%w, the kernel rejects some of the options", err)
+		}
+		return &MountError{Path: margs.Target, Err: err}
+	}
+	mp.log.Info("Kernel overlay mount successful")
+	return nil
+}
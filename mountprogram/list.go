@@ -0,0 +1,110 @@
+package mountprogram
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ActiveMount is a squash mount under the temp mount root and the overlays stacked on it
+type ActiveMount struct {
+	Dir    string
+	FSType string
+	Squash string    // empty when it cannot be told
+	PID    int       // FUSE daemon serving the mount, 0 for kernel mounts
+	Since  time.Time // zero when unknown
+	Users  []Overlay
+}
+
+// Overlay is a mounted container root
+type Overlay struct {
+	Target string
+	PID    int // fuse-overlayfs daemon, 0 for kernel overlays
+	Lower  []string
+}
+
+// ListMounts returns the squash mounts under the temp mount root, oldest first.
+// It has to run in the mount namespace of the containers.
+func ListMounts(cfg *Config) ([]ActiveMount, error) {
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := LoadSharedMounts(cfg.TempMountRoot)
+	if err != nil {
+		return nil, err
+	}
+	squashfuse := fuseDaemons(cfg.Squashfuse)
+	overlays := mountedOverlays(mounts, cfg.FuseOverlayfs)
+
+	var active []ActiveMount
+	prefix := filepath.Join(cfg.TempMountRoot, "lowerdir.")
+	for _, m := range mounts {
+		if !strings.HasPrefix(m.MountPoint, prefix) {
+			continue
+		}
+		a := ActiveMount{Dir: m.MountPoint, FSType: m.FSType}
+		for _, s := range shared {
+			if s.Dir == a.Dir {
+				a.Squash, a.Since = s.Squash, s.Since
+			}
+		}
+		// squashfuse is given the squash file and the mount point last
+		for pid, argv := range squashfuse {
+			if len(argv) >= 3 && argv[len(argv)-1] == a.Dir {
+				a.PID = pid
+				if a.Squash == "" {
+					a.Squash = argv[len(argv)-2]
+				}
+			}
+		}
+		if a.Squash == "" && strings.HasPrefix(m.Source, "/dev/loop") {
+			a.Squash = loopBackingFile(m.Source)
+		}
+		for _, o := range overlays {
+			if slices.Contains(o.Lower, a.Dir) {
+				a.Users = append(a.Users, o)
+			}
+		}
+		active = append(active, a)
+	}
+	slices.SortStableFunc(active, func(a, b ActiveMount) int { return a.Since.Compare(b.Since) })
+	return active, nil
+}
+
+// mountedOverlays returns the kernel overlays of the mount table and the mounts
+// of the running fuse-overlayfs daemons
+func mountedOverlays(mounts []MountInfo, fuseOverlayfs string) []Overlay {
+	var overlays []Overlay
+	// kernel overlays show their lowers in the super options
+	for _, m := range mounts {
+		if m.FSType != "overlay" {
+			continue
+		}
+		o := Overlay{Target: m.MountPoint}
+		for _, opt := range strings.Split(m.SuperOpts, ",") {
+			if value, ok := strings.CutPrefix(opt, "lowerdir="); ok {
+				o.Lower = strings.Split(unescapeMountInfo(value), ":")
+			}
+		}
+		overlays = append(overlays, o)
+	}
+	// FUSE mounts don't, but fuse-overlayfs has them on its command line
+	for pid, argv := range fuseDaemons(fuseOverlayfs) {
+		if margs, err := ParseArgs(argv[1:]); err == nil {
+			overlays = append(overlays, Overlay{Target: margs.Target, PID: pid, Lower: margs.Lower})
+		}
+	}
+	return overlays
+}
+
+// loopBackingFile returns the file behind a loop device, empty if it cannot be read
+func loopBackingFile(dev string) string {
+	data, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(dev), "loop", "backing_file"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
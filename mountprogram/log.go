@@ -0,0 +1,61 @@
+package mountprogram
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"parallax/common"
+)
+
+// Log levels of the mount program as named in PARALLAX_MP_LOGLEVEL
+var logLevels = map[string]logrus.Level{
+	"ERROR":   logrus.ErrorLevel,
+	"WARNING": logrus.WarnLevel,
+	"INFO":    logrus.InfoLevel,
+	"DEBUG":   logrus.DebugLevel,
+}
+
+// lineFormatter keeps the "[date] LEVEL: message" lines of the shell version
+type lineFormatter struct{}
+
+func (lineFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	level := "INFO"
+	for name, l := range logLevels {
+		if l == e.Level {
+			level = name
+		}
+	}
+	return fmt.Appendf(nil, "[%s] %s: %s\n", e.Time.Format("2006-01-02 15:04:05"), level, e.Message), nil
+}
+
+// openLog returns a logger writing to the configured sink, by default appending to the log file
+func openLog(cfg *Config) (*logrus.Logger, error) {
+	level, ok := logLevels[cfg.LogLevel]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Invalid log level '%s'. Defaulting to INFO.\n", cfg.LogLevel)
+		level = logrus.InfoLevel
+	}
+
+	logger := logrus.New()
+	if err := common.SetLogSink(logger, cfg.LogSink, cfg.LogFile, Name); err != nil {
+		return nil, err
+	}
+	logger.SetLevel(level)
+	if cfg.LogFormat == common.LogFormatJSON {
+		logger.SetFormatter(common.JSONFormatter())
+	} else {
+		logger.SetFormatter(lineFormatter{})
+	}
+	return logger, nil
+}
+
+// phase logs how long a step of the mount took and records it in the metrics
+func (mp *mountProgram) phase(name string, start time.Time) {
+	d := time.Since(start)
+	mp.observe(name, d)
+	mp.log.WithFields(logrus.Fields{"phase": name, "duration_ms": d.Milliseconds()}).
+		Infof("Phase %s took %s", name, d.Round(time.Millisecond))
+}
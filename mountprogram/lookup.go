@@ -0,0 +1,66 @@
+package mountprogram
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"parallax/common"
+)
+
+// storeImageOf finds the image whose squash link is lower, a <store>/overlay/l/<link>
+// path, in the images of that store. It returns a nil image for plain directories.
+func storeImageOf(lower string) (string, *common.StoreImage, error) {
+	target, err := os.Readlink(lower)
+	if errors.Is(err, syscall.EINVAL) {
+		// a plain directory, not a layer of a store
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	// links point to ../<layer ID>/diff
+	layer := filepath.Base(filepath.Dir(target))
+	storeRoot := filepath.Dir(filepath.Dir(filepath.Dir(lower)))
+
+	imgs, err := common.ReadStoreImages(storeRoot)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, img := range imgs {
+		if img.TopLayer == layer {
+			return storeRoot, &img, nil
+		}
+	}
+	return storeRoot, nil, nil
+}
+
+// containerID finds the container whose read-write layer is upper, a
+// <graphroot>/overlay/<layer ID>/diff path, in the containers of that store.
+// It returns an empty string when there is none.
+func containerID(upper string) string {
+	if upper == "" {
+		return ""
+	}
+	layer := filepath.Base(filepath.Dir(upper))
+	graphRoot := filepath.Dir(filepath.Dir(filepath.Dir(upper)))
+	data, err := os.ReadFile(filepath.Join(graphRoot, "overlay-containers", "containers.json"))
+	if err != nil {
+		return ""
+	}
+	var containers []struct {
+		ID    string `json:"id"`
+		Layer string `json:"layer"`
+	}
+	if err := json.Unmarshal(data, &containers); err != nil {
+		return ""
+	}
+	for _, c := range containers {
+		if c.Layer == layer {
+			return c.ID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,31 @@
+package mountprogram
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/containers/storage/pkg/unshare"
+
+	"parallax/common"
+)
+
+// metricsName names the mount program's file in the metrics directory
+const metricsName = "parallax-mount"
+
+func newMetrics() common.Metrics {
+	return common.Metrics{Labels: map[string]string{"uid": strconv.Itoa(unshare.GetRootlessUID())}}
+}
+
+// flushMetrics merges what this run recorded into the metrics file, if enabled.
+// Every mount adds to the same counters, averages come from the _sum and _count pairs.
+func (mp *mountProgram) flushMetrics() {
+	if err := mp.metrics.Flush(mp.cfg.MetricsDir, common.MetricsFile(metricsName)); err != nil {
+		mp.log.Warnf("Could not write metrics to %s: %v", mp.cfg.MetricsDir, err)
+	}
+}
+
+// observe adds a duration of a mount phase to the latency counters
+func (mp *mountProgram) observe(phase string, d time.Duration) {
+	mp.metrics.Count("parallax_mount_duration_seconds_sum", "Total time spent in mount phases", d.Seconds(), "phase", phase)
+	mp.metrics.Count("parallax_mount_duration_seconds_count", "Number of timed mount phases", 1, "phase", phase)
+}
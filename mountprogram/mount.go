@@ -0,0 +1,317 @@
+// Package mountprogram is the overlay mount program podman runs for every
+// container when configured with --storage-opt mount_program=.../parallax-mount.
+// Layers that come with a squash side-car are mounted with squashfuse and
+// stacked below the container with fuse-overlayfs, everything else is handed
+// to fuse-overlayfs unchanged.
+package mountprogram
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"parallax/common"
+)
+
+// Name is the program name podman is pointed at, usually a symlink to the parallax binary
+const Name = "parallax-mount"
+
+// watchFlag runs the background process releasing the squash mount once the container is gone
+const watchFlag = "--watch"
+
+// Main runs the mount program with the arguments following the program name and returns the exit code.
+func Main(args []string) int {
+	cfg, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if err := prepareDirs(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	logger, err := openLog(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	mp := &mountProgram{cfg: cfg, log: logger, metrics: newMetrics()}
+	defer mp.flushMetrics()
+
+	if len(args) == 3 && args[0] == watchFlag {
+		mp.log = logger.WithField("mount_dir", args[1])
+		if err := mp.watch(args[1], args[2]); err != nil {
+			mp.log.Error(err)
+			return 1
+		}
+		return 0
+	}
+
+	if err := mp.run(args); err != nil {
+		mp.log.Error(err)
+		// podman shows what the mount program prints
+		if cfg.LogSink != common.LogSinkStderr {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+type mountProgram struct {
+	cfg     *Config
+	log     logrus.FieldLogger
+	metrics common.Metrics
+	xattrs  bool // the side-car was built keeping xattrs
+}
+
+func prepareDirs(cfg *Config) error {
+	if err := os.MkdirAll(filepath.Dir(cfg.LogFile), 0o755); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	// shared by every user of the node, like /tmp itself
+	for _, dir := range []string{cfg.TempParent, cfg.TempMountRoot} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+		if err := os.Chmod(dir, 0o777|os.ModeSticky); err != nil {
+			return fmt.Errorf("failed to set permissions on directory %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+func (mp *mountProgram) run(args []string) error {
+	// FUSE is still needed as fallback unless kernel mounts are forced
+	if mp.cfg.KernelMounts != KernelMountsAlways {
+		for _, dep := range []string{mp.cfg.FuseOverlayfs, mp.cfg.Squashfuse} {
+			if _, err := exec.LookPath(dep); err != nil {
+				return fmt.Errorf("missing required dependency: %s", dep)
+			}
+		}
+		mp.log.Info("All dependencies are available")
+	}
+
+	margs, err := ParseArgs(args)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	defer mp.phase("total", start)
+	fields := logrus.Fields{"mount_dir": margs.Target}
+	if id := containerID(margs.Upper); id != "" {
+		fields["container_id"] = id
+	}
+	mp.log = mp.log.WithFields(fields)
+
+	// the squash side-car belongs to the bottom layer, where migration put the flattened image
+	squashLower := margs.Lower[len(margs.Lower)-1]
+	squashPath := squashLower + ".squash"
+	f, err := os.Open(squashPath)
+	if err != nil {
+		mp.log.Info("Normal container mount")
+		defer mp.phase("overlay_mount", time.Now())
+		return mp.overlayMount(margs, false)
+	}
+	f.Close()
+	fields = logrus.Fields{"squash_link": filepath.Base(squashLower)}
+	if storeRoot, img, _ := storeImageOf(squashLower); img != nil {
+		fields["image"] = img.ID
+		if len(img.Names) > 0 {
+			fields["image"] = img.Names[0]
+		}
+		if opts, err := common.ReadSquashOptions(storeRoot, img.ID); err == nil && opts != nil {
+			mp.xattrs = opts.Xattrs
+		}
+	}
+	mp.log = mp.log.WithFields(fields)
+	if mp.xattrs {
+		mp.log.Info("Squash file keeps xattrs")
+	}
+	mp.log.Infof("Verified file exists and is readable: %s", squashPath)
+	mp.log.Info("Squashed container mount")
+
+	if err := mp.verifyMountPoint(margs.Target); err != nil {
+		return err
+	}
+	if mp.cfg.VerifyChecksum {
+		if err := mp.verifyChecksum(squashPath); err != nil {
+			return err
+		}
+	}
+
+	phaseStart := time.Now()
+	lower, err := mp.acquireSquash(squashPath, margs.Target)
+	if err != nil {
+		return err
+	}
+	mp.phase("squash_mount", phaseStart)
+	phaseStart = time.Now()
+	if err := mp.probe(squashLower, lower); err != nil {
+		mp.releaseSquash(lower, margs.Target)
+		return err
+	}
+	mp.phase("probes", phaseStart)
+
+	phaseStart = time.Now()
+	margs.Lower[len(margs.Lower)-1] = lower
+	mp.log.Infof("Replacing lowerdir with: %s", strings.Join(margs.Lower, ":"))
+	if err := mp.overlayMount(margs, true); err != nil {
+		mp.releaseSquash(lower, margs.Target)
+		return err
+	}
+	if err := mp.waitReady(margs.Target); err != nil {
+		mp.releaseSquash(lower, margs.Target)
+		return fmt.Errorf("overlay mount not ready: %w", err)
+	}
+	mp.phase("overlay_mount", phaseStart)
+
+	// the container root must be traversable by the user namespace
+	if info, err := os.Stat(margs.Target); err == nil {
+		if err := os.Chmod(margs.Target, info.Mode()|0o555); err != nil {
+			mp.log.Warnf("Updating permissions for %s failed: %v", margs.Target, err)
+		}
+	}
+
+	pid, err := mp.startWatcher(margs.Target, lower)
+	if err != nil {
+		return err
+	}
+	mp.log.Infof("Watcher process started with PID: %d", pid)
+	return nil
+}
+
+func (mp *mountProgram) verifyMountPoint(target string) error {
+	info, err := os.Stat(target)
+	if err != nil || !info.IsDir() {
+		return &MountError{Path: target, Err: errors.New("mount point does not exist or is not a directory")}
+	}
+	mounted, err := IsMountPoint(target)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return &MountError{Path: target, Err: errors.New("mount point is already in use")}
+	}
+	mp.log.Infof("Verified mount point is valid: %s", target)
+	return nil
+}
+
+func (mp *mountProgram) verifyChecksum(squashPath string) error {
+	real, err := filepath.EvalSymlinks(squashPath)
+	if err != nil {
+		return fmt.Errorf("cannot resolve squash file %s: %w", squashPath, err)
+	}
+	mp.log.Infof("Verifying checksum of %s", real)
+	err = common.VerifyChecksum(real)
+	if errors.Is(err, common.ErrNoChecksum) {
+		mp.log.Warnf("No checksum recorded for %s, skipping verification", real)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mp.log.Infof("Checksum verified for %s", real)
+	return nil
+}
+
+func (mp *mountProgram) squashMount(squashPath, target string) error {
+	kernel, err := mp.tryKernel("squashfs", kernelSquashfsAllowed(), func() error {
+		return mp.kernelSquashMount(squashPath, target)
+	})
+	if kernel || err != nil {
+		return err
+	}
+
+	opts := append([]string{}, mp.cfg.SquashfuseOpts...)
+	// optional uid/gid passthrough, both need to be set
+	if mp.cfg.OwnerUID != "" && mp.cfg.OwnerGID != "" {
+		opts = append(opts, "-o", "uid="+mp.cfg.OwnerUID+",gid="+mp.cfg.OwnerGID)
+		mp.log.Infof("Applying squashfuse uid/gid mapping: uid=%s gid=%s", mp.cfg.OwnerUID, mp.cfg.OwnerGID)
+	}
+	if mp.xattrs && len(mp.cfg.SquashfuseXattrOpts) > 0 {
+		opts = append(opts, mp.cfg.SquashfuseXattrOpts...)
+		mp.log.Infof("Applying squashfuse xattr options: %s", strings.Join(mp.cfg.SquashfuseXattrOpts, " "))
+	}
+
+	args := append(opts, squashPath, target)
+	_, err = mp.runAndLog("Mounting squash file.", mp.cfg.Squashfuse, args...)
+	var cerr *CommandError
+	if errors.As(err, &cerr) && strings.Contains(cerr.Output, "mountpoint is not empty") {
+		mp.log.Warn("Retry squashfuse with -o nonempty")
+		_, err = mp.runAndLog("Mounting squash file.", mp.cfg.Squashfuse, append(args, "-o", "nonempty")...)
+	}
+	return err
+}
+
+// overlayMount stacks the container overlay, squash tells whether a squash
+// mount is among its lowers. In auto mode only those go through the kernel,
+// other containers get fuse-overlayfs as they would without parallax.
+func (mp *mountProgram) overlayMount(margs *MountArgs, squash bool) error {
+	if squash || mp.cfg.KernelMounts == KernelMountsAlways {
+		kernel, err := mp.tryKernel("overlayfs", kernelOverlayAllowed(), func() error {
+			return mp.kernelOverlayMount(margs)
+		})
+		if kernel || err != nil {
+			return err
+		}
+	}
+	if mp.xattrs && slices.Contains(margs.Options, "noxattrs=1") {
+		mp.log.Warn("fuse-overlayfs runs with noxattrs=1, the xattrs of the squash file are hidden from the container")
+	}
+	return mp.fuseMount(margs.CommandLine())
+}
+
+func (mp *mountProgram) fuseMount(args []string) error {
+	_, err := mp.runAndLog("Exec fuse-overlayfs mount", mp.cfg.FuseOverlayfs, args...)
+	return err
+}
+
+// waitReady polls until path is mounted and can be listed
+func (mp *mountProgram) waitReady(path string) error {
+	for deadline := time.Now().Add(mp.cfg.ReadyTimeout); time.Now().Before(deadline); time.Sleep(mp.cfg.ReadyInterval) {
+		if mounted, _ := IsMountPoint(path); mounted {
+			if _, err := os.ReadDir(path); err == nil {
+				mp.log.Infof("Mount ready: %s", path)
+				return nil
+			}
+		}
+		mp.log.Debugf("Mount not ready: %s", path)
+	}
+	return &MountError{Path: path, Err: fmt.Errorf("timed out after %s waiting for mount", mp.cfg.ReadyTimeout)}
+}
+
+func (mp *mountProgram) runAndLog(description, name string, args ...string) (string, error) {
+	mp.log.Infof("Running (%s): %s %s", description, name, strings.Join(args, " "))
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		mp.log.Errorf("%s failed: %s", description, out)
+		return string(out), &CommandError{Cmd: append([]string{name}, args...), Output: string(out), Err: err}
+	}
+	mp.log.Infof("%s successful: %s", description, out)
+	return string(out), nil
+}
+
+// startWatcher re-executes the binary detached from podman to clean up after the container
+func (mp *mountProgram) startWatcher(mountDir, lower string) (int, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	cmd := exec.Command(self, watchFlag, mountDir, lower)
+	cmd.Args[0] = Name
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("start watcher: %w", err)
+	}
+	pid := cmd.Process.Pid
+	return pid, cmd.Process.Release()
+}
@@ -0,0 +1,105 @@
+package mountprogram
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MountInfo is one line of /proc/self/mountinfo
+type MountInfo struct {
+	ID         int
+	Parent     int
+	Root       string
+	MountPoint string
+	Options    string
+	FSType     string
+	Source     string
+	SuperOpts  string
+}
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+// ReadMountInfo parses the mount table of the current mount namespace
+func ReadMountInfo() ([]MountInfo, error) {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []MountInfo
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		// id parent major:minor root mountpoint options [optional...] - fstype source superoptions
+		pre, post, ok := strings.Cut(sc.Text(), " - ")
+		if !ok {
+			continue
+		}
+		fields, tail := strings.Fields(pre), strings.Fields(post)
+		if len(fields) < 6 || len(tail) < 2 {
+			continue
+		}
+		m := MountInfo{
+			Root:       unescapeMountInfo(fields[3]),
+			MountPoint: unescapeMountInfo(fields[4]),
+			Options:    fields[5],
+			FSType:     tail[0],
+			Source:     unescapeMountInfo(tail[1]),
+		}
+		m.ID, _ = strconv.Atoi(fields[0])
+		m.Parent, _ = strconv.Atoi(fields[1])
+		if len(tail) > 2 {
+			m.SuperOpts = tail[2]
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, sc.Err()
+}
+
+// unescapeMountInfo decodes the octal escapes (\040 for space) the kernel uses
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// IsMountPoint reports whether path is the target of a mount
+func IsMountPoint(path string) (bool, error) {
+	_, ok, err := FindMount(path)
+	return ok, err
+}
+
+// FindMount returns the top most mount on path
+func FindMount(path string) (MountInfo, bool, error) {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	path = filepath.Clean(path)
+
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		return MountInfo{}, false, err
+	}
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].MountPoint == path {
+			return mounts[i], true, nil
+		}
+	}
+	return MountInfo{}, false, nil
+}
@@ -0,0 +1,77 @@
+package mountprogram
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"parallax/common"
+)
+
+// probe waits until the readiness probes recorded for the image of squashLower
+// can be read from its squash mount at dir, so a container never starts on a
+// half ready lower.
+func (mp *mountProgram) probe(squashLower, dir string) error {
+	probes, err := mp.readyProbes(squashLower)
+	if err != nil {
+		// the image may come from a store parallax does not know the layout of
+		mp.log.Warnf("Cannot read readiness probes for %s: %v", squashLower, err)
+		return nil
+	}
+	if len(probes) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	deadline := start.Add(mp.cfg.ReadyTimeout)
+	for _, p := range probes {
+		for {
+			err := probeReadable(filepath.Join(dir, p))
+			if err == nil {
+				mp.log.Infof("Readiness probe %s passed after %s", p, time.Since(start).Round(time.Millisecond))
+				break
+			}
+			if time.Now().After(deadline) {
+				return &MountError{Path: dir, Err: fmt.Errorf("readiness probe %s failed after %s: %w", p, mp.cfg.ReadyTimeout, err)}
+			}
+			mp.log.Debugf("Readiness probe %s not ready: %v", p, err)
+			time.Sleep(mp.cfg.ReadyInterval)
+		}
+	}
+	return nil
+}
+
+// readyProbes returns the probes recorded for the image whose squash link is lower
+func (mp *mountProgram) readyProbes(lower string) ([]string, error) {
+	storeRoot, img, err := storeImageOf(lower)
+	if err != nil || img == nil {
+		return nil, err
+	}
+	probes, err := common.ReadReadyProbes(storeRoot, img.ID)
+	if len(probes) > 0 {
+		mp.log.Infof("Image %s has readiness probes: %s", img.ID, strings.Join(probes, " "))
+	}
+	return probes, err
+}
+
+// probeReadable checks that path exists and, for files, that its first byte can be read
+func probeReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() && info.Size() > 0 {
+		if _, err := f.Read(make([]byte, 1)); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package mountprogram
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Files kept in TEMP_MOUNT_ROOT to share squash mounts between containers
+const (
+	stateFile = "shared-mounts.json"
+	lockFile  = "shared-mounts.lock"
+)
+
+// SharedMount is a squashfuse mount used by one or more containers of the node.
+type SharedMount struct {
+	Squash  string    `json:"squash"` // resolved path of the squash file
+	Dir     string    `json:"dir"`    // where it is mounted
+	Users   []string  `json:"users"`  // overlay mount points using it
+	Since   time.Time `json:"since"`
+	Updated time.Time `json:"updated"` // last time a container took it
+}
+
+// sharedState maps resolved squash paths to their mount
+type sharedState map[string]*SharedMount
+
+// LoadSharedMounts returns the shared mounts recorded under the temp mount root
+func LoadSharedMounts(root string) ([]SharedMount, error) {
+	var mounts []SharedMount
+	err := withSharedState(root, false, func(st sharedState) error {
+		for _, m := range st {
+			mounts = append(mounts, *m)
+		}
+		return nil
+	})
+	slices.SortFunc(mounts, func(a, b SharedMount) int { return a.Since.Compare(b.Since) })
+	return mounts, err
+}
+
+// withSharedState runs fn on the state while holding the lock, saving changes when write is set
+func withSharedState(root string, write bool, fn func(sharedState) error) error {
+	lock, err := os.OpenFile(filepath.Join(root, lockFile), os.O_RDWR|os.O_CREATE, 0o666)
+	if err != nil {
+		return fmt.Errorf("open lock file: %w", err)
+	}
+	defer lock.Close()
+	mode := unix.LOCK_SH
+	if write {
+		mode = unix.LOCK_EX
+	}
+	for {
+		err = unix.Flock(int(lock.Fd()), mode)
+		if !errors.Is(err, unix.EINTR) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("lock %s: %w", lock.Name(), err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	path := filepath.Join(root, stateFile)
+	st := sharedState{}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &st); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+
+	if err := fn(st); err != nil || !write {
+		return err
+	}
+
+	data, err = json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// sharedDir is the mount point of a squash file, stable so every container finds it
+func sharedDir(root, squash string) string {
+	sum := sha256.Sum256([]byte(squash))
+	return filepath.Join(root, "lowerdir."+hex.EncodeToString(sum[:8]))
+}
+
+// acquireSquash returns a mount of squashPath for the overlay at target,
+// mounting it if no other container on the node uses it yet.
+func (mp *mountProgram) acquireSquash(squashPath, target string) (string, error) {
+	squash, err := filepath.EvalSymlinks(squashPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve squash file %s: %w", squashPath, err)
+	}
+
+	var dir string
+	// mounting under the lock makes concurrent containers wait for the first one
+	err = withSharedState(mp.cfg.TempMountRoot, true, func(st sharedState) error {
+		if m, ok := st[squash]; ok {
+			if mounted, _ := IsMountPoint(m.Dir); mounted {
+				m.Users = append(m.Users, target)
+				m.Updated = time.Now()
+				dir = m.Dir
+				mp.log.Infof("Reusing squash mount %s (%d users)", m.Dir, len(m.Users))
+				return nil
+			}
+			mp.log.Warnf("Recorded squash mount %s is gone, mounting again", m.Dir)
+		}
+
+		now := time.Now()
+		m := &SharedMount{Squash: squash, Dir: sharedDir(mp.cfg.TempMountRoot, squash), Users: []string{target}, Since: now, Updated: now}
+		if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create lowerdir mountpoint %s: %w", m.Dir, err)
+		}
+		if err := mp.squashMount(squashPath, m.Dir); err != nil {
+			os.Remove(m.Dir)
+			return err
+		}
+		if err := mp.waitReady(m.Dir); err != nil {
+			exec.Command("umount", m.Dir).Run()
+			os.Remove(m.Dir)
+			return fmt.Errorf("squashfuse mount not ready: %w", err)
+		}
+		st[squash] = m
+		dir = m.Dir
+		return nil
+	})
+	return dir, err
+}
+
+// releaseSquash drops target from the users of the squash mount at dir and
+// unmounts it once the last user is gone.
+func (mp *mountProgram) releaseSquash(dir, target string) error {
+	first := true
+	return mp.unmountShared(dir, mp.cfg.UmountRetries, func(m *SharedMount) bool {
+		if m == nil {
+			mp.log.Infof("No shared mount recorded for %s", dir)
+			return true
+		}
+		if first {
+			m.Users = slices.DeleteFunc(m.Users, func(u string) bool { return u == target })
+			first = false
+		}
+		if len(m.Users) > 0 {
+			mp.log.Infof("Squash mount %s still used by %d containers", dir, len(m.Users))
+			return true
+		}
+		return false
+	})
+}
+
+// unmountShared unmounts the squash mount at dir and removes it from the state,
+// making up to attempts tries UMOUNT_WAIT_DELAY apart. Each attempt is
+// made under the lock after asking keep, so a container starting meanwhile
+// keeps the mount alive instead. keep gets nil for mounts missing from the state.
+func (mp *mountProgram) unmountShared(dir string, attempts int, keep func(*SharedMount) bool) error {
+	for i := 0; i < attempts; i++ {
+		last := i == attempts-1
+		done := false
+		err := withSharedState(mp.cfg.TempMountRoot, true, func(st sharedState) error {
+			var m *SharedMount
+			for _, candidate := range st {
+				if candidate.Dir == dir {
+					m = candidate
+				}
+			}
+			if keep(m) {
+				done = true
+				return nil
+			}
+
+			if mounted, _ := IsMountPoint(dir); mounted {
+				out, err := exec.Command("umount", "-v", dir).CombinedOutput()
+				if err != nil {
+					if last {
+						mp.log.Infof("Unmount failed (%s)", out)
+						return nil
+					}
+					mp.log.Infof("Unmount failed (%s), retrying in %s", out, mp.cfg.UmountDelay)
+					mp.metrics.Count("parallax_unmount_retries_total", "Squash unmounts that failed and were retried", 1)
+					return nil
+				}
+				mp.log.Infof("Successfully unmounted %s", dir)
+				mp.metrics.Count("parallax_unmounts_total", "Squash mounts unmounted", 1)
+			}
+			if m != nil {
+				delete(st, m.Squash)
+			}
+			if err := os.Remove(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+				mp.log.Warnf("Could not remove temporary lowerdir %s", dir)
+			} else {
+				mp.log.Infof("Removed temporary lowerdir %s", dir)
+			}
+			done = true
+			return nil
+		})
+		if err != nil || done {
+			return err
+		}
+		if last {
+			break
+		}
+		// watchers may retry for hours, report the retries as they happen
+		mp.flushMetrics()
+		time.Sleep(mp.cfg.UmountDelay)
+	}
+	mp.metrics.Count("parallax_unmount_failures_total", "Squash unmounts given up after all retries", 1)
+	return fmt.Errorf("failed to unmount %s after %d attempts", dir, attempts)
+}
@@ -0,0 +1,134 @@
+package mountprogram
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// watch waits for the container to go away and then releases its share of the squash mount.
+// The container is gone once its overlay mount leaves the mount table or the
+// fuse-overlayfs daemon serving it exits, whichever is noticed first.
+func (mp *mountProgram) watch(mountDir, lower string) error {
+	if _, err := os.Stat(mountDir); err != nil {
+		return fmt.Errorf("mount directory %s does not exist or is not accessible", mountDir)
+	}
+	mp.log.Infof("Starting squash watcher for shared lowerdir: %s and mount directory: %s", lower, mountDir)
+
+	trigger := mp.waitForExit(mountDir)
+	mp.log.Infof("Cleanup of %s triggered by: %s", mountDir, trigger)
+
+	if err := mp.releaseSquash(lower, mountDir); err != nil {
+		mp.log.Error(err)
+	}
+	mp.log.Infof("Watcher DONE for %s", mountDir)
+	return nil
+}
+
+// waitForExit blocks until the overlay mounted on mountDir is gone and returns what gave it away.
+// The mount table is polled for changes, and rechecked at least every WatchInterval
+// in case a change notification is missed.
+func (mp *mountProgram) waitForExit(mountDir string) string {
+	overlay, ok, err := FindMount(mountDir)
+	if err != nil {
+		return fmt.Sprintf("reading %s failed: %v", mountInfoPath, err)
+	}
+	if !ok {
+		return "overlay mount already gone"
+	}
+
+	mountinfo, err := os.Open(mountInfoPath)
+	if err != nil {
+		return fmt.Sprintf("opening %s failed: %v", mountInfoPath, err)
+	}
+	defer mountinfo.Close()
+	fds := []unix.PollFd{{Fd: int32(mountinfo.Fd()), Events: unix.POLLPRI}}
+
+	if pid := fuseDaemonPID(mp.cfg.FuseOverlayfs, overlay.MountPoint); pid > 0 {
+		pidfd, err := unix.PidfdOpen(pid, 0)
+		if err != nil {
+			mp.log.Warnf("Cannot watch %s process %d: %v", mp.cfg.FuseOverlayfs, pid, err)
+		} else {
+			defer unix.Close(pidfd)
+			fds = append(fds, unix.PollFd{Fd: int32(pidfd), Events: unix.POLLIN})
+			mp.log.Infof("Watching %s process %d", mp.cfg.FuseOverlayfs, pid)
+		}
+	} else {
+		mp.log.Infof("No %s process found for %s, watching the mount table only", mp.cfg.FuseOverlayfs, mountDir)
+	}
+
+	timeout := max(int(mp.cfg.WatchInterval.Milliseconds()), 1)
+	for {
+		n, err := unix.Poll(fds, timeout)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return fmt.Sprintf("polling failed: %v", err)
+		}
+		if len(fds) > 1 && fds[1].Revents != 0 {
+			return fmt.Sprintf("%s process exited", mp.cfg.FuseOverlayfs)
+		}
+		if mounted, err := hasMount(overlay); err != nil {
+			return fmt.Sprintf("reading %s failed: %v", mountInfoPath, err)
+		} else if !mounted {
+			if n == 0 {
+				return "overlay mount disappeared (interval check)"
+			}
+			return "overlay mount disappeared"
+		}
+	}
+}
+
+// hasMount reports whether the mount is still in the mount table
+func hasMount(m MountInfo) (bool, error) {
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		return false, err
+	}
+	for _, cur := range mounts {
+		if cur.ID == m.ID && cur.MountPoint == m.MountPoint {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fuseDaemonPID finds the process of program serving the mount on target, 0 if there is none
+func fuseDaemonPID(program, target string) int {
+	for pid, argv := range fuseDaemons(program) {
+		if argv[len(argv)-1] == target {
+			return pid
+		}
+	}
+	return 0
+}
+
+// fuseDaemons returns the command lines of the running processes of program by PID
+func fuseDaemons(program string) map[int][]string {
+	daemons := map[int][]string{}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return daemons
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join("/proc", e.Name(), "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		argv := strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+		if filepath.Base(argv[0]) == filepath.Base(program) {
+			daemons[pid] = argv
+		}
+	}
+	return daemons
+}
@@ -92,6 +92,8 @@ LOG_FILE="${PARALLAX_MP_LOGFILE:-$TEMP_PARENT/mount_program.log}" # Set log file
 : "${PARALLAX_MP_INOTIFYWAIT_CMD:=inotifywait}"
 : "${PARALLAX_MP_FUSE_OVERLAYFS_CMD:=fuse-overlayfs}"
 : "${PARALLAX_MP_SQUASHFUSE_CMD:=squashfuse_ll}"
+# Verify squash files against their recorded .sha256 before mounting (1 = on)
+: "${PARALLAX_MP_VERIFY_CHECKSUM:=0}"
 # ignore squashfuse flag if not set
 #: "${PARALLAX_MP_SQUASHFUSE_FLAG:=''}"
 
@@ -292,6 +294,26 @@ do_squash_mount() {
     fi
 }
 
+verify_squash_checksum() {
+    local squash_file="$1"
+    local real_squash
+    local checksum_file
+
+    real_squash=$(readlink -f "$squash_file") || handle_error "Cannot resolve squash file: $squash_file"
+    checksum_file="${real_squash}.sha256"
+
+    if [ ! -r "$checksum_file" ]; then
+        log "WARNING" "No checksum recorded for $real_squash, skipping verification"
+        return 0
+    fi
+
+    log "INFO" "Verifying checksum of $real_squash"
+    if ! (cd "$(dirname "$real_squash")" && sha256sum --status -c "$checksum_file") >>"$LOG_FILE" 2>&1; then
+        handle_error "Checksum mismatch for $real_squash"
+    fi
+    log "INFO" "Checksum verified for $real_squash"
+}
+
 do_fuse_mount() {
     run_and_log "Exec fuse-overlayfs mount" "$FUSE_OVERLAYFS_CMD" "$@"
  #   if [ $? -ne 0 ]; then
@@ -441,6 +463,9 @@ main() {
       log "INFO" "Squashed container mount"
 
       verify_mount_point "$MOUNT_DIR"
+      if [[ "$PARALLAX_MP_VERIFY_CHECKSUM" == "1" ]]; then
+          verify_squash_checksum "${LOWER_DIR}.squash"
+      fi
       TEMP_LOWER_DIR=$(create_temp_lowerdir_mountpoint)
 
       # Do the mounts
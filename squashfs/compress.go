@@ -0,0 +1,186 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+type compressor interface {
+	compress(src []byte) ([]byte, error)
+	// options returns the compressor options block to record, nil when defaults are used
+	options() []byte
+}
+
+// Default levels as used by mksquashfs, anything else is recorded in the image
+const (
+	defaultGzipLevel = 9
+	defaultZstdLevel = 15
+)
+
+func newCompressor(c Compression, level int, blockSize uint32) (compressor, error) {
+	switch c {
+	case Gzip:
+		if level == 0 {
+			level = defaultGzipLevel
+		}
+		if level < 1 || level > 9 {
+			return nil, fmt.Errorf("gzip compression level %d out of range 1-9", level)
+		}
+		return gzipCompressor{level: level}, nil
+	case Xz:
+		if level != 0 {
+			return nil, fmt.Errorf("xz does not support a compression level")
+		}
+		return xzCompressor{dictCap: int(blockSize)}, nil
+	case Zstd:
+		if level == 0 {
+			level = defaultZstdLevel
+		}
+		if level < 1 || level > 22 {
+			return nil, fmt.Errorf("zstd compression level %d out of range 1-22", level)
+		}
+		enc, err := zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithEncoderCRC(false),
+			// the kernel decoder only accepts windows up to the block size
+			zstd.WithWindowSize(int(blockSize)))
+		if err != nil {
+			return nil, err
+		}
+		return zstdCompressor{enc: enc, level: level}, nil
+	}
+	return nil, fmt.Errorf("%s compression is not supported for writing", c)
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+func (g gzipCompressor) compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&buf, g.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(src); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g gzipCompressor) options() []byte {
+	if g.level == defaultGzipLevel {
+		return nil
+	}
+	// compression level, window size, strategies
+	opts := make([]byte, 8)
+	order.PutUint32(opts[0:], uint32(g.level))
+	order.PutUint16(opts[4:], 15)
+	return opts
+}
+
+type xzCompressor struct {
+	dictCap int
+}
+
+func (x xzCompressor) compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	// the kernel decoder supports CRC32 but not always CRC64
+	xw, err := xz.WriterConfig{DictCap: x.dictCap, CheckSum: xz.CRC32}.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := xw.Write(src); err != nil {
+		return nil, err
+	}
+	if err := xw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A dictionary of block size is what readers assume without options
+func (x xzCompressor) options() []byte { return nil }
+
+type zstdCompressor struct {
+	enc   *zstd.Encoder
+	level int
+}
+
+func (z zstdCompressor) compress(src []byte) ([]byte, error) {
+	return z.enc.EncodeAll(src, nil), nil
+}
+
+func (z zstdCompressor) options() []byte {
+	if z.level == defaultZstdLevel {
+		return nil
+	}
+	opts := make([]byte, 4)
+	order.PutUint32(opts, uint32(z.level))
+	return opts
+}
+
+type decompressor interface {
+	// decompress returns the uncompressed content of src, which expands to at most max bytes
+	decompress(src []byte, max int) ([]byte, error)
+}
+
+func newDecompressor(c Compression) (decompressor, error) {
+	switch c {
+	case Gzip:
+		return streamDecompressor(func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) }), nil
+	case Xz:
+		return streamDecompressor(func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) }), nil
+	case Lzma:
+		return streamDecompressor(func(r io.Reader) (io.Reader, error) { return lzma.NewReader(r) }), nil
+	case Zstd:
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zstdDecompressor{dec}, nil
+	}
+	return nil, fmt.Errorf("%s compression is not supported", c)
+}
+
+type streamDecompressor func(io.Reader) (io.Reader, error)
+
+func (s streamDecompressor) decompress(src []byte, max int) ([]byte, error) {
+	r, err := s(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > max {
+		return nil, fmt.Errorf("block expands beyond %d bytes", max)
+	}
+	return out, nil
+}
+
+type zstdDecompressor struct {
+	dec *zstd.Decoder
+}
+
+func (z zstdDecompressor) decompress(src []byte, max int) ([]byte, error) {
+	out, err := z.dec.DecodeAll(src, make([]byte, 0, max))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > max {
+		return nil, fmt.Errorf("block expands beyond %d bytes", max)
+	}
+	return out, nil
+}
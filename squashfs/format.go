@@ -0,0 +1,238 @@
+// Package squashfs reads and writes SquashFS 4.0 images as produced by mksquashfs
+// and consumed by squashfuse and the kernel driver.
+package squashfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+)
+
+const (
+	magic        = 0x73717368
+	superSize    = 96
+	metaSize     = 8192 // uncompressed size of a metadata block
+	metaUncomp   = 0x8000
+	dataUncomp   = 1 << 24
+	noFragment   = 0xFFFFFFFF
+	noXattr      = 0xFFFFFFFF
+	noTable      = 0xFFFFFFFFFFFFFFFF
+	fragEntrySz  = 16
+	xattrIDSz    = 16
+	xattrOOL     = 0x100
+	xattrTypeMsk = 0xFF
+)
+
+// Superblock flags
+const (
+	flagUncompressedInodes    = 0x0001
+	flagUncompressedData      = 0x0002
+	flagUncompressedFragments = 0x0008
+	flagNoFragments           = 0x0010
+	flagAlwaysFragments       = 0x0020
+	flagDuplicates            = 0x0040
+	flagExportable            = 0x0080
+	flagUncompressedXattrs    = 0x0100
+	flagNoXattrs              = 0x0200
+	flagCompressorOptions     = 0x0400
+	flagUncompressedIDs       = 0x0800
+)
+
+// Inode types, extended variants carry xattrs, link counts and 64bit sizes
+const (
+	typeDir = iota + 1
+	typeFile
+	typeSymlink
+	typeBlock
+	typeChar
+	typeFifo
+	typeSocket
+	typeExtDir
+	typeExtFile
+	typeExtSymlink
+	typeExtBlock
+	typeExtChar
+	typeExtFifo
+	typeExtSocket
+)
+
+// Compression identifies the compressor used for data and metadata blocks.
+type Compression uint16
+
+const (
+	Gzip Compression = iota + 1
+	Lzma
+	Lzo
+	Xz
+	Lz4
+	Zstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Gzip:
+		return "gzip"
+	case Lzma:
+		return "lzma"
+	case Lzo:
+		return "lzo"
+	case Xz:
+		return "xz"
+	case Lz4:
+		return "lz4"
+	case Zstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown(%d)", uint16(c))
+}
+
+// ParseCompression maps a mksquashfs compressor name to its Compression.
+func ParseCompression(name string) (Compression, error) {
+	for c := Gzip; c <= Zstd; c++ {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compressor %q", name)
+}
+
+type superblock struct {
+	Magic             uint32
+	InodeCount        uint32
+	ModTime           uint32
+	BlockSize         uint32
+	FragCount         uint32
+	Compression       Compression
+	BlockLog          uint16
+	Flags             uint16
+	IDCount           uint16
+	VersionMajor      uint16
+	VersionMinor      uint16
+	RootInode         uint64
+	BytesUsed         uint64
+	IDTableStart      uint64
+	XattrIDTableStart uint64
+	InodeTableStart   uint64
+	DirTableStart     uint64
+	FragTableStart    uint64
+	ExportTableStart  uint64
+}
+
+func (sb *superblock) validate() error {
+	if sb.Magic != magic {
+		return fmt.Errorf("not a squashfs image (magic %#x)", sb.Magic)
+	}
+	if sb.VersionMajor != 4 || sb.VersionMinor != 0 {
+		return fmt.Errorf("unsupported squashfs version %d.%d", sb.VersionMajor, sb.VersionMinor)
+	}
+	if sb.BlockSize < 4096 || sb.BlockSize > 1<<20 || sb.BlockSize != 1<<sb.BlockLog {
+		return fmt.Errorf("invalid block size %d", sb.BlockSize)
+	}
+	return nil
+}
+
+type inodeHeader struct {
+	Type     uint16
+	Perm     uint16
+	UIDIndex uint16
+	GIDIndex uint16
+	ModTime  uint32
+	Number   uint32
+}
+
+type dirHeader struct {
+	Count  uint32 // entries - 1
+	Start  uint32 // inode metadata block, relative to the inode table
+	Number uint32 // base inode number for the entries
+}
+
+type dirEntry struct {
+	Offset   uint16
+	NumDelta int16
+	Type     uint16
+	NameSize uint16 // len(name) - 1
+}
+
+type fragmentEntry struct {
+	Start  uint64
+	Size   uint32
+	Unused uint32
+}
+
+type xattrIDEntry struct {
+	Ref   uint64
+	Count uint32
+	Size  uint32
+}
+
+type xattrTableHeader struct {
+	TableStart uint64
+	IDs        uint32
+	Unused     uint32
+}
+
+var order = binary.LittleEndian
+
+// Prefixes of the xattr namespaces squashfs can store, indexed by type
+var xattrPrefixes = []string{"user.", "trusted.", "security."}
+
+// basicType maps extended inode types to their basic counterpart as used in directory entries.
+func basicType(t uint16) uint16 {
+	if t >= typeExtDir {
+		return t - 7
+	}
+	return t
+}
+
+// fileMode converts a squashfs inode type and permission field to an fs.FileMode.
+func fileMode(t, perm uint16) fs.FileMode {
+	m := fs.FileMode(perm & 0777)
+	if perm&04000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if perm&02000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if perm&01000 != 0 {
+		m |= fs.ModeSticky
+	}
+	switch basicType(t) {
+	case typeDir:
+		m |= fs.ModeDir
+	case typeSymlink:
+		m |= fs.ModeSymlink
+	case typeBlock:
+		m |= fs.ModeDevice
+	case typeChar:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case typeFifo:
+		m |= fs.ModeNamedPipe
+	case typeSocket:
+		m |= fs.ModeSocket
+	}
+	return m
+}
+
+// permBits converts the permission part of an fs.FileMode back to squashfs bits.
+func permBits(m fs.FileMode) uint16 {
+	p := uint16(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		p |= 04000
+	}
+	if m&fs.ModeSetgid != 0 {
+		p |= 02000
+	}
+	if m&fs.ModeSticky != 0 {
+		p |= 01000
+	}
+	return p
+}
+
+// Device numbers are stored in the kernel's new_encode_dev layout.
+func decodeDev(d uint32) (major, minor uint32) {
+	return (d & 0xfff00) >> 8, (d & 0xff) | ((d >> 12) & 0xfff00)
+}
+
+func encodeDev(major, minor uint32) uint32 {
+	return (minor & 0xff) | (major << 8) | ((minor &^ 0xff) << 12)
+}
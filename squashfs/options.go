@@ -0,0 +1,123 @@
+package squashfs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ParseMksquashfsArgs translates mksquashfs command line options into writer
+// Options, so the same --mksquashfs-opts work with both builders. It returns
+// the paths given to -e or listed in -ef files, relative to the source directory.
+// Options that only affect the mksquashfs user interface are ignored.
+func ParseMksquashfsArgs(args []string) (Options, []string, error) {
+	var opts Options
+	var excludes []string
+
+	next := func(i *int) (string, error) {
+		if *i+1 >= len(args) {
+			return "", fmt.Errorf("%s requires an argument", args[*i])
+		}
+		*i++
+		return args[*i], nil
+	}
+
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; arg {
+		case "-comp":
+			v, err := next(&i)
+			if err != nil {
+				return opts, nil, err
+			}
+			if opts.Compression, err = ParseCompression(v); err != nil {
+				return opts, nil, err
+			}
+		case "-Xcompression-level":
+			v, err := next(&i)
+			if err != nil {
+				return opts, nil, err
+			}
+			if opts.Level, err = strconv.Atoi(v); err != nil {
+				return opts, nil, fmt.Errorf("invalid compression level %q", v)
+			}
+		case "-b":
+			v, err := next(&i)
+			if err != nil {
+				return opts, nil, err
+			}
+			if opts.BlockSize, err = parseBlockSize(v); err != nil {
+				return opts, nil, err
+			}
+		case "-e":
+			// every following argument up to the next option is an exclude
+			for i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				excludes = append(excludes, args[i])
+			}
+		case "-ef":
+			v, err := next(&i)
+			if err != nil {
+				return opts, nil, err
+			}
+			paths, err := ReadExcludeFile(v)
+			if err != nil {
+				return opts, nil, err
+			}
+			excludes = append(excludes, paths...)
+		case "-no-xattrs":
+			opts.NoXattrs = true
+		case "-xattrs":
+			opts.NoXattrs = false
+		case "-no-fragments":
+			opts.NoFragments = true
+		case "-noI", "-noInodeCompression":
+			opts.NoCompressInodes = true
+		case "-noD", "-noDataCompression":
+			opts.NoCompressData = true
+		case "-noF", "-noFragmentCompression":
+			opts.NoCompressFragments = true
+		case "-noappend", "-no-duplicates", "-noX", "-noXattrCompression",
+			"-no-progress", "-progress", "-percentage", "-quiet", "-info", "-no-exports":
+		case "-processors", "-mem":
+			if _, err := next(&i); err != nil {
+				return opts, nil, err
+			}
+		default:
+			return opts, nil, fmt.Errorf("mksquashfs option %q is not supported by the builtin builder", arg)
+		}
+	}
+	return opts, excludes, nil
+}
+
+// ReadExcludeFile reads the paths of an mksquashfs -ef file, one per line
+func ReadExcludeFile(name string) ([]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("exclude file: %w", err)
+	}
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, nil
+}
+
+// parseBlockSize accepts sizes in bytes or with a K or M suffix, as mksquashfs does
+func parseBlockSize(v string) (uint32, error) {
+	mult := uint64(1)
+	num := v
+	switch {
+	case strings.HasSuffix(v, "K"), strings.HasSuffix(v, "k"):
+		mult, num = 1<<10, v[:len(v)-1]
+	case strings.HasSuffix(v, "M"), strings.HasSuffix(v, "m"):
+		mult, num = 1<<20, v[:len(v)-1]
+	}
+	n, err := strconv.ParseUint(num, 10, 32)
+	if err != nil || n*mult > 1<<20 {
+		return 0, fmt.Errorf("invalid block size %q", v)
+	}
+	return uint32(n * mult), nil
+}
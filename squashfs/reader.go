@@ -0,0 +1,595 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reader gives access to the file tree stored in a squashfs image.
+type Reader struct {
+	r     io.ReaderAt
+	sb    superblock
+	dec   decompressor
+	ids   []uint32
+	frags []fragmentEntry
+
+	xattrStart uint64
+	xattrIDs   []xattrIDEntry
+
+	mu    sync.Mutex
+	cache map[int64]metaBlock
+}
+
+type metaBlock struct {
+	data []byte
+	next int64 // absolute position of the following block
+}
+
+// Entry describes a single file, directory or special file in the image.
+type Entry struct {
+	Path    string // absolute path within the image, "/" for the root
+	Mode    fs.FileMode
+	UID     uint32
+	GID     uint32
+	ModTime time.Time
+	Size    int64
+	Target  string // symlink target
+	Major   uint32 // device numbers for block and char devices
+	Minor   uint32
+	Nlink   uint32
+	Inode   uint32
+	Xattrs  map[string][]byte
+
+	ino *inode
+}
+
+type inode struct {
+	hdr        inodeHeader
+	nlink      uint32
+	size       uint64
+	blockStart uint64
+	blockSizes []uint32
+	fragIndex  uint32
+	fragOffset uint32
+	dirBlock   uint32
+	dirOffset  uint16
+	target     string
+	dev        uint32
+	xattr      uint32
+}
+
+// Open reads the superblock and lookup tables of the image behind r.
+func Open(r io.ReaderAt) (*Reader, error) {
+	sr := &Reader{r: r, cache: map[int64]metaBlock{}, xattrStart: noTable}
+	raw := make([]byte, superSize)
+	if _, err := r.ReadAt(raw, 0); err != nil {
+		return nil, fmt.Errorf("read superblock: %w", err)
+	}
+	if err := binary.Read(bytes.NewReader(raw), order, &sr.sb); err != nil {
+		return nil, err
+	}
+	if err := sr.sb.validate(); err != nil {
+		return nil, err
+	}
+	dec, err := newDecompressor(sr.sb.Compression)
+	if err != nil {
+		return nil, err
+	}
+	sr.dec = dec
+
+	if err := sr.readIDs(); err != nil {
+		return nil, fmt.Errorf("read id table: %w", err)
+	}
+	if err := sr.readFragments(); err != nil {
+		return nil, fmt.Errorf("read fragment table: %w", err)
+	}
+	if err := sr.readXattrIDs(); err != nil {
+		return nil, fmt.Errorf("read xattr table: %w", err)
+	}
+	return sr, nil
+}
+
+// Compression returns the compressor the image was built with.
+func (r *Reader) Compression() Compression { return r.sb.Compression }
+
+// BlockSize returns the data block size of the image.
+func (r *Reader) BlockSize() uint32 { return r.sb.BlockSize }
+
+// BytesUsed returns the size of the image without trailing padding.
+func (r *Reader) BytesUsed() uint64 { return r.sb.BytesUsed }
+
+// HasXattrs reports whether the image carries an xattr table.
+func (r *Reader) HasXattrs() bool {
+	return r.sb.Flags&flagNoXattrs == 0 && r.sb.XattrIDTableStart != noTable
+}
+
+// WalkFunc is called for every entry in lexical order, parents before children.
+// Returning fs.SkipDir from a directory entry skips its children.
+type WalkFunc func(e *Entry) error
+
+// Walk visits the whole tree starting from the root directory.
+func (r *Reader) Walk(fn WalkFunc) error {
+	root, err := r.readInode(r.sb.RootInode)
+	if err != nil {
+		return fmt.Errorf("read root inode: %w", err)
+	}
+	return r.walk("/", root, fn)
+}
+
+func (r *Reader) walk(p string, ino *inode, fn WalkFunc) error {
+	e, err := r.entry(p, ino)
+	if err != nil {
+		return err
+	}
+	if err := fn(e); err != nil {
+		if errors.Is(err, fs.SkipDir) && e.Mode.IsDir() {
+			return nil
+		}
+		return err
+	}
+	if !e.Mode.IsDir() {
+		return nil
+	}
+	children, err := r.readDir(ino)
+	if err != nil {
+		return fmt.Errorf("read directory %s: %w", p, err)
+	}
+	for _, c := range children {
+		child, err := r.readInode(c.ref)
+		if err != nil {
+			return fmt.Errorf("read inode of %s: %w", path.Join(p, c.name), err)
+		}
+		if err := r.walk(path.Join(p, c.name), child, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Reader) entry(p string, ino *inode) (*Entry, error) {
+	e := &Entry{
+		Path:    p,
+		Mode:    fileMode(ino.hdr.Type, ino.hdr.Perm),
+		ModTime: time.Unix(int64(ino.hdr.ModTime), 0),
+		Size:    int64(ino.size),
+		Target:  ino.target,
+		Nlink:   ino.nlink,
+		Inode:   ino.hdr.Number,
+		ino:     ino,
+	}
+	var err error
+	if e.UID, err = r.id(ino.hdr.UIDIndex); err != nil {
+		return nil, err
+	}
+	if e.GID, err = r.id(ino.hdr.GIDIndex); err != nil {
+		return nil, err
+	}
+	if e.Mode&fs.ModeDevice != 0 {
+		e.Major, e.Minor = decodeDev(ino.dev)
+	}
+	if e.Mode.IsDir() {
+		e.Size = 0
+	}
+	if ino.xattr != noXattr {
+		if e.Xattrs, err = r.readXattrs(ino.xattr); err != nil {
+			return nil, fmt.Errorf("xattrs of %s: %w", p, err)
+		}
+	}
+	return e, nil
+}
+
+func (r *Reader) id(idx uint16) (uint32, error) {
+	if int(idx) >= len(r.ids) {
+		return 0, fmt.Errorf("id index %d out of range", idx)
+	}
+	return r.ids[idx], nil
+}
+
+// Open returns the content of a regular file entry.
+func (r *Reader) Open(e *Entry) (io.Reader, error) {
+	if !e.Mode.IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", e.Path)
+	}
+	return &fileReader{r: r, ino: e.ino, pos: int64(e.ino.blockStart)}, nil
+}
+
+// metadata handling
+
+func (r *Reader) readMetaBlock(pos int64) (metaBlock, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b, ok := r.cache[pos]; ok {
+		return b, nil
+	}
+	var hdr [2]byte
+	if _, err := r.r.ReadAt(hdr[:], pos); err != nil {
+		return metaBlock{}, fmt.Errorf("metadata header at %d: %w", pos, err)
+	}
+	h := order.Uint16(hdr[:])
+	size := int(h &^ metaUncomp)
+	raw := make([]byte, size)
+	if _, err := r.r.ReadAt(raw, pos+2); err != nil {
+		return metaBlock{}, fmt.Errorf("metadata block at %d: %w", pos, err)
+	}
+	data := raw
+	if h&metaUncomp == 0 {
+		var err error
+		if data, err = r.dec.decompress(raw, metaSize); err != nil {
+			return metaBlock{}, fmt.Errorf("metadata block at %d: %w", pos, err)
+		}
+	}
+	b := metaBlock{data: data, next: pos + 2 + int64(size)}
+	r.cache[pos] = b
+	return b, nil
+}
+
+// metaReader reads a metadata stream across block boundaries.
+type metaReader struct {
+	r   *Reader
+	b   metaBlock
+	off int
+}
+
+func (r *Reader) metaAt(block int64, offset int) (*metaReader, error) {
+	b, err := r.readMetaBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	if offset > len(b.data) {
+		return nil, fmt.Errorf("metadata offset %d beyond block of %d bytes", offset, len(b.data))
+	}
+	return &metaReader{r: r, b: b, off: offset}, nil
+}
+
+func (m *metaReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if m.off >= len(m.b.data) {
+			b, err := m.r.readMetaBlock(m.b.next)
+			if err != nil {
+				return n, err
+			}
+			m.b, m.off = b, 0
+		}
+		c := copy(p[n:], m.b.data[m.off:])
+		m.off += c
+		n += c
+	}
+	return n, nil
+}
+
+func (m *metaReader) read(v any) error {
+	return binary.Read(m, order, v)
+}
+
+// readTable loads count fixed-size entries stored behind a list of metadata block pointers.
+func (r *Reader) readTable(start uint64, count, entrySize int, v any) error {
+	if count == 0 {
+		return nil
+	}
+	blocks := (count*entrySize + metaSize - 1) / metaSize
+	ptrs := make([]uint64, blocks)
+	raw := make([]byte, blocks*8)
+	if _, err := r.r.ReadAt(raw, int64(start)); err != nil {
+		return err
+	}
+	if err := binary.Read(bytes.NewReader(raw), order, ptrs); err != nil {
+		return err
+	}
+	m, err := r.metaAt(int64(ptrs[0]), 0)
+	if err != nil {
+		return err
+	}
+	return m.read(v)
+}
+
+func (r *Reader) readIDs() error {
+	r.ids = make([]uint32, r.sb.IDCount)
+	return r.readTable(r.sb.IDTableStart, len(r.ids), 4, r.ids)
+}
+
+func (r *Reader) readFragments() error {
+	if r.sb.FragCount == 0 || r.sb.FragTableStart == noTable {
+		return nil
+	}
+	r.frags = make([]fragmentEntry, r.sb.FragCount)
+	return r.readTable(r.sb.FragTableStart, len(r.frags), fragEntrySz, r.frags)
+}
+
+func (r *Reader) readXattrIDs() error {
+	if !r.HasXattrs() {
+		return nil
+	}
+	raw := make([]byte, 16)
+	if _, err := r.r.ReadAt(raw, int64(r.sb.XattrIDTableStart)); err != nil {
+		return err
+	}
+	var hdr xattrTableHeader
+	if err := binary.Read(bytes.NewReader(raw), order, &hdr); err != nil {
+		return err
+	}
+	r.xattrStart = hdr.TableStart
+	r.xattrIDs = make([]xattrIDEntry, hdr.IDs)
+	return r.readTable(r.sb.XattrIDTableStart+16, len(r.xattrIDs), xattrIDSz, r.xattrIDs)
+}
+
+func (r *Reader) readXattrs(idx uint32) (map[string][]byte, error) {
+	if int(idx) >= len(r.xattrIDs) {
+		return nil, fmt.Errorf("xattr index %d out of range", idx)
+	}
+	id := r.xattrIDs[idx]
+	m, err := r.metaAt(int64(r.xattrStart+id.Ref>>16), int(id.Ref&0xffff))
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte, id.Count)
+	for i := uint32(0); i < id.Count; i++ {
+		var kh struct{ Type, Size uint16 }
+		if err := m.read(&kh); err != nil {
+			return nil, err
+		}
+		name := make([]byte, kh.Size)
+		if err := m.read(name); err != nil {
+			return nil, err
+		}
+		t := int(kh.Type & xattrTypeMsk)
+		if t >= len(xattrPrefixes) {
+			return nil, fmt.Errorf("unknown xattr type %d", t)
+		}
+		value, err := r.readXattrValue(m, kh.Type&xattrOOL != 0)
+		if err != nil {
+			return nil, err
+		}
+		out[xattrPrefixes[t]+string(name)] = value
+	}
+	return out, nil
+}
+
+func (r *Reader) readXattrValue(m *metaReader, outOfLine bool) ([]byte, error) {
+	var size uint32
+	if err := m.read(&size); err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	if err := m.read(value); err != nil {
+		return nil, err
+	}
+	if !outOfLine {
+		return value, nil
+	}
+	ref := order.Uint64(value)
+	ool, err := r.metaAt(int64(r.xattrStart+ref>>16), int(ref&0xffff))
+	if err != nil {
+		return nil, err
+	}
+	return r.readXattrValue(ool, false)
+}
+
+func (r *Reader) readInode(ref uint64) (*inode, error) {
+	m, err := r.metaAt(int64(r.sb.InodeTableStart+ref>>16), int(ref&0xffff))
+	if err != nil {
+		return nil, err
+	}
+	ino := &inode{fragIndex: noFragment, xattr: noXattr, nlink: 1}
+	if err := m.read(&ino.hdr); err != nil {
+		return nil, err
+	}
+
+	switch ino.hdr.Type {
+	case typeDir:
+		var d struct {
+			Block  uint32
+			Nlink  uint32
+			Size   uint16
+			Offset uint16
+			Parent uint32
+		}
+		err = m.read(&d)
+		ino.dirBlock, ino.nlink, ino.size, ino.dirOffset = d.Block, d.Nlink, uint64(d.Size), d.Offset
+	case typeExtDir:
+		var d struct {
+			Nlink      uint32
+			Size       uint32
+			Block      uint32
+			Parent     uint32
+			IndexCount uint16
+			Offset     uint16
+			Xattr      uint32
+		}
+		err = m.read(&d)
+		ino.dirBlock, ino.nlink, ino.size, ino.dirOffset, ino.xattr = d.Block, d.Nlink, uint64(d.Size), d.Offset, d.Xattr
+	case typeFile:
+		var f struct {
+			Start      uint32
+			FragIndex  uint32
+			FragOffset uint32
+			Size       uint32
+		}
+		if err = m.read(&f); err == nil {
+			ino.blockStart, ino.fragIndex, ino.fragOffset, ino.size = uint64(f.Start), f.FragIndex, f.FragOffset, uint64(f.Size)
+			err = r.readBlockSizes(m, ino)
+		}
+	case typeExtFile:
+		var f struct {
+			Start      uint64
+			Size       uint64
+			Sparse     uint64
+			Nlink      uint32
+			FragIndex  uint32
+			FragOffset uint32
+			Xattr      uint32
+		}
+		if err = m.read(&f); err == nil {
+			ino.blockStart, ino.size, ino.nlink = f.Start, f.Size, f.Nlink
+			ino.fragIndex, ino.fragOffset, ino.xattr = f.FragIndex, f.FragOffset, f.Xattr
+			err = r.readBlockSizes(m, ino)
+		}
+	case typeSymlink, typeExtSymlink:
+		var s struct{ Nlink, Size uint32 }
+		if err = m.read(&s); err == nil {
+			target := make([]byte, s.Size)
+			err = m.read(target)
+			ino.nlink, ino.target, ino.size = s.Nlink, string(target), uint64(s.Size)
+		}
+		if err == nil && ino.hdr.Type == typeExtSymlink {
+			err = m.read(&ino.xattr)
+		}
+	case typeBlock, typeChar, typeExtBlock, typeExtChar:
+		var d struct{ Nlink, Dev uint32 }
+		err = m.read(&d)
+		ino.nlink, ino.dev = d.Nlink, d.Dev
+		if err == nil && ino.hdr.Type >= typeExtDir {
+			err = m.read(&ino.xattr)
+		}
+	case typeFifo, typeSocket, typeExtFifo, typeExtSocket:
+		err = m.read(&ino.nlink)
+		if err == nil && ino.hdr.Type >= typeExtDir {
+			err = m.read(&ino.xattr)
+		}
+	default:
+		return nil, fmt.Errorf("unknown inode type %d", ino.hdr.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("inode %d: %w", ino.hdr.Number, err)
+	}
+	return ino, nil
+}
+
+func (r *Reader) readBlockSizes(m *metaReader, ino *inode) error {
+	bs := uint64(r.sb.BlockSize)
+	n := ino.size / bs
+	if ino.fragIndex == noFragment && ino.size%bs != 0 {
+		n++
+	}
+	ino.blockSizes = make([]uint32, n)
+	return m.read(ino.blockSizes)
+}
+
+type dirChild struct {
+	name string
+	ref  uint64
+}
+
+func (r *Reader) readDir(ino *inode) ([]dirChild, error) {
+	// file size counts the implicit "." and ".." entries
+	if ino.size <= 3 {
+		return nil, nil
+	}
+	m, err := r.metaAt(int64(r.sb.DirTableStart)+int64(ino.dirBlock), int(ino.dirOffset))
+	if err != nil {
+		return nil, err
+	}
+	listing := make([]byte, ino.size-3)
+	if err := m.read(listing); err != nil {
+		return nil, err
+	}
+	lr := bytes.NewReader(listing)
+	var out []dirChild
+	for lr.Len() > 0 {
+		var h dirHeader
+		if err := binary.Read(lr, order, &h); err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i <= h.Count; i++ {
+			var de dirEntry
+			if err := binary.Read(lr, order, &de); err != nil {
+				return nil, err
+			}
+			name := make([]byte, int(de.NameSize)+1)
+			if _, err := io.ReadFull(lr, name); err != nil {
+				return nil, err
+			}
+			out = append(out, dirChild{name: string(name), ref: uint64(h.Start)<<16 | uint64(de.Offset)})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out, nil
+}
+
+// file data handling
+
+type fileReader struct {
+	r     *Reader
+	ino   *inode
+	block int   // next entry in blockSizes
+	pos   int64 // position of the next data block in the image
+	done  int64 // bytes of the file handed out so far
+	buf   []byte
+}
+
+func (f *fileReader) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		if f.done >= int64(f.ino.size) {
+			return 0, io.EOF
+		}
+		if err := f.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+}
+
+func (f *fileReader) fill() error {
+	bs := int64(f.r.sb.BlockSize)
+	want := int64(f.ino.size) - f.done
+	if want > bs {
+		want = bs
+	}
+
+	if f.block < len(f.ino.blockSizes) {
+		size := f.ino.blockSizes[f.block]
+		f.block++
+		if size == 0 {
+			// sparse block
+			f.buf = make([]byte, want)
+		} else {
+			data, err := f.r.readData(int64(f.pos), size, int(bs))
+			if err != nil {
+				return err
+			}
+			f.pos += int64(size &^ dataUncomp)
+			f.buf = data
+		}
+	} else {
+		if f.ino.fragIndex == noFragment || int(f.ino.fragIndex) >= len(f.r.frags) {
+			return fmt.Errorf("inode %d: missing data", f.ino.hdr.Number)
+		}
+		frag := f.r.frags[f.ino.fragIndex]
+		data, err := f.r.readData(int64(frag.Start), frag.Size, int(bs))
+		if err != nil {
+			return err
+		}
+		end := int64(f.ino.fragOffset) + want
+		if end > int64(len(data)) {
+			return fmt.Errorf("inode %d: fragment too short", f.ino.hdr.Number)
+		}
+		f.buf = data[f.ino.fragOffset:end]
+	}
+	if int64(len(f.buf)) < want {
+		return fmt.Errorf("inode %d: short data block", f.ino.hdr.Number)
+	}
+	f.buf = f.buf[:want]
+	f.done += want
+	return nil
+}
+
+func (r *Reader) readData(pos int64, size uint32, max int) ([]byte, error) {
+	raw := make([]byte, size&^dataUncomp)
+	if _, err := r.r.ReadAt(raw, pos); err != nil {
+		return nil, fmt.Errorf("data block at %d: %w", pos, err)
+	}
+	if size&dataUncomp != 0 {
+		return raw, nil
+	}
+	return r.dec.decompress(raw, max)
+}
@@ -0,0 +1,97 @@
+package squashfs
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Node is a file, directory or special file of the tree handed to Writer.Finish.
+// Hard links are expressed by adding the same Node under several names.
+type Node struct {
+	Mode    fs.FileMode
+	UID     uint32
+	GID     uint32
+	ModTime time.Time
+	Xattrs  map[string][]byte
+	Target  string // symlink target
+	Major   uint32 // device numbers for block and char devices
+	Minor   uint32
+	Data    *FileData // content of regular files, as returned by Writer.WriteFile
+
+	children map[string]*Node
+}
+
+// NewDir returns an empty directory node.
+func NewDir(perm fs.FileMode, uid, gid uint32, mtime time.Time) *Node {
+	return &Node{
+		Mode:     fs.ModeDir | perm,
+		UID:      uid,
+		GID:      gid,
+		ModTime:  mtime,
+		children: map[string]*Node{},
+	}
+}
+
+// Children returns the sorted names of the entries of a directory node.
+func (n *Node) Children() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Child returns the named entry of a directory node, or nil.
+func (n *Node) Child(name string) *Node {
+	return n.children[name]
+}
+
+// SetChild adds or replaces an entry of a directory node.
+func (n *Node) SetChild(name string, child *Node) error {
+	if !n.Mode.IsDir() {
+		return fmt.Errorf("cannot add %q to a non-directory", name)
+	}
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid entry name %q", name)
+	}
+	if child.Mode.IsDir() && child.children == nil {
+		child.children = map[string]*Node{}
+	}
+	n.children[name] = child
+	return nil
+}
+
+// RemoveChild drops an entry of a directory node.
+func (n *Node) RemoveChild(name string) {
+	delete(n.children, name)
+}
+
+// ClearChildren drops all entries of a directory node.
+func (n *Node) ClearChildren() {
+	n.children = map[string]*Node{}
+}
+
+// Lookup resolves a slash separated path relative to n without following symlinks.
+func (n *Node) Lookup(p string) *Node {
+	cur := n
+	for _, part := range splitPath(p) {
+		if cur == nil || !cur.Mode.IsDir() {
+			return nil
+		}
+		cur = cur.children[part]
+	}
+	return cur
+}
+
+func splitPath(p string) []string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
@@ -0,0 +1,730 @@
+package squashfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultBlockSize is the data block size used by mksquashfs.
+const DefaultBlockSize = 128 * 1024
+
+// Options control how a Writer lays out the image. The zero value matches the mksquashfs defaults.
+type Options struct {
+	Compression         Compression // gzip when unset
+	Level               int         // compressor level, 0 selects the compressor default
+	BlockSize           uint32      // DefaultBlockSize when unset
+	NoXattrs            bool
+	NoFragments         bool
+	NoCompressData      bool
+	NoCompressInodes    bool
+	NoCompressFragments bool
+	ModTime             time.Time // recorded in the superblock, defaults to now
+}
+
+// FileData locates the content of a regular file written with Writer.WriteFile.
+type FileData struct {
+	size       uint64
+	start      uint64
+	blocks     []uint32
+	sparse     uint64
+	fragIndex  uint32
+	fragOffset uint32
+}
+
+// Size returns the length of the file content.
+func (d *FileData) Size() int64 { return int64(d.size) }
+
+// Writer builds a squashfs image. File contents are streamed with WriteFile,
+// the directory tree referencing them is written by Finish.
+type Writer struct {
+	out  *bufio.Writer
+	ws   io.WriteSeeker
+	pos  uint64
+	opts Options
+	comp compressor
+	sb   superblock
+	buf  []byte
+
+	frag  []byte
+	frags []fragmentEntry
+
+	ids    []uint32
+	idIdx  map[uint32]uint16
+	xattrs map[string]uint32
+	xkv    *metaWriter
+	xids   []xattrIDEntry
+
+	inodes  *metaWriter
+	dirs    *metaWriter
+	count   uint32
+	numbers map[*Node]uint32
+	refs    map[*Node]uint64
+	types   map[*Node]uint16
+	nlinks  map[*Node]uint32
+}
+
+// NewWriter starts an image on ws, which must be positioned at the start of the image.
+func NewWriter(ws io.WriteSeeker, opts Options) (*Writer, error) {
+	if opts.Compression == 0 {
+		opts.Compression = Gzip
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = DefaultBlockSize
+	}
+	if opts.BlockSize < 4096 || opts.BlockSize > 1<<20 || opts.BlockSize&(opts.BlockSize-1) != 0 {
+		return nil, fmt.Errorf("block size %d must be a power of two between 4K and 1M", opts.BlockSize)
+	}
+	if opts.ModTime.IsZero() {
+		opts.ModTime = time.Now()
+	}
+	comp, err := newCompressor(opts.Compression, opts.Level, opts.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		out:     bufio.NewWriterSize(ws, 1<<20),
+		ws:      ws,
+		opts:    opts,
+		comp:    comp,
+		buf:     make([]byte, opts.BlockSize),
+		idIdx:   map[uint32]uint16{},
+		xattrs:  map[string]uint32{},
+		xkv:     &metaWriter{comp: comp},
+		inodes:  &metaWriter{comp: comp, raw: opts.NoCompressInodes},
+		dirs:    &metaWriter{comp: comp, raw: opts.NoCompressInodes},
+		numbers: map[*Node]uint32{},
+		refs:    map[*Node]uint64{},
+		types:   map[*Node]uint16{},
+		nlinks:  map[*Node]uint32{},
+	}
+	w.sb = superblock{
+		Magic:        magic,
+		ModTime:      unixTime(opts.ModTime),
+		BlockSize:    opts.BlockSize,
+		Compression:  opts.Compression,
+		VersionMajor: 4,
+		VersionMinor: 0,
+		// duplicate detection is not done, but readers treat the flag as informational
+		Flags: flagDuplicates,
+	}
+	for bs := opts.BlockSize; bs > 1; bs >>= 1 {
+		w.sb.BlockLog++
+	}
+	if opts.NoCompressInodes {
+		w.sb.Flags |= flagUncompressedInodes
+	}
+	if opts.NoCompressData {
+		w.sb.Flags |= flagUncompressedData
+	}
+	if opts.NoCompressFragments {
+		w.sb.Flags |= flagUncompressedFragments
+	}
+	if opts.NoFragments {
+		w.sb.Flags |= flagNoFragments
+	}
+	if opts.NoXattrs {
+		w.sb.Flags |= flagNoXattrs
+	}
+
+	// the superblock is written last, once all table positions are known, which
+	// is also why a checksum of the image can only be taken once it is finished
+	if err := w.write(make([]byte, superSize)); err != nil {
+		return nil, err
+	}
+	if copts := comp.options(); copts != nil {
+		w.sb.Flags |= flagCompressorOptions
+		if err := w.write(metaHeader(len(copts), true)); err != nil {
+			return nil, err
+		}
+		if err := w.write(copts); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *Writer) write(p []byte) error {
+	n, err := w.out.Write(p)
+	w.pos += uint64(n)
+	return err
+}
+
+// WriteFile stores the content of a regular file. The returned FileData is
+// attached to the Node of every name the file is reachable under.
+func (w *Writer) WriteFile(r io.Reader) (*FileData, error) {
+	d := &FileData{start: w.pos, fragIndex: noFragment}
+	bs := int(w.opts.BlockSize)
+	for {
+		n, err := io.ReadFull(r, w.buf)
+		if n > 0 {
+			d.size += uint64(n)
+			if n < bs && !w.opts.NoFragments {
+				if ferr := w.addFragment(d, w.buf[:n]); ferr != nil {
+					return nil, ferr
+				}
+			} else {
+				size, werr := w.writeBlock(w.buf[:n], w.opts.NoCompressData, true)
+				if werr != nil {
+					return nil, werr
+				}
+				if size == 0 {
+					d.sparse += uint64(n)
+				}
+				d.blocks = append(d.blocks, size)
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return d, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// writeBlock stores a data block and returns its on-disk size field.
+// Blocks of zeros are not stored at all when sparse is allowed.
+func (w *Writer) writeBlock(data []byte, raw, sparse bool) (uint32, error) {
+	if sparse && allZero(data) {
+		return 0, nil
+	}
+	if !raw {
+		c, err := w.comp.compress(data)
+		if err != nil {
+			return 0, err
+		}
+		if len(c) < len(data) {
+			return uint32(len(c)), w.write(c)
+		}
+	}
+	return uint32(len(data)) | dataUncomp, w.write(data)
+}
+
+func (w *Writer) addFragment(d *FileData, tail []byte) error {
+	if len(w.frag)+len(tail) > int(w.opts.BlockSize) {
+		if err := w.flushFragment(); err != nil {
+			return err
+		}
+	}
+	d.fragIndex = uint32(len(w.frags))
+	d.fragOffset = uint32(len(w.frag))
+	w.frag = append(w.frag, tail...)
+	return nil
+}
+
+func (w *Writer) flushFragment() error {
+	if len(w.frag) == 0 {
+		return nil
+	}
+	start := w.pos
+	size, err := w.writeBlock(w.frag, w.opts.NoCompressFragments, false)
+	if err != nil {
+		return err
+	}
+	w.frags = append(w.frags, fragmentEntry{Start: start, Size: size})
+	w.frag = w.frag[:0]
+	return nil
+}
+
+// Finish writes the inodes and directories of the tree below root followed by
+// the lookup tables and the superblock. The Writer must not be used afterwards.
+func (w *Writer) Finish(root *Node) error {
+	if root == nil || !root.Mode.IsDir() {
+		return fmt.Errorf("root of the image must be a directory")
+	}
+	if err := w.flushFragment(); err != nil {
+		return err
+	}
+
+	if err := w.countLinks(root, map[*Node]bool{}); err != nil {
+		return err
+	}
+	w.number(root)
+	if err := w.writeDir(root, w.count+1); err != nil {
+		return err
+	}
+	w.sb.RootInode = w.refs[root]
+	w.sb.InodeCount = w.count
+
+	inodes, err := w.inodes.finish()
+	if err != nil {
+		return err
+	}
+	dirs, err := w.dirs.finish()
+	if err != nil {
+		return err
+	}
+	w.sb.InodeTableStart = w.pos
+	if err := w.write(inodes); err != nil {
+		return err
+	}
+	w.sb.DirTableStart = w.pos
+	if err := w.write(dirs); err != nil {
+		return err
+	}
+
+	// the kernel expects the tables in this order and derives their lengths from the next one
+	w.sb.FragCount = uint32(len(w.frags))
+	if w.sb.FragTableStart, err = w.writeTable(w.frags); err != nil {
+		return err
+	}
+	w.sb.ExportTableStart = noTable
+	w.sb.IDCount = uint16(len(w.ids))
+	if w.sb.IDTableStart, err = w.writeTable(w.ids); err != nil {
+		return err
+	}
+	if w.sb.XattrIDTableStart, err = w.writeXattrTables(); err != nil {
+		return err
+	}
+	w.sb.BytesUsed = w.pos
+
+	// images are padded to 4K so they can be used as loop devices
+	if pad := w.pos % 4096; pad != 0 {
+		if err := w.write(make([]byte, 4096-pad)); err != nil {
+			return err
+		}
+	}
+	if err := w.out.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.ws.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return binary.Write(w.ws, order, &w.sb)
+}
+
+// countLinks computes link counts: directories have one per subdirectory plus
+// two, other nodes one per name they appear under.
+func (w *Writer) countLinks(dir *Node, seen map[*Node]bool) error {
+	if seen[dir] {
+		return fmt.Errorf("directory linked more than once")
+	}
+	seen[dir] = true
+	w.nlinks[dir] = 2
+	for _, c := range dir.children {
+		if c.Mode.IsDir() {
+			w.nlinks[dir]++
+			if err := w.countLinks(c, seen); err != nil {
+				return err
+			}
+		} else {
+			w.nlinks[c]++
+		}
+	}
+	return nil
+}
+
+// number assigns inode numbers in the order the inodes are written, children before their directory.
+func (w *Writer) number(dir *Node) {
+	for _, name := range dir.Children() {
+		c := dir.children[name]
+		if c.Mode.IsDir() {
+			w.number(c)
+		} else if w.numbers[c] == 0 {
+			w.count++
+			w.numbers[c] = w.count
+		}
+	}
+	w.count++
+	w.numbers[dir] = w.count
+}
+
+func (w *Writer) writeDir(dir *Node, parent uint32) error {
+	names := dir.Children()
+	for _, name := range names {
+		c := dir.children[name]
+		if c.Mode.IsDir() {
+			if err := w.writeDir(c, w.numbers[dir]); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		} else if _, done := w.refs[c]; !done {
+			if err := w.writeInode(c); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+
+	block, offset := w.dirs.pos()
+	listing, err := w.dirListing(dir, names)
+	if err != nil {
+		return err
+	}
+	if _, err := w.dirs.Write(listing); err != nil {
+		return err
+	}
+	xattr, err := w.xattrIndex(dir.Xattrs)
+	if err != nil {
+		return err
+	}
+
+	// the size includes the implicit "." and ".." entries
+	size := uint32(len(listing)) + 3
+	if xattr == noXattr && size <= math.MaxUint16 {
+		return w.putInode(dir, typeDir, struct {
+			Block  uint32
+			Nlink  uint32
+			Size   uint16
+			Offset uint16
+			Parent uint32
+		}{uint32(block), w.nlinks[dir], uint16(size), offset, parent})
+	}
+	return w.putInode(dir, typeExtDir, struct {
+		Nlink      uint32
+		Size       uint32
+		Block      uint32
+		Parent     uint32
+		IndexCount uint16
+		Offset     uint16
+		Xattr      uint32
+	}{w.nlinks[dir], size, uint32(block), parent, 0, offset, xattr})
+}
+
+// dirListing encodes the entries of a directory. A header covers up to 256
+// entries whose inodes share a metadata block and a nearby inode number.
+func (w *Writer) dirListing(dir *Node, names []string) ([]byte, error) {
+	var out, run bytes.Buffer
+	var hdr dirHeader
+	entries := 0
+	flush := func() {
+		if entries == 0 {
+			return
+		}
+		hdr.Count = uint32(entries - 1)
+		binary.Write(&out, order, &hdr)
+		out.Write(run.Bytes())
+		run.Reset()
+		entries = 0
+	}
+
+	for _, name := range names {
+		if len(name) > 256 {
+			return nil, fmt.Errorf("name %q longer than 256 bytes", name)
+		}
+		c := dir.children[name]
+		ref, num := w.refs[c], w.numbers[c]
+		start := uint32(ref >> 16)
+		delta := int64(num) - int64(hdr.Number)
+		if entries == 0 || entries == 256 || start != hdr.Start || delta < math.MinInt16 || delta > math.MaxInt16 {
+			flush()
+			hdr = dirHeader{Start: start, Number: num}
+			delta = 0
+		}
+		binary.Write(&run, order, &dirEntry{
+			Offset:   uint16(ref & 0xffff),
+			NumDelta: int16(delta),
+			Type:     basicType(w.types[c]),
+			NameSize: uint16(len(name) - 1),
+		})
+		run.WriteString(name)
+		entries++
+	}
+	flush()
+	return out.Bytes(), nil
+}
+
+func (w *Writer) writeInode(n *Node) error {
+	xattr, err := w.xattrIndex(n.Xattrs)
+	if err != nil {
+		return err
+	}
+	nlink := w.nlinks[n]
+	ext := xattr != noXattr
+
+	switch {
+	case n.Mode.IsRegular():
+		d := n.Data
+		if d == nil {
+			d = &FileData{fragIndex: noFragment}
+		}
+		if !ext && nlink == 1 && d.sparse == 0 && d.size <= math.MaxUint32 && d.start <= math.MaxUint32 {
+			return w.putInode(n, typeFile, struct {
+				Start      uint32
+				FragIndex  uint32
+				FragOffset uint32
+				Size       uint32
+			}{uint32(d.start), d.fragIndex, d.fragOffset, uint32(d.size)}, d.blocks)
+		}
+		return w.putInode(n, typeExtFile, struct {
+			Start      uint64
+			Size       uint64
+			Sparse     uint64
+			Nlink      uint32
+			FragIndex  uint32
+			FragOffset uint32
+			Xattr      uint32
+		}{d.start, d.size, d.sparse, nlink, d.fragIndex, d.fragOffset, xattr}, d.blocks)
+	case n.Mode&fs.ModeSymlink != 0:
+		fields := []any{struct{ Nlink, Size uint32 }{nlink, uint32(len(n.Target))}, []byte(n.Target)}
+		if ext {
+			return w.putInode(n, typeExtSymlink, append(fields, xattr)...)
+		}
+		return w.putInode(n, typeSymlink, fields...)
+	case n.Mode&fs.ModeDevice != 0:
+		t := uint16(typeBlock)
+		if n.Mode&fs.ModeCharDevice != 0 {
+			t = typeChar
+		}
+		fields := []any{struct{ Nlink, Dev uint32 }{nlink, encodeDev(n.Major, n.Minor)}}
+		if ext {
+			return w.putInode(n, t+7, append(fields, xattr)...)
+		}
+		return w.putInode(n, t, fields...)
+	case n.Mode&(fs.ModeNamedPipe|fs.ModeSocket) != 0:
+		t := uint16(typeFifo)
+		if n.Mode&fs.ModeSocket != 0 {
+			t = typeSocket
+		}
+		if ext {
+			return w.putInode(n, t+7, nlink, xattr)
+		}
+		return w.putInode(n, t, nlink)
+	}
+	return fmt.Errorf("unsupported file type %s", n.Mode.Type())
+}
+
+func (w *Writer) putInode(n *Node, t uint16, fields ...any) error {
+	uid, err := w.id(n.UID)
+	if err != nil {
+		return err
+	}
+	gid, err := w.id(n.GID)
+	if err != nil {
+		return err
+	}
+
+	block, offset := w.inodes.pos()
+	w.refs[n] = block<<16 | uint64(offset)
+	w.types[n] = t
+
+	var buf bytes.Buffer
+	binary.Write(&buf, order, &inodeHeader{
+		Type:     t,
+		Perm:     permBits(n.Mode),
+		UIDIndex: uid,
+		GIDIndex: gid,
+		ModTime:  unixTime(n.ModTime),
+		Number:   w.numbers[n],
+	})
+	for _, f := range fields {
+		if err := binary.Write(&buf, order, f); err != nil {
+			return err
+		}
+	}
+	_, err = w.inodes.Write(buf.Bytes())
+	return err
+}
+
+// id returns the index of a uid or gid in the id table
+func (w *Writer) id(v uint32) (uint16, error) {
+	if idx, ok := w.idIdx[v]; ok {
+		return idx, nil
+	}
+	if len(w.ids) >= math.MaxUint16 {
+		return 0, fmt.Errorf("more than %d distinct uids and gids", math.MaxUint16)
+	}
+	idx := uint16(len(w.ids))
+	w.ids = append(w.ids, v)
+	w.idIdx[v] = idx
+	return idx, nil
+}
+
+// xattrIndex stores a set of xattrs once and returns its index in the xattr id table.
+// Names outside the user, trusted and security namespaces cannot be represented and are dropped.
+func (w *Writer) xattrIndex(xattrs map[string][]byte) (uint32, error) {
+	if w.opts.NoXattrs || len(xattrs) == 0 {
+		return noXattr, nil
+	}
+	var kv bytes.Buffer
+	count := uint32(0)
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for t, prefix := range xattrPrefixes {
+			if !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+				continue
+			}
+			value := xattrs[name]
+			binary.Write(&kv, order, []uint16{uint16(t), uint16(len(name) - len(prefix))})
+			kv.WriteString(name[len(prefix):])
+			binary.Write(&kv, order, uint32(len(value)))
+			kv.Write(value)
+			count++
+		}
+	}
+	if count == 0 {
+		return noXattr, nil
+	}
+
+	key := kv.String()
+	if idx, ok := w.xattrs[key]; ok {
+		return idx, nil
+	}
+	block, offset := w.xkv.pos()
+	if _, err := w.xkv.Write(kv.Bytes()); err != nil {
+		return 0, err
+	}
+	idx := uint32(len(w.xids))
+	w.xids = append(w.xids, xattrIDEntry{Ref: block<<16 | uint64(offset), Count: count, Size: uint32(kv.Len())})
+	w.xattrs[key] = idx
+	return idx, nil
+}
+
+// writeTable stores entries as metadata blocks followed by the list of their
+// positions, and returns where that list starts.
+func (w *Writer) writeTable(entries any) (uint64, error) {
+	var data bytes.Buffer
+	if err := binary.Write(&data, order, entries); err != nil {
+		return 0, err
+	}
+	var index []uint64
+	for raw := data.Bytes(); len(raw) > 0; {
+		n := min(len(raw), metaSize)
+		index = append(index, w.pos)
+		block, err := encodeMeta(w.comp, raw[:n], false)
+		if err != nil {
+			return 0, err
+		}
+		if err := w.write(block); err != nil {
+			return 0, err
+		}
+		raw = raw[n:]
+	}
+	start := w.pos
+	var buf bytes.Buffer
+	binary.Write(&buf, order, index)
+	return start, w.write(buf.Bytes())
+}
+
+func (w *Writer) writeXattrTables() (uint64, error) {
+	if len(w.xids) == 0 {
+		return noTable, nil
+	}
+	kv, err := w.xkv.finish()
+	if err != nil {
+		return 0, err
+	}
+	kvStart := w.pos
+	if err := w.write(kv); err != nil {
+		return 0, err
+	}
+
+	var data bytes.Buffer
+	binary.Write(&data, order, w.xids)
+	var index []uint64
+	for raw := data.Bytes(); len(raw) > 0; {
+		n := min(len(raw), metaSize)
+		index = append(index, w.pos)
+		block, err := encodeMeta(w.comp, raw[:n], false)
+		if err != nil {
+			return 0, err
+		}
+		if err := w.write(block); err != nil {
+			return 0, err
+		}
+		raw = raw[n:]
+	}
+
+	start := w.pos
+	var buf bytes.Buffer
+	binary.Write(&buf, order, &xattrTableHeader{TableStart: kvStart, IDs: uint32(len(w.xids))})
+	binary.Write(&buf, order, index)
+	return start, w.write(buf.Bytes())
+}
+
+// metaWriter packs a stream into metadata blocks held in memory until the table is placed.
+type metaWriter struct {
+	comp compressor
+	raw  bool
+	out  bytes.Buffer
+	buf  []byte
+}
+
+// pos returns the reference of the next byte: the block offset relative to
+// the start of the table and the offset inside the uncompressed block.
+func (m *metaWriter) pos() (uint64, uint16) {
+	return uint64(m.out.Len()), uint16(len(m.buf))
+}
+
+func (m *metaWriter) Write(p []byte) (int, error) {
+	m.buf = append(m.buf, p...)
+	for len(m.buf) >= metaSize {
+		if err := m.flush(metaSize); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (m *metaWriter) flush(n int) error {
+	block, err := encodeMeta(m.comp, m.buf[:n], m.raw)
+	if err != nil {
+		return err
+	}
+	m.out.Write(block)
+	m.buf = m.buf[:copy(m.buf, m.buf[n:])]
+	return nil
+}
+
+func (m *metaWriter) finish() ([]byte, error) {
+	if len(m.buf) > 0 {
+		if err := m.flush(len(m.buf)); err != nil {
+			return nil, err
+		}
+	}
+	return m.out.Bytes(), nil
+}
+
+// encodeMeta encodes one metadata block, compressed unless that does not save space.
+func encodeMeta(comp compressor, data []byte, raw bool) ([]byte, error) {
+	if !raw {
+		c, err := comp.compress(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(c) < len(data) {
+			return append(metaHeader(len(c), false), c...), nil
+		}
+	}
+	return append(metaHeader(len(data), true), data...), nil
+}
+
+func metaHeader(size int, uncompressed bool) []byte {
+	h := uint16(size)
+	if uncompressed {
+		h |= metaUncomp
+	}
+	return order.AppendUint16(nil, h)
+}
+
+func allZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func unixTime(t time.Time) uint32 {
+	s := t.Unix()
+	if s < 0 || t.IsZero() {
+		return 0
+	}
+	if s > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(s)
+}
@@ -0,0 +1,189 @@
+load helpers.bash
+
+@test "migrate with the builtin squash builder and run the image" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull busybox:latest
+assert_success
+
+# The builtin builder must not need mksquashfs
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath /nonexistent/mksquashfs \
+		--squash-builder builtin \
+		--mksquashfs-opts "-noappend -comp gzip -b 256K -e security.capability" \
+		--log-level info \
+		--migrate \
+		--image busybox:latest
+assert_success
+assert_output --partial "Migration successfully completed"
+
+run bash -c 'unsquashfs -s "$(ls "$RO_STORAGE"/squash/*.squash | head -n1)"'
+assert_success
+assert_output --partial "Compression gzip"
+assert_output --partial "Block size 262144"
+
+run \
+	"$PARALLAX_BINARY" verify \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--log-level info \
+		--image busybox:latest
+assert_success
+
+run \
+	"$PODMAN_BINARY" \
+		--root "$CLEAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		--storage-opt additionalimagestore=$RO_STORAGE \
+		--storage-opt mount_program=$MOUNT_PROGRAM_PATH \
+		run --rm $PODMAN_RUN_OPTIONS busybox:latest sh -c 'ls /bin/busybox && echo builtin-ok'
+assert_success
+assert_output --partial "builtin-ok"
+}
+
+@test "builtin squash builder rejects unsupported mksquashfs options" {
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--squash-builder builtin \
+		--mksquashfs-opts "-comp lz4" \
+		--migrate \
+		--image busybox:latest
+assert_failure
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--squash-builder builtin \
+		--mksquashfs-opts "-sort file.txt" \
+		--migrate \
+		--image busybox:latest
+assert_failure
+assert_output --partial "not supported by the builtin builder"
+}
+
+@test "migrate without mounting the source image" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull docker.io/library/python:3.12-alpine
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--squash-builder builtin \
+		--no-mount \
+		--log-level debug \
+		--migrate \
+		--image docker.io/library/python:3.12-alpine
+assert_success
+assert_output --partial "Applying"
+refute_output --partial "Mounting source image"
+
+# the layer based tree must match what the overlay mount shows
+run \
+	"$PARALLAX_BINARY" verify \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--log-level info \
+		--image docker.io/library/python:3.12-alpine
+assert_success
+
+run \
+	"$PODMAN_BINARY" \
+		--root "$CLEAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		--storage-opt additionalimagestore=$RO_STORAGE \
+		--storage-opt mount_program=$MOUNT_PROGRAM_PATH \
+		run --rm $PODMAN_RUN_OPTIONS docker.io/library/python:3.12-alpine python3 -c 'print("no-mount-ok")'
+assert_success
+assert_output --partial "no-mount-ok"
+}
+
+@test "--no-mount requires the builtin builder" {
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--no-mount \
+		--migrate \
+		--image busybox:latest
+assert_failure
+assert_output --partial "--squash-builder builtin"
+}
+
+@test "--no-mount keeps hard links, honours opaque directories and is reproducible" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull busybox:latest
+assert_success
+
+cat > "$BATS_TEST_TMPDIR/Containerfile" <<'EOF'
+FROM busybox:latest
+RUN mkdir -p /opq/sub && echo old > /opq/old && echo old > /opq/sub/old
+RUN rm -rf /opq && mkdir /opq && echo new > /opq/new
+RUN echo linked > /a && ln /a /b
+EOF
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		build --pull=never -f "$BATS_TEST_TMPDIR/Containerfile" -t localhost/layered:test "$BATS_TEST_TMPDIR"
+assert_success
+
+for store in "$RO_STORAGE" "$BATS_TEST_TMPDIR/ro2"; do
+	mkdir -p "$store"
+	run \
+		"$PARALLAX_BINARY" \
+			--podmanRoot "$PODMAN_ROOT" \
+			--roStoragePath "$store" \
+			--squash-builder builtin \
+			--no-mount \
+			--migrate \
+			--image localhost/layered:test
+	assert_success
+done
+
+# the layer based tree must match what the overlay mount shows
+run \
+	"$PARALLAX_BINARY" verify \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--image localhost/layered:test
+assert_success
+
+run bash -c 'unsquashfs -lln "$(ls "$1"/squash/*.squash)" squashfs-root/opq' _ "$RO_STORAGE"
+assert_success
+assert_output --partial "squashfs-root/opq/new"
+refute_output --partial "old"
+
+# hard links share their inode
+run \
+	"$PODMAN_BINARY" \
+		--root "$CLEAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		--storage-opt additionalimagestore=$RO_STORAGE \
+		--storage-opt mount_program=$MOUNT_PROGRAM_PATH \
+		run --rm $PODMAN_RUN_OPTIONS localhost/layered:test sh -c 'stat -c "%h %i" /a /b; ls /opq'
+assert_success
+assert_line --index 0 "${lines[1]}"
+assert_line --regexp "^2 "
+assert_line "new"
+refute_line "old"
+
+# two builds from the same layers list the same entries, owners and times
+run bash -c 'diff <(unsquashfs -lln "$(ls "$1"/squash/*.squash)") <(unsquashfs -lln "$(ls "$2"/squash/*.squash)")' _ "$RO_STORAGE" "$BATS_TEST_TMPDIR/ro2"
+assert_success
+}
@@ -0,0 +1,53 @@
+load helpers.bash
+
+@test "migration records a checksum that the checksum command verifies" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull docker.io/library/hello-world:linux
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--log-level info \
+		--migrate \
+		--image docker.io/library/hello-world:linux
+assert_success
+
+run bash -c 'cd "$RO_STORAGE"/squash && sha256sum -c *.sha256'
+assert_success
+
+run \
+	"$PARALLAX_BINARY" checksum \
+		--roStoragePath "$RO_STORAGE" \
+		--image docker.io/library/hello-world:linux
+assert_success
+assert_output --partial "0 failed"
+
+# Corrupt the side-car, all-store mode must catch it
+run bash -c 'f=$(ls "$RO_STORAGE"/squash/*.squash | head -n1) && printf x >> "$f"'
+assert_success
+
+run \
+	"$PARALLAX_BINARY" checksum \
+		--roStoragePath "$RO_STORAGE"
+assert_failure
+assert_output --partial "checksum mismatch"
+
+# and rmi removes the checksum too
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$CLEAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--rmi \
+		--image docker.io/library/hello-world:linux
+assert_success
+
+run bash -c 'ls "$RO_STORAGE"/squash/*.sha256 2>/dev/null | wc -l'
+assert_output "0"
+}
@@ -0,0 +1,59 @@
+load helpers.bash
+
+@test "config files are layered and flags override them" {
+mkdir -p "$BATS_TEST_TMPDIR/xdg/parallax"
+cat > "$BATS_TEST_TMPDIR/xdg/parallax/parallax.conf" <<CONF
+roStoragePath = "$RO_STORAGE"
+log-level = "debug"
+ready-probe = ["/bin/sh"]
+CONF
+cat > "$BATS_TEST_TMPDIR/site.conf" <<CONF
+log-level = "warn"
+squash-builder = "builtin"
+CONF
+
+XDG_CONFIG_HOME="$BATS_TEST_TMPDIR/xdg" PARALLAX_CONFIG="$BATS_TEST_TMPDIR/site.conf" run \
+	"$PARALLAX_BINARY" config show --squash-builder mksquashfs
+assert_success
+assert_line --regexp "^roStoragePath +\"$RO_STORAGE\" +$BATS_TEST_TMPDIR/xdg/parallax/parallax.conf$"
+assert_line --regexp "^ready-probe +\"/bin/sh\" +$BATS_TEST_TMPDIR/xdg/parallax/parallax.conf$"
+assert_line --regexp "^log-level +\"warn\" +$BATS_TEST_TMPDIR/site.conf$"
+assert_line --regexp "^squash-builder +\"mksquashfs\" +flag$"
+assert_line --regexp "^log-output +\"stdout\" +default$"
+}
+
+@test "config files reject unknown and command options" {
+echo 'no-such-option = 1' > "$BATS_TEST_TMPDIR/bad.conf"
+PARALLAX_CONFIG="$BATS_TEST_TMPDIR/bad.conf" run "$PARALLAX_BINARY" config show
+assert_failure
+assert_output --partial 'unknown option "no-such-option"'
+
+echo 'image = "busybox"' > "$BATS_TEST_TMPDIR/bad.conf"
+PARALLAX_CONFIG="$BATS_TEST_TMPDIR/bad.conf" run "$PARALLAX_BINARY" config show
+assert_failure
+assert_output --partial '"image" can only be given on the command line'
+
+PARALLAX_CONFIG="$BATS_TEST_TMPDIR/missing.conf" run "$PARALLAX_BINARY" config show
+assert_failure
+assert_output --partial "missing.conf"
+}
+
+@test "migration takes its options from PARALLAX_CONFIG" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull busybox:latest
+assert_success
+
+cat > "$BATS_TEST_TMPDIR/site.conf" <<CONF
+podmanRoot = "$PODMAN_ROOT"
+roStoragePath = "$RO_STORAGE"
+mksquashfsPath = "$MKSQUASHFS_PATH"
+CONF
+PARALLAX_CONFIG="$BATS_TEST_TMPDIR/site.conf" run \
+	"$PARALLAX_BINARY" --migrate --image busybox:latest
+assert_success
+run bash -c 'ls "$RO_STORAGE"/squash/*.squash'
+assert_success
+}
@@ -0,0 +1,48 @@
+load helpers.bash
+
+@test "doctor reports the environment checks" {
+mkdir -p "$RO_STORAGE"
+run \
+	"$PARALLAX_BINARY" doctor \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH"
+assert_line --partial "dynamic linking: "
+assert_line --partial "user namespace: "
+assert_line --partial "rsync: "
+assert_line --partial "fusermount3: "
+assert_line --partial "temp directory: "
+assert_line --regexp "^\[ok  \] read-only store: $RO_STORAGE on "
+assert_line "[ok  ] read-only store access: $RO_STORAGE is writable"
+}
+
+@test "doctor fails on a missing read-only store" {
+run \
+	"$PARALLAX_BINARY" doctor \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$BATS_TEST_TMPDIR/no-such-store" \
+		--mksquashfsPath "$MKSQUASHFS_PATH"
+assert_failure
+assert_line --partial "[FAIL] read-only store: '$BATS_TEST_TMPDIR/no-such-store' is not a valid directory"
+assert_line --partial "hint: create an empty directory with 'mkdir -p $BATS_TEST_TMPDIR/no-such-store'"
+assert_line "[skip] read-only store access: no usable read-only store"
+assert_output --partial "Doctor found problems"
+}
+
+@test "doctor reports an old fusermount and rsync" {
+mkdir -p "$BATS_TEST_TMPDIR/bin"
+printf '#!/bin/sh\necho "fusermount version: 2.9.9"\n' > "$BATS_TEST_TMPDIR/bin/fusermount"
+printf '#!/bin/sh\necho "rsync  version 3.0.9  protocol version 30"\n' > "$BATS_TEST_TMPDIR/bin/rsync"
+chmod +x "$BATS_TEST_TMPDIR/bin/fusermount" "$BATS_TEST_TMPDIR/bin/rsync"
+
+PATH="$BATS_TEST_TMPDIR/bin:/usr/bin:/bin" run \
+	"$PARALLAX_BINARY" doctor \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH"
+assert_failure
+assert_line "[FAIL] rsync: $BATS_TEST_TMPDIR/bin/rsync version 3.0.9 is too old"
+if [ -e /dev/fuse ] && [ ! -x /usr/bin/fusermount3 ] && [ ! -x /bin/fusermount3 ]; then
+	assert_line "[FAIL] fusermount3: $BATS_TEST_TMPDIR/bin/fusermount version 2.9.9 is FUSE 2"
+fi
+}
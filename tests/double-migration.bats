@@ -53,3 +53,183 @@ run \
 		--image busybox:latest
 assert_success
 }
+
+@test "mv3 re-migration when the tag moves to a new image" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull busybox:latest alpine:latest
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--log-level info \
+		--migrate \
+		--image busybox:latest
+assert_success
+assert_output --partial "Migration successfully completed"
+
+# move the tag to a different image in the source store
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		tag alpine:latest busybox:latest
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--log-level info \
+		--migrate \
+		--prune-previous \
+		--image busybox:latest
+assert_success
+assert_output --partial "Re-migrating"
+assert_output --partial "Pruning previous version"
+
+# the name now serves the new content
+run \
+	"$PODMAN_BINARY" \
+		--root "$CLEAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		--storage-opt additionalimagestore=$RO_STORAGE \
+		--storage-opt mount_program=$MOUNT_PROGRAM_PATH \
+		run --rm $PODMAN_RUN_OPTIONS busybox:latest cat /etc/alpine-release
+assert_success
+
+# only the new squash side-car is left
+run bash -c 'ls "$RO_STORAGE"/squash/*.squash | wc -l'
+assert_output "1"
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$CLEAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--log-level info \
+		--rmi \
+		--image busybox:latest
+assert_success
+}
+
+@test "mv3 re-migration keeps the previous version untagged by default" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull busybox:latest alpine:latest
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--migrate \
+		--image busybox:latest
+assert_success
+previous=$("$PODMAN_BINARY" --root "$RO_STORAGE" --runroot "$PODMAN_RUNROOT" image inspect --format '{{.Id}}' busybox:latest)
+
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		tag alpine:latest busybox:latest
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--migrate \
+		--image busybox:latest
+assert_success
+assert_output --partial "Re-migrating"
+assert_output --partial "kept untagged, remove it with --rmi --image ${previous:0:12}"
+
+# both side-cars are left until the untagged version is removed by ID
+run bash -c 'ls "$RO_STORAGE"/squash/*.squash | wc -l'
+assert_output "2"
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$CLEAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--rmi \
+		--image "${previous:0:12}"
+assert_success
+assert_output --partial "Removal successfully completed"
+
+run bash -c 'ls "$RO_STORAGE"/squash/*.squash | wc -l'
+assert_output "1"
+run "$PODMAN_BINARY" --root "$RO_STORAGE" --runroot "$PODMAN_RUNROOT" image ls --all --no-trunc --format '{{.Id}}'
+refute_output --partial "$previous"
+}
+
+@test "mv3 re-migration keeps a previous version that has other tags" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull busybox:latest alpine:latest
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--migrate \
+		--image busybox:latest
+assert_success
+
+# a second tag on the migrated image
+run \
+	"$PODMAN_BINARY" \
+		--root "$RO_STORAGE" \
+		--runroot "$PODMAN_RUNROOT" \
+		tag busybox:latest busybox:1.36
+assert_success
+
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		tag alpine:latest busybox:latest
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--migrate \
+		--prune-previous \
+		--image busybox:latest
+assert_success
+assert_output --partial "Re-migrating"
+assert_output --partial "it is still tagged docker.io/library/busybox:1.36"
+refute_output --partial "Pruning previous version"
+
+# the other tag still runs the previous version
+run \
+	"$PODMAN_BINARY" \
+		--root "$CLEAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		--storage-opt additionalimagestore=$RO_STORAGE \
+		--storage-opt mount_program=$MOUNT_PROGRAM_PATH \
+		run --rm $PODMAN_RUN_OPTIONS busybox:1.36 echo ok
+assert_success
+assert_output "ok"
+
+run bash -c 'ls "$RO_STORAGE"/squash/*.squash | wc -l'
+assert_output "2"
+}
@@ -0,0 +1,62 @@
+load helpers.bash
+
+@test "migration and mounts write Prometheus textfile metrics" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull busybox:latest
+assert_success
+
+metrics_dir="$BATS_TEST_TMPDIR/textfile"
+mkdir -p "$metrics_dir"
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--metrics-dir "$metrics_dir" \
+		--migrate \
+		--image busybox:latest
+assert_success
+
+run bash -c 'cat "$0"/parallax-*.prom' "$metrics_dir"
+assert_success
+assert_output --partial '# TYPE parallax_migrations_total counter'
+assert_output --partial 'parallax_migration_phase_duration_seconds{image="busybox:latest",phase="squash"'
+assert_output --partial 'parallax_squash_build_duration_seconds{builder="mksquashfs"'
+assert_output --partial 'parallax_squash_size_bytes{'
+assert_output --partial 'parallax_squash_compression_ratio{'
+assert_output --partial 'result="migrated"'
+
+# a second run has nothing to do, the counters add up
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--metrics-dir "$metrics_dir" \
+		--migrate \
+		--image busybox:latest
+assert_success
+run bash -c 'grep "^parallax_migrations_total" "$0"/parallax-*.prom' "$metrics_dir"
+assert_output --partial 'result="migrated",uid="'
+assert_output --partial 'result="skipped",uid="'
+refute_output --partial 'image='
+
+ln -s "$PARALLAX_BINARY" "$BATS_TEST_TMPDIR/parallax-mount"
+PARALLAX_MP_METRICS_DIR="$metrics_dir" run \
+	"$PODMAN_BINARY" \
+		--root "$CLEAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		--storage-opt additionalimagestore=$RO_STORAGE \
+		--storage-opt mount_program=$BATS_TEST_TMPDIR/parallax-mount \
+		run --rm $PODMAN_RUN_OPTIONS busybox:latest echo metrics-ok
+assert_success
+assert_output --partial "metrics-ok"
+
+run bash -c 'cat "$0"/parallax-mount-*.prom' "$metrics_dir"
+assert_success
+assert_output --partial 'parallax_mount_duration_seconds_count{phase="total"'
+assert_output --partial 'parallax_mount_duration_seconds_sum{phase="squash_mount"'
+}
@@ -0,0 +1,256 @@
+#!/usr/bin/env bats
+# tests for the native "parallax mount-program" configuration and argument handling
+
+export PARALLAX_BINARY="${PARALLAX_BINARY:-/mnt/nfs/git/parallax/parallax}"
+
+setup() {
+  TEST_DIR="$(mktemp -d)"
+  export PARALLAX_MP_LOGFILE="$TEST_DIR/mp.log"
+  export PARALLAX_MP_LOGLEVEL="DEBUG"
+  export PARALLAX_MP_TMPDIR="$TEST_DIR/mounts"
+  export PATH="$TEST_DIR/bin:$PATH"
+  unset PARALLAX_MP_CONFIG PARALLAX_MP_SQUASHFUSE_CMD PARALLAX_MP_FUSE_OVERLAYFS_CMD
+  # the fake tools below stand in for FUSE, keep the kernel out of the way
+  export PARALLAX_MP_KERNEL_MOUNTS=never
+
+  mkdir -p "$TEST_DIR/bin"
+  LOWERDIR="$TEST_DIR/lowerdir"
+  UPPERRDIR="$TEST_DIR/upperdir"
+  WORKDIR="$TEST_DIR/workdir"
+  MNTPOINT="$TEST_DIR/mnt"
+  mkdir -p "$LOWERDIR" "$UPPERRDIR" "$WORKDIR" "$MNTPOINT"
+
+  # fake tools recording their arguments, one per line
+  for tool in custom-fuse-overlayfs env-fuse-overlayfs squashfuse_ll; do
+    printf '#!/usr/bin/env bash\necho %s\nprintf "<%%s>\\n" "$@"\n' "$tool" > "$TEST_DIR/bin/$tool"
+    chmod +x "$TEST_DIR/bin/$tool"
+  done
+
+  # the program is also installed under its own name
+  ln -s "$PARALLAX_BINARY" "$TEST_DIR/bin/parallax-mount"
+}
+
+teardown() {
+  rm -rf "$TEST_DIR"
+}
+
+@test "config file overrides environment" {
+  cat <<CONF > "$TEST_DIR/parallax-mount.conf"
+# comments and export are accepted
+export PARALLAX_MP_FUSE_OVERLAYFS_CMD="custom-fuse-overlayfs"
+CONF
+  export PARALLAX_MP_FUSE_OVERLAYFS_CMD=env-fuse-overlayfs
+
+  run env PARALLAX_MP_CONFIG="$TEST_DIR/parallax-mount.conf" \
+    "$PARALLAX_BINARY" mount-program \
+      "-o lowerdir=$LOWERDIR,upperdir=$UPPERRDIR,workdir=$WORKDIR" \
+      "$MNTPOINT"
+  [ "$status" -eq 0 ]
+  grep -q "Normal container mount" "$PARALLAX_MP_LOGFILE"
+  grep -q "custom-fuse-overlayfs" "$PARALLAX_MP_LOGFILE"
+  ! grep -q "env-fuse-overlayfs" "$PARALLAX_MP_LOGFILE"
+}
+
+@test "environment is used without config file" {
+  export PARALLAX_MP_FUSE_OVERLAYFS_CMD=env-fuse-overlayfs
+
+  run parallax-mount -o "lowerdir=$LOWERDIR,upperdir=$UPPERRDIR,workdir=$WORKDIR" "$MNTPOINT"
+  [ "$status" -eq 0 ]
+  grep -q "env-fuse-overlayfs" "$PARALLAX_MP_LOGFILE"
+}
+
+@test "escaped colons and commas survive the option rewrite" {
+  export PARALLAX_MP_FUSE_OVERLAYFS_CMD=env-fuse-overlayfs
+  mkdir -p "$TEST_DIR/odd:dir,name"
+
+  run parallax-mount -o "lowerdir=$TEST_DIR/odd\:dir\,name:$LOWERDIR,upperdir=$UPPERRDIR,workdir=$WORKDIR,context=\"system_u:object_r:container_file_t:s0:c1,c2\"" "$MNTPOINT"
+  [ "$status" -eq 0 ]
+  grep -qF "<lowerdir=$TEST_DIR/odd\:dir\,name:$LOWERDIR,upperdir=$UPPERRDIR,workdir=$WORKDIR,context=\"system_u:object_r:container_file_t:s0:c1,c2\">" "$PARALLAX_MP_LOGFILE"
+  grep -qF "<$MNTPOINT>" "$PARALLAX_MP_LOGFILE"
+}
+
+@test "malformed arguments are reported" {
+  export PARALLAX_MP_FUSE_OVERLAYFS_CMD=env-fuse-overlayfs
+
+  run parallax-mount -o "upperdir=$UPPERRDIR" "$MNTPOINT"
+  [ "$status" -eq 1 ]
+  [[ "$output" =~ "no lowerdir in mount options" ]]
+
+  run parallax-mount -o "lowerdir=$LOWERDIR"
+  [ "$status" -eq 1 ]
+  [[ "$output" =~ "no mount point given" ]]
+
+  run parallax-mount -o "lowerdir=$LOWERDIR::$LOWERDIR" "$MNTPOINT"
+  [ "$status" -eq 1 ]
+  [[ "$output" =~ "empty lower directory" ]]
+}
+
+@test "missing fuse-overlayfs is reported" {
+  export PARALLAX_MP_FUSE_OVERLAYFS_CMD=missing-fuse-overlayfs
+
+  run parallax-mount -o "lowerdir=$LOWERDIR,upperdir=$UPPERRDIR,workdir=$WORKDIR" "$MNTPOINT"
+  [ "$status" -eq 1 ]
+  [[ "$output" =~ "missing required dependency: missing-fuse-overlayfs" ]]
+}
+
+@test "unsupported config file lines are rejected" {
+  echo 'source /etc/other.conf' > "$TEST_DIR/parallax-mount.conf"
+
+  run env PARALLAX_MP_CONFIG="$TEST_DIR/parallax-mount.conf" \
+    parallax-mount -o "lowerdir=$LOWERDIR" "$MNTPOINT"
+  [ "$status" -eq 1 ]
+  [[ "$output" =~ "line 1" ]]
+}
+
+@test "containers of one squash file share its mount" {
+  [ "$(id -u)" -eq 0 ] || skip "kernel mounts stand in for the FUSE tools"
+  export UMOUNT_WAIT_DELAY=0.2
+  # kernel squashfs and overlayfs instead of squashfuse and fuse-overlayfs
+  printf '#!/usr/bin/env bash\nmount -t squashfs -o loop,ro "$1" "$2"\n' > "$TEST_DIR/bin/squashfuse_ll"
+  printf '#!/usr/bin/env bash\nmount -t overlay overlay -o "$2" "$3"\n' > "$TEST_DIR/bin/kernel-overlayfs"
+  chmod +x "$TEST_DIR/bin/squashfuse_ll" "$TEST_DIR/bin/kernel-overlayfs"
+  export PARALLAX_MP_FUSE_OVERLAYFS_CMD=kernel-overlayfs
+
+  mkdir -p "$TEST_DIR/rootfs/etc"
+  touch "$TEST_DIR/rootfs/etc/hostname"
+  mksquashfs "$TEST_DIR/rootfs" "$LOWERDIR.squash" -noappend -quiet
+
+  for c in 1 2; do
+    mkdir -p "$TEST_DIR/up$c" "$TEST_DIR/work$c" "$TEST_DIR/mnt$c"
+    run parallax-mount -o "lowerdir=$LOWERDIR,upperdir=$TEST_DIR/up$c,workdir=$TEST_DIR/work$c" "$TEST_DIR/mnt$c"
+    [ "$status" -eq 0 ]
+  done
+  [ "$(grep -c 'Mounting squash file' "$PARALLAX_MP_LOGFILE")" -eq 1 ]
+  grep -q "Reusing squash mount" "$PARALLAX_MP_LOGFILE"
+  [ "$(grep -c "$TEST_DIR/mounts/lowerdir\." /proc/self/mountinfo)" -eq 3 ]
+
+  # deleting files in /etc is not an exit
+  rm "$TEST_DIR/mnt1/etc/hostname"
+  sleep 1
+  ! grep -q "Cleanup of" "$PARALLAX_MP_LOGFILE"
+
+  # the first container exits, the squash mount stays for the second one
+  umount "$TEST_DIR/mnt1"
+  sleep 1
+  grep -q "still used by 1 containers" "$PARALLAX_MP_LOGFILE"
+  [ "$(grep -c "$TEST_DIR/mounts/lowerdir\." /proc/self/mountinfo)" -eq 2 ]
+
+  # the last one unmounts it, even lazily unmounted
+  umount -l "$TEST_DIR/mnt2"
+  sleep 1
+  grep -q "Cleanup of $TEST_DIR/mnt2 triggered by: overlay mount disappeared" "$PARALLAX_MP_LOGFILE"
+  ! grep -q "$TEST_DIR/mounts/lowerdir\." /proc/self/mountinfo
+  ! ls -d "$TEST_DIR"/mounts/lowerdir.*
+}
+
+@test "mounts gc unmounts squash mounts left by a killed watcher" {
+  [ "$(id -u)" -eq 0 ] || skip "kernel mounts stand in for the FUSE tools"
+  export UMOUNT_WAIT_DELAY=0.2 UMOUNT_WAIT_RETRIES=3 PARALLAX_MP_LOG_MAX_SIZE=0 PARALLAX_MP_READY_TIMEOUT=5
+  printf '#!/usr/bin/env bash\nmount -t squashfs -o loop,ro "$1" "$2"\n' > "$TEST_DIR/bin/squashfuse_ll"
+  printf '#!/usr/bin/env bash\nmount -t overlay overlay -o "$2" "$3"\n' > "$TEST_DIR/bin/kernel-overlayfs"
+  chmod +x "$TEST_DIR/bin/squashfuse_ll" "$TEST_DIR/bin/kernel-overlayfs"
+  export PARALLAX_MP_FUSE_OVERLAYFS_CMD=kernel-overlayfs
+
+  mkdir -p "$TEST_DIR/rootfs/etc"
+  mksquashfs "$TEST_DIR/rootfs" "$LOWERDIR.squash" -noappend -quiet
+  run parallax-mount -o "lowerdir=$LOWERDIR,upperdir=$UPPERRDIR,workdir=$WORKDIR" "$MNTPOINT"
+  [ "$status" -eq 0 ]
+  mkdir "$TEST_DIR/mounts/lowerdir.leftover"
+
+  # an overlay still uses the squash mount
+  run "$PARALLAX_BINARY" mounts gc
+  [ "$status" -eq 0 ]
+  [[ "$output" =~ "is in use" ]]
+  [[ "$output" =~ "Removed leftover lowerdir $TEST_DIR/mounts/lowerdir.leftover" ]]
+  [[ "$output" =~ "Rotated $PARALLAX_MP_LOGFILE" ]]
+
+  # without its watcher nobody unmounts it, gc does once the grace period is over
+  pkill -f "^parallax-mount --watch $MNTPOINT"
+  umount "$MNTPOINT"
+  sleep 11
+  run "$PARALLAX_BINARY" mounts gc
+  [ "$status" -eq 0 ]
+  [[ "$output" =~ "Unmounted 1 squash mounts" ]]
+  ! grep -q "$TEST_DIR/mounts/lowerdir\." /proc/self/mountinfo
+}
+
+@test "mounts list shows squash mounts with their image and containers" {
+  [ "$(id -u)" -eq 0 ] || skip "kernel mounts stand in for the FUSE tools"
+  printf '#!/usr/bin/env bash\nmount -t squashfs -o loop,ro "$1" "$2"\n' > "$TEST_DIR/bin/squashfuse_ll"
+  printf '#!/usr/bin/env bash\nmount -t overlay overlay -o "$2" "$3"\n' > "$TEST_DIR/bin/kernel-overlayfs"
+  chmod +x "$TEST_DIR/bin/squashfuse_ll" "$TEST_DIR/bin/kernel-overlayfs"
+  export PARALLAX_MP_FUSE_OVERLAYFS_CMD=kernel-overlayfs
+
+  # a read-only store with one migrated image
+  RO="$TEST_DIR/ro"
+  mkdir -p "$RO/overlay/layer1" "$RO/overlay/l/LINK1" "$RO/squash" "$RO/overlay-images" "$TEST_DIR/rootfs/etc"
+  printf LINK1 > "$RO/overlay/layer1/link"
+  echo '[{"id":"0123456789abcdef","names":["docker.io/library/demo:1"],"layer":"layer1"}]' > "$RO/overlay-images/images.json"
+  mksquashfs "$TEST_DIR/rootfs" "$RO/squash/LINK1.squash" -noappend -quiet
+  ln -s ../../squash/LINK1.squash "$RO/overlay/l/LINK1.squash"
+
+  run parallax-mount -o "lowerdir=$RO/overlay/l/LINK1,upperdir=$UPPERRDIR,workdir=$WORKDIR" "$MNTPOINT"
+  [ "$status" -eq 0 ]
+
+  run "$PARALLAX_BINARY" mounts list --roStoragePath "$RO"
+  [ "$status" -eq 0 ]
+  [[ "$output" =~ "$RO/squash/LINK1.squash" ]]
+  [[ "$output" =~ "docker.io/library/demo:1" ]]
+  [[ "$output" =~ "└ $MNTPOINT" ]]
+  umount "$MNTPOINT"
+  sleep 1
+}
+
+@test "kernel squashfs and overlayfs are used when allowed" {
+  [ "$(id -u)" -eq 0 ] || skip "loop devices need root"
+  export PARALLAX_MP_KERNEL_MOUNTS=auto
+  mkdir -p "$TEST_DIR/rootfs/etc"
+  echo kernel > "$TEST_DIR/rootfs/etc/hostname"
+  mksquashfs "$TEST_DIR/rootfs" "$LOWERDIR.squash" -noappend -quiet
+
+  run parallax-mount -o "lowerdir=$LOWERDIR,upperdir=$UPPERRDIR,workdir=$WORKDIR" "$MNTPOINT"
+  [ "$status" -eq 0 ]
+  grep -q "Mounting squash file with the kernel" "$PARALLAX_MP_LOGFILE"
+  grep -q "Kernel overlay mount successful" "$PARALLAX_MP_LOGFILE"
+  ! grep -q "squashfuse_ll" "$PARALLAX_MP_LOGFILE"
+  [ "$(cat "$MNTPOINT/etc/hostname")" = "kernel" ]
+  umount "$MNTPOINT"
+  sleep 1
+}
+
+@test "kernel overlay falls back to fuse-overlayfs on unknown options" {
+  [ "$(id -u)" -eq 0 ] || skip "kernel overlay mounts need root here"
+  export PARALLAX_MP_KERNEL_MOUNTS=auto PARALLAX_MP_FUSE_OVERLAYFS_CMD=env-fuse-overlayfs
+
+  run parallax-mount -o "lowerdir=$LOWERDIR,upperdir=$UPPERRDIR,workdir=$WORKDIR,uidmapping=0:1000:1" "$MNTPOINT"
+  [ "$status" -eq 0 ]
+  grep -q "falling back to FUSE" "$PARALLAX_MP_LOGFILE"
+  grep -q "env-fuse-overlayfs" "$PARALLAX_MP_LOGFILE"
+
+  export PARALLAX_MP_KERNEL_MOUNTS=always
+  run parallax-mount -o "lowerdir=$LOWERDIR,upperdir=$UPPERRDIR,workdir=$WORKDIR,uidmapping=0:1000:1" "$MNTPOINT"
+  [ "$status" -eq 1 ]
+}
+
+@test "json log lines carry the container and phase timings" {
+  export PARALLAX_MP_LOG_FORMAT=json PARALLAX_MP_FUSE_OVERLAYFS_CMD=env-fuse-overlayfs
+  # podman's layout: the upperdir is the diff of the container's layer
+  GRAPH="$TEST_DIR/graph"
+  mkdir -p "$GRAPH/overlay/ctrlayer/diff" "$GRAPH/overlay/ctrlayer/work" "$GRAPH/overlay-containers"
+  echo '[{"id":"c0ffee","layer":"ctrlayer"}]' > "$GRAPH/overlay-containers/containers.json"
+
+  run parallax-mount -o "lowerdir=$LOWERDIR,upperdir=$GRAPH/overlay/ctrlayer/diff,workdir=$GRAPH/overlay/ctrlayer/work" "$MNTPOINT"
+  [ "$status" -eq 0 ]
+  grep '"phase":"total"' "$PARALLAX_MP_LOGFILE" | grep -q '"container_id":"c0ffee"'
+  grep -q "\"mount_dir\":\"$MNTPOINT\"" "$PARALLAX_MP_LOGFILE"
+  ! grep -qv '^{.*}$' "$PARALLAX_MP_LOGFILE"
+}
+
+@test "stderr log sink" {
+  export PARALLAX_MP_LOG_SINK=stderr PARALLAX_MP_FUSE_OVERLAYFS_CMD=env-fuse-overlayfs
+
+  run parallax-mount -o "lowerdir=$LOWERDIR,upperdir=$UPPERRDIR,workdir=$WORKDIR" "$MNTPOINT"
+  [ "$status" -eq 0 ]
+  [[ "$output" =~ "Normal container mount" ]]
+  [ ! -s "$PARALLAX_MP_LOGFILE" ]
+}
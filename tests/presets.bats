@@ -0,0 +1,83 @@
+load helpers.bash
+
+@test "presets are recorded with the image and shown by list and inspect" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull docker.io/library/hello-world:linux
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--preset small \
+		--migrate \
+		--image docker.io/library/hello-world:linux
+assert_success
+assert_output --partial "Squash options (small): -noappend -comp zstd -Xcompression-level 19 -b 1M -no-xattrs"
+
+run "$PARALLAX_BINARY" list --roStoragePath "$RO_STORAGE"
+assert_success
+assert_line --regexp "docker.io/library/hello-world:linux +[0-9.]+[kM]?B +small$"
+
+run \
+	"$PARALLAX_BINARY" inspect \
+		--roStoragePath "$RO_STORAGE" \
+		--log-output stderr \
+		--image docker.io/library/hello-world:linux
+assert_success
+assert_output --partial '"preset": "small"'
+assert_output --partial '"builder": "mksquashfs"'
+assert_output --partial '"19",'
+assert_output --partial '"1M",'
+}
+
+@test "images migrated without options record the default preset" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull docker.io/library/hello-world:linux
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--migrate \
+		--image docker.io/library/hello-world:linux
+assert_success
+
+run "$PARALLAX_BINARY" list --roStoragePath "$RO_STORAGE"
+assert_line --regexp "docker.io/library/hello-world:linux +[0-9.]+[kM]?B +default$"
+}
+
+@test "preset and mksquashfs-opts conflicts" {
+run "$PARALLAX_BINARY" config show --preset nope
+assert_failure
+assert_output --partial 'Unknown preset "nope" (compat, fast, small)'
+
+run "$PARALLAX_BINARY" config show --preset fast --mksquashfs-opts "-comp xz"
+assert_failure
+assert_output --partial "--preset and --mksquashfs-opts cannot be combined"
+
+# the command line wins over the config files
+cat > "$BATS_TEST_TMPDIR/parallax.conf" <<CONF
+mksquashfs-opts = "-comp xz"
+[stores.archive]
+path = "$RO_STORAGE"
+preset = "compat"
+CONF
+PARALLAX_CONFIG="$BATS_TEST_TMPDIR/parallax.conf" run \
+	"$PARALLAX_BINARY" doctor --preset fast --mksquashfsPath "$MKSQUASHFS_PATH"
+assert_line --partial "mksquashfs options: -noappend -comp zstd -Xcompression-level 1 -no-xattrs"
+
+# and a store over the config files
+PARALLAX_CONFIG="$BATS_TEST_TMPDIR/parallax.conf" run \
+	"$PARALLAX_BINARY" doctor --store archive --mksquashfsPath "$MKSQUASHFS_PATH"
+assert_line --partial "mksquashfs options: -noappend -comp gzip -no-xattrs"
+}
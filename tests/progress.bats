@@ -0,0 +1,57 @@
+load helpers.bash
+
+@test "migration logs progress events for its phases" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull busybox:latest
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--log-format json \
+		--progress-interval 1ms \
+		--migrate \
+		--image busybox:latest
+assert_success
+assert_output --partial '"event":"progress"'
+assert_output --partial '"phase":"mirror"'
+assert_output --partial '"phase":"squash"'
+assert_output --partial '"bytes_total":'
+}
+
+@test "builtin builder reports the bytes it read" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull busybox:latest
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--squash-builder builtin \
+		--no-mount \
+		--log-format json \
+		--progress-interval 1ms \
+		--migrate \
+		--image busybox:latest
+assert_success
+assert_output --regexp '"bytes_done":[1-9][0-9]*,"bytes_total":[1-9]'
+}
+
+@test "progress-interval must be positive" {
+run \
+	"$PARALLAX_BINARY" \
+		--roStoragePath "$RO_STORAGE" \
+		--progress-interval 0s \
+		checksum
+assert_failure
+assert_output --partial "progress-interval must be positive"
+}
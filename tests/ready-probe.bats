@@ -0,0 +1,83 @@
+load helpers.bash
+
+@test "readiness probes are recorded at migration and checked before the container starts" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull busybox:latest
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--ready-probe /bin/busybox \
+		--ready-probe /etc/passwd \
+		--migrate \
+		--image busybox:latest
+assert_success
+
+run bash -c 'cat "$RO_STORAGE"/overlay-images/*/parallax.probes'
+assert_success
+assert_output '["/bin/busybox","/etc/passwd"]'
+
+# the probes are only checked by the native mount program
+ln -s "$PARALLAX_BINARY" "$BATS_TEST_TMPDIR/parallax-mount"
+run \
+	"$PODMAN_BINARY" \
+		--root "$CLEAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		--storage-opt additionalimagestore=$RO_STORAGE \
+		--storage-opt mount_program=$BATS_TEST_TMPDIR/parallax-mount \
+		run --rm $PODMAN_RUN_OPTIONS busybox:latest echo probed-ok
+assert_success
+assert_output --partial "probed-ok"
+grep -q "Readiness probe /etc/passwd passed" "$PARALLAX_MP_LOGFILE"
+}
+
+@test "a failing readiness probe stops the container start" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull busybox:latest
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--ready-probe /opt/never/there \
+		--migrate \
+		--image busybox:latest
+assert_success
+
+ln -s "$PARALLAX_BINARY" "$BATS_TEST_TMPDIR/parallax-mount"
+export PARALLAX_MP_READY_TIMEOUT=2
+run \
+	"$PODMAN_BINARY" \
+		--root "$CLEAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		--storage-opt additionalimagestore=$RO_STORAGE \
+		--storage-opt mount_program=$BATS_TEST_TMPDIR/parallax-mount \
+		run --rm $PODMAN_RUN_OPTIONS busybox:latest echo should-not-run
+assert_failure
+refute_output --partial "should-not-run"
+grep -q "readiness probe /opt/never/there failed after 2s" "$PARALLAX_MP_LOGFILE"
+}
+
+@test "readiness probes must be absolute paths" {
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--ready-probe opt/app \
+		--migrate \
+		--image busybox:latest
+assert_failure
+assert_output --partial "must be an absolute path"
+}
@@ -0,0 +1,96 @@
+load helpers.bash
+
+@test "resquash rebuilds the side-car in place with new options" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull docker.io/library/busybox:latest
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--preset fast \
+		--migrate \
+		--image docker.io/library/busybox:latest
+assert_success
+
+run "$PARALLAX_BINARY" list --roStoragePath "$RO_STORAGE"
+assert_line --regexp "docker.io/library/busybox:latest +[0-9.]+[kM]?B +fast$"
+before_id=$(echo "$output" | awk '/busybox/ { print $2 }')
+squash=$(ls "$RO_STORAGE"/squash/*.squash)
+before_sum=$(sha256sum "$squash" | cut -d' ' -f1)
+
+# the source image is not needed anymore
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		rmi docker.io/library/busybox:latest
+assert_success
+
+for builder in mksquashfs builtin; do
+	run \
+		"$PARALLAX_BINARY" resquash \
+			--roStoragePath "$RO_STORAGE" \
+			--mksquashfsPath "$MKSQUASHFS_PATH" \
+			--squash-builder "$builder" \
+			--preset small \
+			--image docker.io/library/busybox:latest
+	assert_success
+	assert_output --partial "Resquash successfully completed"
+done
+
+# same file name, image and link, new content and checksum
+[ "$(ls "$RO_STORAGE"/squash/*.squash)" = "$squash" ]
+[ ! -e "$squash.resquash" ]
+[ "$(sha256sum "$squash" | cut -d' ' -f1)" != "$before_sum" ]
+run "$PARALLAX_BINARY" checksum --roStoragePath "$RO_STORAGE"
+assert_success
+
+run "$PARALLAX_BINARY" list --roStoragePath "$RO_STORAGE"
+assert_line --regexp "^.* $before_id +docker.io/library/busybox:latest +[0-9.]+[kM]?B +small$"
+
+run \
+	"$PODMAN_BINARY" \
+		--root "$CLEAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		--storage-opt additionalimagestore="$RO_STORAGE" \
+		--storage-opt mount_program="$MOUNT_PROGRAM_PATH" \
+		run --rm docker.io/library/busybox:latest echo resquashed
+assert_success
+assert_output --partial "resquashed"
+}
+
+@test "resquash keeps a side-car that fails its checksum" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull docker.io/library/hello-world:linux
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--migrate \
+		--image docker.io/library/hello-world:linux
+assert_success
+
+squash=$(ls "$RO_STORAGE"/squash/*.squash)
+printf 'x' | dd of="$squash" bs=1 seek=200 conv=notrunc 2>/dev/null
+
+run \
+	"$PARALLAX_BINARY" resquash \
+		--roStoragePath "$RO_STORAGE" \
+		--squash-builder builtin \
+		--preset fast \
+		--image docker.io/library/hello-world:linux
+assert_failure
+assert_output --partial "checksum mismatch"
+}
@@ -0,0 +1,49 @@
+load helpers.bash
+
+@test "setup writes the store and mount program into storage.conf" {
+cat > "$BATS_TEST_TMPDIR/storage.conf" <<CONF
+[storage]
+driver = "overlay"
+graphroot = "$PODMAN_ROOT"
+[storage.options]
+additionalimagestores = ["/some/other/store"]
+CONF
+mkdir -p "$RO_STORAGE/overlay" "$RO_STORAGE/squash"
+ln -s "$PARALLAX_BINARY" "$BATS_TEST_TMPDIR/parallax-mount"
+
+CONTAINERS_STORAGE_CONF="$BATS_TEST_TMPDIR/storage.conf" run \
+	"$PARALLAX_BINARY" setup \
+		--roStoragePath "$RO_STORAGE" \
+		--mount-program "$BATS_TEST_TMPDIR/parallax-mount"
+assert_success
+assert_output --partial "Updated $BATS_TEST_TMPDIR/storage.conf"
+[ -f "$BATS_TEST_TMPDIR/storage.conf.bak" ]
+
+run cat "$BATS_TEST_TMPDIR/storage.conf"
+assert_output --partial "additionalimagestores = [\"/some/other/store\", \"$RO_STORAGE\"]"
+assert_output --partial "mount_program = \"$BATS_TEST_TMPDIR/parallax-mount\""
+
+# running it again changes nothing
+CONTAINERS_STORAGE_CONF="$BATS_TEST_TMPDIR/storage.conf" run \
+	"$PARALLAX_BINARY" setup \
+		--roStoragePath "$RO_STORAGE" \
+		--mount-program "$BATS_TEST_TMPDIR/parallax-mount"
+assert_success
+assert_output --partial "already uses"
+
+# the defaults now come from storage.conf
+CONTAINERS_STORAGE_CONF="$BATS_TEST_TMPDIR/storage.conf" run \
+	"$PARALLAX_BINARY" config show
+assert_success
+assert_line --regexp "^podmanRoot +\"$PODMAN_ROOT\" +$BATS_TEST_TMPDIR/storage.conf$"
+assert_line --regexp "^roStoragePath +\"$RO_STORAGE\" +$BATS_TEST_TMPDIR/storage.conf \(additionalimagestores\)$"
+}
+
+@test "setup needs a mount program" {
+CONTAINERS_STORAGE_CONF="$BATS_TEST_TMPDIR/storage.conf" run \
+	"$PARALLAX_BINARY" setup \
+		--roStoragePath "$RO_STORAGE" \
+		--mount-program "$BATS_TEST_TMPDIR/missing"
+assert_failure
+[ ! -e "$BATS_TEST_TMPDIR/storage.conf" ]
+}
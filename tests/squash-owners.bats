@@ -0,0 +1,84 @@
+load helpers.bash
+
+# builds an image whose files belong to in-container users
+import_owned_image() {
+	mkdir -p "$BATS_TEST_TMPDIR/rootfs/home/app"
+	echo data > "$BATS_TEST_TMPDIR/rootfs/home/app/data"
+	echo root > "$BATS_TEST_TMPDIR/rootfs/root-file"
+	tar --owner=0 --group=0 -C "$BATS_TEST_TMPDIR/rootfs" -cf "$BATS_TEST_TMPDIR/rootfs.tar" root-file
+	tar --owner=1000 --group=1001 -C "$BATS_TEST_TMPDIR/rootfs" -rf "$BATS_TEST_TMPDIR/rootfs.tar" home
+
+	run \
+		"$PODMAN_BINARY" \
+			--root "$PODMAN_ROOT" \
+			--runroot "$PODMAN_RUNROOT" \
+			import "$BATS_TEST_TMPDIR/rootfs.tar" localhost/owned:test
+	assert_success
+}
+
+@test "uid and gid maps rewrite the owners of the side-car" {
+import_owned_image
+
+for builder in mksquashfs builtin; do
+	run \
+		"$PARALLAX_BINARY" \
+			--podmanRoot "$PODMAN_ROOT" \
+			--roStoragePath "$RO_STORAGE.$builder" \
+			--mksquashfsPath "$MKSQUASHFS_PATH" \
+			--squash-builder "$builder" \
+			--uid-map 1000:5000:100 \
+			--gid-map 1000:6000:100 \
+			--migrate \
+			--image localhost/owned:test
+	assert_success
+	assert_output --partial "Squash owners: uids 1000:5000:100, gids 1000:6000:100"
+
+	run bash -c "unsquashfs -lln \"\$(ls \"$RO_STORAGE.$builder\"/squash/*.squash | head -n1)\""
+	assert_success
+	assert_output --regexp " 5000/6001 .*home/app/data"
+	assert_output --regexp " 0/0 .*root-file"
+
+	run \
+		"$PARALLAX_BINARY" inspect \
+			--roStoragePath "$RO_STORAGE.$builder" \
+			--log-output stderr \
+			--image localhost/owned:test
+	assert_success
+	assert_output --partial '"1000:5000:100"'
+	assert_output --partial '"1000:6000:100"'
+done
+}
+
+@test "squash-owner gives every entry one owner" {
+import_owned_image
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--squash-owner 4000:4000 \
+		--migrate \
+		--image localhost/owned:test
+assert_success
+
+run bash -c 'unsquashfs -lln "$(ls "$RO_STORAGE"/squash/*.squash | head -n1)"'
+assert_success
+assert_output --regexp " 4000/4000 .*home/app/data"
+assert_output --regexp " 4000/4000 .*root-file"
+refute_output --regexp " 0/0 "
+}
+
+@test "owner options are validated" {
+run "$PARALLAX_BINARY" config show --uid-map 1000:2000
+assert_failure
+assert_output --partial 'ID map "1000:2000" must be from:to:size'
+
+run "$PARALLAX_BINARY" config show --uid-map 0:100:10 --uid-map 5:200:1
+assert_failure
+assert_output --partial 'ID map "5:200:1" overlaps 0:100:10'
+
+run "$PARALLAX_BINARY" config show --squash-owner 1000:1000 --gid-map 0:100:10
+assert_failure
+assert_output --partial "--squash-owner cannot be combined with --uid-map or --gid-map"
+}
@@ -0,0 +1,65 @@
+load helpers.bash
+
+@test "store profiles select the store and list spans all of them" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull busybox:latest
+assert_success
+
+mkdir -p "$BATS_TEST_TMPDIR/other"
+cat > "$BATS_TEST_TMPDIR/stores.conf" <<CONF
+[stores.project]
+path = "$RO_STORAGE"
+mksquashfs-opts = "-comp gzip"
+description = "Project images"
+
+[stores.other]
+path = "$BATS_TEST_TMPDIR/other"
+CONF
+export PARALLAX_CONFIG="$BATS_TEST_TMPDIR/stores.conf"
+
+run "$PARALLAX_BINARY" config show --store project
+assert_success
+assert_line --regexp "^roStoragePath +\"$RO_STORAGE\" +store project$"
+assert_line --regexp "^mksquashfs-opts +\"-comp gzip\" +store project$"
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--store project \
+		--migrate \
+		--image busybox:latest
+assert_success
+
+run "$PARALLAX_BINARY" list
+assert_success
+assert_line --regexp "^project +[0-9a-f]{12} +docker.io/library/busybox:latest +[0-9.]+[kM]?B +custom$"
+
+run "$PARALLAX_BINARY" list --store other
+assert_success
+refute_output --partial "busybox"
+}
+
+@test "store profiles restrict who may change them" {
+cat > "$BATS_TEST_TMPDIR/stores.conf" <<CONF
+[stores.locked]
+path = "$RO_STORAGE"
+users = ["no-such-user-here"]
+CONF
+PARALLAX_CONFIG="$BATS_TEST_TMPDIR/stores.conf" run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--store locked \
+		--rmi \
+		--image busybox:latest
+assert_failure
+assert_output --partial 'Store "locked" does not allow user'
+
+PARALLAX_CONFIG="$BATS_TEST_TMPDIR/stores.conf" run \
+	"$PARALLAX_BINARY" list --store missing
+assert_failure
+assert_output --partial 'Unknown store "missing" (configured: locked)'
+}
@@ -0,0 +1,73 @@
+load helpers.bash
+
+# builds an image with files the rootless user cannot read outside the user namespace
+import_restricted_image() {
+	mkdir -p "$BATS_TEST_TMPDIR/rootfs/etc" "$BATS_TEST_TMPDIR/rootfs/data"
+	echo secret > "$BATS_TEST_TMPDIR/rootfs/etc/shadow"
+	echo plain > "$BATS_TEST_TMPDIR/rootfs/data/plain"
+	echo skipped > "$BATS_TEST_TMPDIR/rootfs/data/skipped"
+	tar --owner=0 --group=0 -C "$BATS_TEST_TMPDIR/rootfs" -cf "$BATS_TEST_TMPDIR/rootfs.tar" data
+	tar --owner=0 --group=42 --mode=000 -C "$BATS_TEST_TMPDIR/rootfs" -rf "$BATS_TEST_TMPDIR/rootfs.tar" etc/shadow
+
+	run \
+		"$PODMAN_BINARY" \
+			--root "$PODMAN_ROOT" \
+			--runroot "$PODMAN_RUNROOT" \
+			import "$BATS_TEST_TMPDIR/rootfs.tar" localhost/restricted:test
+	assert_success
+}
+
+@test "files with mode 000 keep their content, mode and owners" {
+import_restricted_image
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--migrate \
+		--image localhost/restricted:test
+assert_success
+refute_output --partial "cannot be read"
+
+run bash -c 'unsquashfs -lln "$(ls "$RO_STORAGE"/squash/*.squash | head -n1)" etc/shadow'
+assert_success
+assert_output --regexp "---------- 0/42 +7 "
+
+run \
+	"$PARALLAX_BINARY" inspect \
+		--roStoragePath "$RO_STORAGE" \
+		--log-output stderr \
+		--image localhost/restricted:test
+assert_success
+refute_output --partial "SquashReport"
+}
+
+@test "paths listed with -ef are left out of the side-car" {
+import_restricted_image
+echo data/skipped > "$BATS_TEST_TMPDIR/excludes"
+
+for builder in mksquashfs builtin; do
+	run \
+		"$PARALLAX_BINARY" \
+			--podmanRoot "$PODMAN_ROOT" \
+			--roStoragePath "$RO_STORAGE.$builder" \
+			--mksquashfsPath "$MKSQUASHFS_PATH" \
+			--squash-builder "$builder" \
+			--mksquashfs-opts "-noappend -comp gzip -ef $BATS_TEST_TMPDIR/excludes" \
+			--migrate \
+			--image localhost/restricted:test
+	assert_success
+
+	run bash -c "unsquashfs -l \"\$(ls \"$RO_STORAGE.$builder\"/squash/*.squash | head -n1)\""
+	assert_success
+	assert_output --partial "data/plain"
+	refute_output --partial "data/skipped"
+done
+}
+
+@test "a missing -ef file is an error" {
+run "$PARALLAX_BINARY" config show --squash-builder builtin --mksquashfs-opts "-ef /nonexistent/excludes"
+assert_failure
+assert_output --partial "exclude file: open /nonexistent/excludes"
+}
@@ -49,3 +49,54 @@ run \
 		--rmi \
 		--image docker.io/library/hello-world:linux
 }
+
+@test "unsupported mksquashfs options fail before touching the stores" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull docker.io/library/hello-world:linux
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--mksquashfs-opts "-noappend -comp no-such-compressor" \
+		--migrate \
+		--image docker.io/library/hello-world:linux
+assert_failure
+assert_output --partial "does not support no-such-compressor compression"
+run bash -c 'ls -A "$RO_STORAGE"'
+assert_output ""
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--mksquashfs-opts "-noappend -no-such-option" \
+		--migrate \
+		--image docker.io/library/hello-world:linux
+assert_failure
+assert_output --partial "does not know option -no-such-option"
+}
+
+@test "doctor reports the mksquashfs capabilities" {
+run \
+	"$PARALLAX_BINARY" doctor \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH"
+assert_output --regexp "\[ok  \] mksquashfs: .* version [0-9.]+, compressors: .*zstd"
+assert_output --partial "[ok  ] mksquashfs options: -noappend -comp zstd"
+
+run \
+	"$PARALLAX_BINARY" doctor \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--mksquashfs-opts "-comp zstd -Xbcj x86"
+assert_failure
+assert_output --partial "[FAIL] mksquashfs options: mksquashfs option -Xbcj is not supported by the zstd compressor"
+assert_output --partial "hint:"
+}
@@ -0,0 +1,43 @@
+load helpers.bash
+
+@test "verify passes for a fresh migration and catches a truncated squash file" {
+run \
+	"$PODMAN_BINARY" \
+		--root "$PODMAN_ROOT" \
+		--runroot "$PODMAN_RUNROOT" \
+		pull busybox:latest
+assert_success
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--log-level info \
+		--migrate \
+		--image busybox:latest
+assert_success
+assert_output --partial "Migration successfully completed"
+
+run \
+	"$PARALLAX_BINARY" verify \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--log-level info \
+		--image busybox:latest
+assert_success
+assert_output --partial "Verification successfully completed"
+
+# Simulate a broken write of the side-car
+run bash -c 'f=$(ls "$RO_STORAGE"/squash/*.squash | head -n1) && truncate -s 8192 "$f"'
+assert_success
+
+run \
+	"$PARALLAX_BINARY" verify \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--log-level info \
+		--image busybox:latest
+assert_failure
+assert_output --partial "Verification failed"
+}
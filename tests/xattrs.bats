@@ -0,0 +1,95 @@
+load helpers.bash
+
+# builds an image whose /data/tagged file carries a user.parallax xattr
+import_xattr_image() {
+	mkdir -p "$BATS_TEST_TMPDIR/rootfs/data"
+	echo tagged > "$BATS_TEST_TMPDIR/rootfs/data/tagged"
+	echo plain > "$BATS_TEST_TMPDIR/rootfs/data/plain"
+	setfattr -n user.parallax -v kept "$BATS_TEST_TMPDIR/rootfs/data/tagged"
+	tar --xattrs --xattrs-include='user.*' -C "$BATS_TEST_TMPDIR/rootfs" \
+		-cf "$BATS_TEST_TMPDIR/rootfs.tar" .
+
+	run \
+		"$PODMAN_BINARY" \
+			--root "$PODMAN_ROOT" \
+			--runroot "$PODMAN_RUNROOT" \
+			import "$BATS_TEST_TMPDIR/rootfs.tar" localhost/xattrs:test
+	assert_success
+}
+
+@test "xattrs dropped from the side-car are reported" {
+import_xattr_image
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--preset compat \
+		--migrate \
+		--image localhost/xattrs:test
+assert_success
+assert_output --partial "1 source files carry xattrs the squash file drops: user.parallax on 1, e.g. /data/tagged"
+assert_output --partial "Migrate with --xattr-policy preserve to keep them"
+}
+
+@test "xattr-policy fail refuses the migration before writing the store" {
+import_xattr_image
+
+run \
+	"$PARALLAX_BINARY" \
+		--podmanRoot "$PODMAN_ROOT" \
+		--roStoragePath "$RO_STORAGE" \
+		--mksquashfsPath "$MKSQUASHFS_PATH" \
+		--preset compat \
+		--xattr-policy fail \
+		--migrate \
+		--image localhost/xattrs:test
+assert_failure
+assert_output --partial "user.parallax on 1"
+
+run bash -c 'ls "$RO_STORAGE"/squash/*.squash'
+assert_failure
+}
+
+@test "xattr-policy preserve keeps xattrs in the side-car" {
+import_xattr_image
+
+for builder in mksquashfs builtin; do
+	run \
+		"$PARALLAX_BINARY" \
+			--podmanRoot "$PODMAN_ROOT" \
+			--roStoragePath "$RO_STORAGE.$builder" \
+			--mksquashfsPath "$MKSQUASHFS_PATH" \
+			--squash-builder "$builder" \
+			--preset compat \
+			--xattr-policy preserve \
+			--migrate \
+			--image localhost/xattrs:test
+	assert_success
+	assert_output --partial "Squash options (compat): -noappend -comp gzip"
+	refute_output --partial "-no-xattrs"
+
+	run \
+		"$PARALLAX_BINARY" inspect \
+			--roStoragePath "$RO_STORAGE.$builder" \
+			--log-output stderr \
+			--image localhost/xattrs:test
+	assert_success
+	assert_output --partial '"xattrs": true'
+
+	run bash -c "unsquashfs -lls -xattrs \"\$(ls \"$RO_STORAGE.$builder\"/squash/*.squash | head -n1)\" data/tagged"
+	assert_success
+	assert_output --partial "user.parallax"
+done
+}
+
+@test "xattr-policy values" {
+run "$PARALLAX_BINARY" config show --xattr-policy keep
+assert_failure
+assert_output --partial 'Invalid xattr-policy "keep" (ignore, warn, fail or preserve)'
+
+run "$PARALLAX_BINARY" config show --xattr-policy preserve --mksquashfs-opts "-comp xz -no-xattrs"
+assert_failure
+assert_output --partial "--xattr-policy preserve cannot keep xattrs with -no-xattrs in mksquashfs-opts"
+}